@@ -9,6 +9,7 @@ import (
 	"github.com/chachabrian/mooveit-backend/internal/handlers"
 	"github.com/chachabrian/mooveit-backend/internal/middleware"
 	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -51,9 +52,43 @@ func main() {
 		log.Fatalf("Failed to initialize storage: %v", err)
 	}
 
+	// Load the SMS, email and push message templates (TEMPLATES_DIR, ./templates by default)
+	templatesDir := os.Getenv("TEMPLATES_DIR")
+	if templatesDir == "" {
+		templatesDir = "templates"
+	}
+	if err := utils.LoadMessageTemplates(templatesDir); err != nil {
+		log.Fatalf("Failed to load message templates: %v", err)
+	}
+	if err := handlers.CheckNotificationTemplates(); err != nil {
+		log.Fatalf("Failed to load message templates: %v", err)
+	}
+
+	// Initialize geocoding and geocode rides listed before it existed
+	services.InitGeocoder()
+	go handlers.BackfillRideCoordinates(db)
+
 	// Initialize WebSocket hub
-	hub := services.NewHub()
+	wsConfig := services.LoadWebSocketConfig()
+	if wsConfig.MapTokenSecret == "" {
+		log.Fatal("MAP_TOKEN_SECRET or JWT_SECRET must be set")
+	}
+	hub := services.NewHubWithConfig(wsConfig)
+	locationBatcher := handlers.NewLocationBatcher(db)
+	handlers.RegisterWebSocketCommands(db, hub, locationBatcher)
 	go hub.Run()
+	go locationBatcher.Run()
+	go handlers.NewDriverSweeper(db, hub).Run()
+	go handlers.NewRideGenerator(db, hub).Run()
+	go handlers.NewBookingExpirer(db, hub).Run()
+
+	// Send queued SMS, email and push notifications in the background
+	services.RegisterWebSocketJob(hub)
+	handlers.TrackNotificationDeliveries(db)
+	handlers.PruneUnregisteredTokens(db)
+	go services.RunJobWorkers()
+	go handlers.NewOutboxRelay(db).Run()
+	go handlers.NewNotificationPruner(db).Run()
 
 	// Initialize router
 	r := gin.Default()
@@ -61,12 +96,17 @@ func main() {
 	// Configure CORS
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{"*"}
-	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization"}
+	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Admin-Key", "Idempotency-Key"}
+	config.ExposeHeaders = []string{"X-Next-Cursor"}
 	r.Use(cors.New(config))
 
 	// Serve static files
 	r.Static("/uploads", "/app/uploads")
 	r.Static("/static", "./static")
+	r.LoadHTMLFiles("./static/track.html")
+
+	// Public parcel tracking page linked from receiver messages
+	r.GET("/track/:code", middleware.RateLimitMiddleware("track", 30, time.Minute), handlers.TrackParcelPage(db))
 
 	// Routes
 	api := r.Group("/api")
@@ -82,6 +122,14 @@ func main() {
 			auth.POST("/reset-password", handlers.ResetPassword(db))
 		}
 
+		// Public parcel tracking
+		track := api.Group("/track")
+		track.Use(middleware.RateLimitMiddleware("track", 30, time.Minute))
+		{
+			track.GET("/:code", handlers.TrackParcel(db))
+			track.GET("/:code/proof", handlers.GetDeliveryProofByTrackingCode(db))
+		}
+
 		// WebSocket connection
 		api.GET("/ws", middleware.AuthMiddleware(), handlers.WebSocketHandler(hub))
 
@@ -99,8 +147,8 @@ func main() {
 			// Driver location and availability routes
 			driver := protected.Group("/driver")
 			{
-				driver.POST("/location", handlers.UpdateDriverLocation(db, hub))
-				driver.POST("/availability", handlers.UpdateDriverAvailability(db))
+				driver.POST("/location", handlers.UpdateDriverLocation(db, hub, locationBatcher))
+				driver.POST("/availability", handlers.UpdateDriverAvailability(db, hub))
 				driver.GET("/status", handlers.GetDriverStatus(db))
 				driver.GET("/assigned-rides", handlers.GetDriverAssignedRides(db))
 				driver.POST("/rides/:rideId/accept", handlers.AcceptRide(db, hub))
@@ -108,13 +156,18 @@ func main() {
 				driver.POST("/rides/:rideId/arrived", handlers.DriverArrived(db, hub))
 				driver.POST("/rides/:rideId/start", handlers.StartRide(db, hub))
 				driver.GET("/trip-history", handlers.GetDriverTripHistory(db))
+				driver.GET("/sessions", handlers.GetDriverSessions(db))
+				driver.GET("/sessions/summary", handlers.GetDriverSessionSummary(db))
+				driver.GET("/parcel-requests", handlers.GetDriverParcelRequests(db))
+				driver.PATCH("/trips/:rideId/status", handlers.UpdateTripStatus(db, hub))
+				driver.POST("/bookings/:bookingId/delivered", handlers.MarkBookingDelivered(db, hub))
 			}
 
 			// Rides routes
 			rides := protected.Group("/rides")
 			{
 				rides.GET("", handlers.GetAvailableRides(db))
-				rides.POST("", handlers.CreateRide(db))
+				rides.POST("", handlers.CreateRide(db, hub))
 				rides.GET("/driver", handlers.GetDriverRides(db))
 				rides.GET("/all", handlers.GetAllRides(db))
 				rides.DELETE("/:id", handlers.DeleteRide(db))
@@ -129,6 +182,17 @@ func main() {
 				rides.GET("/trip-history", handlers.GetClientTripHistory(db))
 			}
 
+			// Recurring rides
+			rideTemplates := protected.Group("/ride-templates")
+			{
+				rideTemplates.POST("", handlers.CreateRideTemplate(db, hub))
+				rideTemplates.GET("", handlers.GetRideTemplates(db))
+				rideTemplates.GET("/:id", handlers.GetRideTemplate(db))
+				rideTemplates.DELETE("/:id", handlers.CancelRideTemplate(db, hub))
+				rideTemplates.POST("/:id/occurrences/:date/skip", handlers.SkipRideOccurrence(db, hub))
+				rideTemplates.PATCH("/:id/occurrences/:date", handlers.UpdateRideOccurrence(db, hub))
+			}
+
 			// Pricing routes
 			pricing := protected.Group("/pricing")
 			{
@@ -154,6 +218,29 @@ func main() {
 			parcels := protected.Group("/parcels")
 			{
 				parcels.POST("", handlers.CreateParcel(db))
+				parcels.PATCH("/:id/status", handlers.UpdateParcelStatus(db, hub))
+				parcels.GET("/:id/history", handlers.GetParcelHistory(db))
+				parcels.POST("/:id/delivery-code", handlers.ResendDeliveryCode(db))
+				parcels.POST("/:id/deliver", handlers.CompleteDelivery(db, hub))
+				parcels.GET("/:id/proof", handlers.GetDeliveryProof(db))
+			}
+
+			// Parcel requests matched against rides heading the same way
+			parcelRequests := protected.Group("/parcel-requests")
+			{
+				parcelRequests.POST("", handlers.CreateParcelRequest(db, hub))
+				parcelRequests.GET("", handlers.GetParcelRequests(db))
+				parcelRequests.GET("/:id/matches", handlers.GetParcelRequestMatches(db))
+				parcelRequests.POST("/:id/cancel", handlers.CancelParcelRequest(db))
+			}
+
+			// Insurance and claims routes
+			protected.GET("/insurance/tiers", handlers.GetInsuranceTiers())
+			claims := protected.Group("/claims")
+			{
+				claims.POST("", handlers.FileClaim(db))
+				claims.GET("", handlers.GetClientClaims(db))
+				claims.GET("/:id", handlers.GetClaim(db))
 			}
 
 			// Notification routes
@@ -161,10 +248,17 @@ func main() {
 			{
 				notifications.POST("/register-token", handlers.RegisterFCMToken(db))
 				notifications.DELETE("/remove-token", handlers.RemoveFCMToken(db))
+				notifications.GET("/devices", handlers.GetDevices(db))
 				notifications.POST("/test", handlers.TestNotification(db))
 				notifications.POST("/broadcast", handlers.SendBroadcastNotificationHandler(db))
 				notifications.POST("/scheduled-rides-available", handlers.NotifyScheduledRidesAvailable(db))
 
+				// Notification inbox
+				notifications.GET("", handlers.ListNotifications(db))
+				notifications.GET("/unread-count", handlers.GetUnreadNotificationCount(db))
+				notifications.POST("/read-all", handlers.MarkAllNotificationsRead(db, hub))
+				notifications.POST("/:id/read", handlers.MarkNotificationRead(db, hub))
+
 				// Notification preferences
 				notifications.GET("/preferences", handlers.GetNotificationPreferences(db))
 				notifications.PUT("/preferences", handlers.UpdateNotificationPreferences(db))
@@ -172,6 +266,17 @@ func main() {
 		}
 	}
 
+	// Admin routes, authenticated with the ADMIN_API_KEY
+	admin := r.Group("/api/admin")
+	admin.Use(middleware.AdminMiddleware())
+	{
+		admin.GET("/claims", handlers.ListClaims(db))
+		admin.PATCH("/claims/:id", handlers.ResolveClaim(db, hub))
+		admin.GET("/jobs/dead", handlers.ListDeadJobs())
+		admin.POST("/jobs/dead/:id/retry", handlers.RetryDeadJob())
+		admin.GET("/ws/stats", handlers.WebSocketStats(hub))
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
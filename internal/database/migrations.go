@@ -1,6 +1,8 @@
 package database
 
 import (
+	"log"
+
 	"github.com/chachabrian/mooveit-backend/internal/models"
 	"gorm.io/gorm"
 )
@@ -20,6 +22,20 @@ func RunMigrations(db *gorm.DB) error {
 		&models.DriverPricing{},
 		&models.TripCompletion{},
 		&models.NotificationPreference{},
+		&models.DriverSession{},
+		&models.ParcelStatusEvent{},
+		&models.ProofOfDelivery{},
+		&models.Claim{},
+		&models.ClaimPhoto{},
+		&models.LedgerEntry{},
+		&models.ParcelRequest{},
+		&models.ParcelRequestMatch{},
+		&models.RideTemplate{},
+		&models.RideTemplateException{},
+		&models.OutboxMessage{},
+		&models.NotificationDelivery{},
+		&models.Notification{},
+		&models.DeviceToken{},
 	)
 	if err != nil {
 		return err
@@ -33,7 +49,6 @@ func RunMigrations(db *gorm.DB) error {
 			"ADD COLUMN IF NOT EXISTS car_color text DEFAULT ''",
 			"ADD COLUMN IF NOT EXISTS user_type text DEFAULT 'client'",
 			"ADD COLUMN IF NOT EXISTS is_verified boolean DEFAULT false",
-			"ADD COLUMN IF NOT EXISTS fcm_token text DEFAULT ''",
 		}
 
 		for _, column := range columns {
@@ -47,6 +62,72 @@ func RunMigrations(db *gorm.DB) error {
 		db.Exec(`ALTER TABLE users ADD CONSTRAINT users_user_type_check CHECK (user_type IN ('client', 'driver'))`)
 	}
 
+	// A driver has at most one open session. End duplicates opened before
+	// this was enforced at their start, so they add no online time.
+	if err := db.Exec(`
+		UPDATE driver_sessions
+		SET ended_at = started_at, end_reason = ?
+		WHERE ended_at IS NULL AND deleted_at IS NULL AND id NOT IN (
+			SELECT MIN(id) FROM driver_sessions
+			WHERE ended_at IS NULL AND deleted_at IS NULL
+			GROUP BY driver_id
+		)`, models.SessionEndOffline).Error; err != nil {
+		return err
+	}
+	if err := db.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_driver_sessions_open
+		ON driver_sessions (driver_id)
+		WHERE ended_at IS NULL AND deleted_at IS NULL`).Error; err != nil {
+		return err
+	}
+
+	// Users used to have a single FCM token. Move it to their devices.
+	if db.Migrator().HasColumn(&models.User{}, "fcm_token") {
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec(`
+				INSERT INTO device_tokens (user_id, token, platform, app_version, last_seen_at, created_at, updated_at)
+				SELECT id, fcm_token, '', '', updated_at, NOW(), NOW()
+				FROM users
+				WHERE fcm_token IS NOT NULL AND fcm_token <> ''
+				ON CONFLICT (token) DO NOTHING`).Error; err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&models.User{}, "fcm_token")
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Derive the capacity of rides created before capacity was tracked.
+	// Their bookings carry no parcel weights, so all of it is left free.
+	var rides []models.Ride
+	if err := db.Where("capacity_kg IS NULL").Find(&rides).Error; err != nil {
+		return err
+	}
+	for _, ride := range rides {
+		capacity, ok := models.CapacityForTruckSize(ride.TruckSize)
+		if !ok {
+			continue
+		}
+		if err := db.Model(&ride).Updates(map[string]interface{}{
+			"capacity_kg":  capacity.WeightKg,
+			"capacity_m3":  capacity.VolumeM3,
+			"remaining_kg": capacity.WeightKg,
+			"remaining_m3": capacity.VolumeM3,
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	// Price bookings made before insurance at their ride's price
+	if err := db.Exec(`
+		UPDATE bookings
+		SET total_price = rides.price + bookings.insurance_premium
+		FROM rides
+		WHERE rides.id = bookings.ride_id AND bookings.total_price = 0`).Error; err != nil {
+		return err
+	}
+
 	// Handle parcels table separately
 	if !db.Migrator().HasTable(&models.Parcel{}) {
 		// If table doesn't exist, create it with all columns
@@ -89,6 +170,42 @@ func RunMigrations(db *gorm.DB) error {
 				return err
 			}
 		}
+
+		// Parcels used to belong to a ride only. Attach them to the booking
+		// and client of rides with a single live booking. Rejected,
+		// cancelled and expired bookings never carried the parcels. On
+		// shared rides there is no telling whose parcel is whose, so those
+		// stay unassigned, and hidden from every client, for manual review.
+		if err := db.Exec(`
+			UPDATE parcels
+			SET booking_id = b.id, client_id = b.client_id
+			FROM (
+				SELECT MIN(id) AS id, ride_id, MIN(client_id) AS client_id
+				FROM bookings
+				WHERE deleted_at IS NULL
+				AND status IN ('pending', 'accepted', 'in_progress', 'delivered', 'completed')
+				GROUP BY ride_id
+				HAVING count(*) = 1
+			) b
+			WHERE parcels.ride_id = b.ride_id AND parcels.booking_id IS NULL AND parcels.client_id = 0`).Error; err != nil {
+			return err
+		}
+
+		var unassigned int64
+		if err := db.Model(&models.Parcel{}).Where("booking_id IS NULL AND client_id = 0").Count(&unassigned).Error; err != nil {
+			return err
+		}
+		if unassigned > 0 {
+			log.Printf("%d parcels on shared rides have no booking and need to be assigned manually", unassigned)
+		}
+
+		// Give parcels created before tracking a tracking code
+		if err := db.Exec(`
+			UPDATE parcels
+			SET tracking_code = 'MV' || upper(substr(md5(random()::text || id::text), 1, 8))
+			WHERE tracking_code IS NULL OR tracking_code = ''`).Error; err != nil {
+			return err
+		}
 	}
 
 	return nil
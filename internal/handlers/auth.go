@@ -24,6 +24,13 @@ func Register(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		if input.PreferredLanguage == "" {
+			input.PreferredLanguage = utils.DefaultLanguage
+		} else if !utils.SupportedLanguage(input.PreferredLanguage) {
+			c.JSON(400, gin.H{"error": "Unsupported language"})
+			return
+		}
+
 		// Hash the password
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
 		if err != nil {
@@ -32,12 +39,13 @@ func Register(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		user := models.User{
-			Username:     input.Username,
-			Email:        input.Email,
-			PasswordHash: string(hashedPassword),
-			PhoneNumber:  input.Phone,
-			UserType:     models.UserType(input.UserType), // Convert string to UserType
-			IsVerified:   false,                           // New users start unverified
+			Username:          input.Username,
+			Email:             input.Email,
+			PasswordHash:      string(hashedPassword),
+			PhoneNumber:       input.Phone,
+			UserType:          models.UserType(input.UserType), // Convert string to UserType
+			IsVerified:        false,                           // New users start unverified
+			PreferredLanguage: input.PreferredLanguage,
 		}
 
 		if result := db.Create(&user); result.Error != nil {
@@ -64,7 +72,7 @@ func Register(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		// Send verification email
-		if err := utils.SendEmailVerificationOTP(user.Email, otp); err != nil {
+		if err := utils.SendEmailVerificationOTP(user.Email, otp, user.PreferredLanguage); err != nil {
 			c.JSON(500, gin.H{"error": "Failed to send verification email: " + err.Error()})
 			return
 		}
@@ -72,12 +80,13 @@ func Register(db *gorm.DB) gin.HandlerFunc {
 		c.JSON(201, gin.H{
 			"message": "User created successfully. Please check your email for verification code.",
 			"user": gin.H{
-				"id":          user.ID,
-				"email":       user.Email,
-				"username":    user.Username,
-				"phoneNumber": user.PhoneNumber,
-				"userType":    user.UserType,
-				"isVerified":  user.IsVerified,
+				"id":                user.ID,
+				"email":             user.Email,
+				"username":          user.Username,
+				"phoneNumber":       user.PhoneNumber,
+				"userType":          user.UserType,
+				"isVerified":        user.IsVerified,
+				"preferredLanguage": user.PreferredLanguage,
 			},
 			"requiresVerification": true,
 		})
@@ -90,6 +99,8 @@ type RegisterInput struct {
 	Password string `json:"password" binding:"required,min=6"`
 	Phone    string `json:"phone"`
 	UserType string `json:"userType" binding:"required,oneof=client driver"`
+	// PreferredLanguage is the language messages are sent in, English by default
+	PreferredLanguage string `json:"preferredLanguage"`
 }
 
 func Login(db *gorm.DB) gin.HandlerFunc {
@@ -138,7 +149,7 @@ func Login(db *gorm.DB) gin.HandlerFunc {
 			}
 
 			// Send verification email
-			if err := utils.SendEmailVerificationOTP(user.Email, otp); err != nil {
+			if err := utils.SendEmailVerificationOTP(user.Email, otp, user.PreferredLanguage); err != nil {
 				c.JSON(500, gin.H{"error": "Failed to send verification email: " + err.Error()})
 				return
 			}
@@ -161,12 +172,13 @@ func Login(db *gorm.DB) gin.HandlerFunc {
 		c.JSON(200, gin.H{
 			"token": token,
 			"user": gin.H{
-				"id":          user.ID,
-				"email":       user.Email,
-				"username":    user.Username,
-				"phoneNumber": user.PhoneNumber,
-				"userType":    user.UserType,
-				"isVerified":  user.IsVerified,
+				"id":                user.ID,
+				"email":             user.Email,
+				"username":          user.Username,
+				"phoneNumber":       user.PhoneNumber,
+				"userType":          user.UserType,
+				"isVerified":        user.IsVerified,
+				"preferredLanguage": user.PreferredLanguage,
 			},
 		})
 	}
@@ -222,7 +234,7 @@ func RequestPasswordReset(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		// Send OTP via email and SMS
-		if err := utils.SendPasswordResetOTP(user.Email, user.PhoneNumber, otp); err != nil {
+		if err := utils.SendPasswordResetOTP(user.Email, user.PhoneNumber, otp, user.PreferredLanguage); err != nil {
 			c.JSON(500, gin.H{"error": "Failed to send OTP: " + err.Error()})
 			return
 		}
@@ -390,12 +402,13 @@ func VerifyEmail(db *gorm.DB) gin.HandlerFunc {
 			"message": "Email verified successfully",
 			"token":   token,
 			"user": gin.H{
-				"id":          user.ID,
-				"email":       user.Email,
-				"username":    user.Username,
-				"phoneNumber": user.PhoneNumber,
-				"userType":    user.UserType,
-				"isVerified":  user.IsVerified,
+				"id":                user.ID,
+				"email":             user.Email,
+				"username":          user.Username,
+				"phoneNumber":       user.PhoneNumber,
+				"userType":          user.UserType,
+				"isVerified":        user.IsVerified,
+				"preferredLanguage": user.PreferredLanguage,
 			},
 		})
 	}
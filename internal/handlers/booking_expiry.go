@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"log"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+	"gorm.io/gorm"
+)
+
+// bookingExpiryInterval is how often unanswered bookings are looked for
+const bookingExpiryInterval = 5 * time.Minute
+
+// pendingBookingTTL is how long a driver has to answer a booking
+func pendingBookingTTL() time.Duration {
+	return utils.EnvDuration("BOOKING_PENDING_TTL", 24*time.Hour)
+}
+
+// BookingExpirer expires bookings the driver never answered, so the client
+// can look for another ride and the space they held is freed
+type BookingExpirer struct {
+	db  *gorm.DB
+	hub *services.Hub
+}
+
+// NewBookingExpirer creates an expirer using BOOKING_PENDING_TTL (e.g. "24h")
+// as the time drivers have to answer
+func NewBookingExpirer(db *gorm.DB, hub *services.Hub) *BookingExpirer {
+	return &BookingExpirer{db: db, hub: hub}
+}
+
+// Run expires bookings until the process exits
+func (e *BookingExpirer) Run() {
+	ticker := time.NewTicker(bookingExpiryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		e.Expire()
+	}
+}
+
+// Expire expires pending bookings older than the TTL or whose ride has
+// already left
+func (e *BookingExpirer) Expire() {
+	now := time.Now()
+
+	var bookings []models.Booking
+	if err := e.db.Preload("Ride").
+		Joins("JOIN rides ON rides.id = bookings.ride_id").
+		Where("bookings.status = ?", models.BookingStatusPending).
+		Where("bookings.created_at < ? OR rides.date < ?", now.Add(-pendingBookingTTL()), now).
+		Limit(500).
+		Find(&bookings).Error; err != nil {
+		log.Printf("Failed to find pending bookings: %v", err)
+		return
+	}
+
+	count := 0
+	for _, booking := range bookings {
+		var expired bool
+		if err := e.db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			expired, err = expireBooking(tx, &booking)
+			return err
+		}); err != nil {
+			log.Printf("Failed to expire booking %d: %v", booking.ID, err)
+			continue
+		}
+		if expired {
+			count++
+			notifyBookingStatus(e.db, e.hub, booking, booking.Ride)
+		}
+	}
+
+	if count > 0 {
+		log.Printf("Expired %d unanswered bookings", count)
+	}
+}
@@ -1,15 +1,15 @@
 package handlers
 
 import (
-	"context"
+	"errors"
 	"fmt"
-	"log"
+	"time"
 
 	"github.com/chachabrian/mooveit-backend/internal/models"
-	"github.com/chachabrian/mooveit-backend/internal/services"
 	"github.com/chachabrian/mooveit-backend/pkg/utils"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // CreateBooking handles the creation of a new booking
@@ -17,7 +17,8 @@ func CreateBooking(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userId := c.GetUint("userId")
 		var input struct {
-			RideID uint `json:"rideId" binding:"required"`
+			RideID    uint   `json:"rideId" binding:"required"`
+			ParcelIDs []uint `json:"parcelIds"` // defaults to all of the client's unbooked parcels on the ride
 		}
 
 		if err := c.ShouldBindJSON(&input); err != nil {
@@ -25,6 +26,19 @@ func CreateBooking(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		// A retried request carries the same key and gets the original booking back
+		var idempotencyKey *string
+		if key := c.GetHeader("Idempotency-Key"); key != "" {
+			if len(key) > 255 {
+				c.JSON(400, gin.H{"error": "Idempotency-Key is too long"})
+				return
+			}
+			if replayIdempotentBooking(c, db, userId, input.RideID, key) {
+				return
+			}
+			idempotencyKey = &key
+		}
+
 		// Start a transaction
 		tx := db.Begin()
 		if tx.Error != nil {
@@ -32,14 +46,54 @@ func CreateBooking(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		// Load the ride with driver information
+		// Lock the ride so bookings on it are created one at a time
 		var ride models.Ride
-		if err := tx.Preload("Driver").First(&ride, input.RideID).Error; err != nil {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&ride, input.RideID).Error; err != nil {
 			tx.Rollback()
 			c.JSON(404, gin.H{"error": "Ride not found"})
 			return
 		}
 
+		// A retry racing the original on the same ride waited for the lock above
+		if idempotencyKey != nil && replayIdempotentBooking(c, tx, userId, input.RideID, *idempotencyKey) {
+			tx.Rollback()
+			return
+		}
+
+		if ride.DriverID == userId {
+			tx.Rollback()
+			c.JSON(400, gin.H{"error": "You cannot book your own ride"})
+			return
+		}
+		if ride.Status != models.RideAvailable {
+			tx.Rollback()
+			c.JSON(409, gin.H{"error": "This ride is no longer available"})
+			return
+		}
+		if !ride.Date.After(time.Now()) {
+			tx.Rollback()
+			c.JSON(400, gin.H{"error": "This ride has already left"})
+			return
+		}
+
+		// More parcels are added to an existing booking, not a second one
+		var active models.Booking
+		if err := tx.Where("ride_id = ? AND client_id = ? AND status IN ?", ride.ID, userId,
+			[]models.BookingStatus{models.BookingStatusPending, models.BookingStatusAccepted}).
+			First(&active).Error; err == nil {
+			tx.Rollback()
+			c.JSON(409, gin.H{"error": "You have already booked this ride", "bookingId": active.ID})
+			return
+		}
+
+		var driver models.User
+		if err := tx.First(&driver, ride.DriverID).Error; err != nil {
+			tx.Rollback()
+			c.JSON(500, gin.H{"error": "Failed to load driver information"})
+			return
+		}
+		ride.Driver = &driver
+
 		// Load the client information
 		var client models.User
 		if err := tx.First(&client, userId).Error; err != nil {
@@ -48,66 +102,118 @@ func CreateBooking(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		// Book the client's parcels for this ride and hold space for them
+		var parcels []models.Parcel
+		parcelQuery := tx.Where("ride_id = ? AND client_id = ? AND booking_id IS NULL", input.RideID, userId)
+		if len(input.ParcelIDs) > 0 {
+			parcelQuery = parcelQuery.Where("id IN ?", input.ParcelIDs)
+		}
+		if err := parcelQuery.Find(&parcels).Error; err != nil {
+			tx.Rollback()
+			c.JSON(500, gin.H{"error": "Failed to load parcels"})
+			return
+		}
+		if len(input.ParcelIDs) > 0 && len(parcels) != len(input.ParcelIDs) {
+			tx.Rollback()
+			c.JSON(404, gin.H{"error": "Some parcels were not found on this ride or are already booked"})
+			return
+		}
+
 		booking := models.Booking{
-			ClientID: userId,
-			RideID:   input.RideID,
-			Status:   models.BookingStatusPending,
+			ClientID:       userId,
+			RideID:         input.RideID,
+			Status:         models.BookingStatusPending,
+			IdempotencyKey: idempotencyKey,
+		}
+		parcelIDs := make([]uint, 0, len(parcels))
+		for _, parcel := range parcels {
+			booking.ReservedKg += parcel.WeightKg
+			booking.ReservedM3 += parcel.VolumeM3()
+			booking.InsurancePremium += parcel.InsurancePremium
+			parcelIDs = append(parcelIDs, parcel.ID)
+		}
+
+		booking.TotalPrice = ride.Price + booking.InsurancePremium
+
+		if err := reserveRideCapacity(tx, ride.ID, booking.ReservedKg, booking.ReservedM3); err != nil {
+			tx.Rollback()
+			if err == errRideFull {
+				c.JSON(409, gin.H{"error": "Not enough space left on this ride for your parcels"})
+				return
+			}
+			c.JSON(500, gin.H{"error": "Failed to reserve space on the ride"})
+			return
 		}
 
 		if err := tx.Create(&booking).Error; err != nil {
 			tx.Rollback()
+			// A retry on another ride got the key first
+			if idempotencyKey != nil && replayIdempotentBooking(c, db, userId, input.RideID, *idempotencyKey) {
+				return
+			}
 			c.JSON(500, gin.H{"error": "Failed to create booking"})
 			return
 		}
 
-		// Send notifications to driver
-		if err := utils.SendNewBookingNotificationToDriver(
-			ride.Driver.PhoneNumber,
-			ride.Destination,
-			client.Username,
-		); err != nil {
-			// Log the error but don't fail the transaction
-			log.Printf("Failed to send SMS to driver: %v", err)
-		}
-
-		if err := utils.SendNewBookingNotificationEmailToDriver(
-			ride.Driver.Email,
-			ride.Destination,
-			client.Username,
-		); err != nil {
-			// Log the error but don't fail the transaction
-			log.Printf("Failed to send email to driver: %v", err)
-		}
-
-		// Send FCM push notification to driver
-		if ride.Driver.FCMToken != "" {
-			ctx := context.Background()
-			payload := services.NotificationPayload{
-				Title: "New Booking Request!",
-				Body:  fmt.Sprintf("%s has booked your ride to %s", client.Username, ride.Destination),
-				Data: map[string]interface{}{
-					"type":        "new_booking",
-					"bookingId":   fmt.Sprintf("%d", booking.ID),
-					"rideId":      fmt.Sprintf("%d", ride.ID),
-					"clientName":  client.Username,
-					"destination": ride.Destination,
-				},
-			}
-			if err := services.SendNotificationToToken(ctx, ride.Driver.FCMToken, payload); err != nil {
-				log.Printf("Failed to send FCM notification to driver: %v", err)
+		if len(parcelIDs) > 0 {
+			result := tx.Model(&models.Parcel{}).
+				Where("id IN ? AND booking_id IS NULL", parcelIDs).
+				Update("booking_id", booking.ID)
+			if result.Error != nil || result.RowsAffected != int64(len(parcelIDs)) {
+				tx.Rollback()
+				c.JSON(409, gin.H{"error": "Parcels were booked by another request, please try again"})
+				return
 			}
 		}
 
+		// Notify the driver once the booking is committed
+		if err := notify(tx, Notification{
+			Event:  eventBookingCreated,
+			UserID: ride.DriverID,
+			Data: map[string]interface{}{
+				"bookingId":   fmt.Sprintf("%d", booking.ID),
+				"rideId":      fmt.Sprintf("%d", ride.ID),
+				"clientName":  client.Username,
+				"destination": ride.Destination,
+			},
+		}); err != nil {
+			tx.Rollback()
+			c.JSON(500, gin.H{"error": "Failed to queue notifications"})
+			return
+		}
+
 		// Commit transaction
 		if err := tx.Commit().Error; err != nil {
 			c.JSON(500, gin.H{"error": "Failed to commit transaction"})
 			return
 		}
 
+		for i := range parcels {
+			parcels[i].BookingID = &booking.ID
+		}
+		booking.Parcels = parcels
+
 		c.JSON(201, booking)
 	}
 }
 
+// replayIdempotentBooking answers with the client's booking made under key,
+// if there is one, and reports whether it did.
+func replayIdempotentBooking(c *gin.Context, db *gorm.DB, clientID, rideID uint, key string) bool {
+	var existing models.Booking
+	if err := db.Preload("Parcels").
+		Where("client_id = ? AND idempotency_key = ?", clientID, key).
+		First(&existing).Error; err != nil {
+		return false
+	}
+	if existing.RideID != rideID {
+		c.JSON(422, gin.H{"error": "Idempotency-Key was already used for another ride"})
+		return true
+	}
+	c.JSON(200, existing)
+	return true
+}
+
 // GetBookingStatus retrieves detailed booking information
 func GetBookingStatus(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -129,14 +235,19 @@ func GetBookingStatus(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		response := gin.H{
-			"id":          booking.ID,
-			"status":      booking.Status,
-			"clientName":  booking.Client.Username,
-			"clientPhone": booking.Client.PhoneNumber,
-			"pickup":      booking.Ride.CurrentLocation,
-			"destination": booking.Ride.Destination,
-			"date":        booking.Ride.Date,
-			"price":       booking.Ride.Price,
+			"id":               booking.ID,
+			"status":           booking.Status,
+			"clientName":       booking.Client.Username,
+			"clientPhone":      booking.Client.PhoneNumber,
+			"pickup":           booking.Ride.CurrentLocation,
+			"destination":      booking.Ride.Destination,
+			"date":             booking.Ride.Date,
+			"price":            booking.Ride.Price,
+			"insurancePremium": booking.InsurancePremium,
+			"totalPrice":       booking.TotalPrice,
+			"rideStatus":       booking.Ride.Status,
+			"deliveredAt":      booking.DeliveredAt,
+			"completedAt":      booking.CompletedAt,
 		}
 
 		if booking.Ride.Driver != nil {
@@ -162,6 +273,7 @@ func GetClientBookings(db *gorm.DB) gin.HandlerFunc {
 		if err := db.Where("client_id = ?", userId).
 			Preload("Ride").
 			Preload("Ride.Driver").
+			Preload("Parcels").
 			Find(&bookings).Error; err != nil {
 			c.JSON(500, gin.H{"error": "Failed to fetch bookings"})
 			return
@@ -279,7 +391,37 @@ func UpdateBookingStatus(db *gorm.DB) gin.HandlerFunc {
 		// Start a transaction
 		tx := db.Begin()
 
+		// Lock the ride and then the booking so answers to bookings on the
+		// same ride are applied one at a time
+		var ride models.Ride
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&ride, booking.RideID).Error; err != nil {
+			tx.Rollback()
+			c.JSON(500, gin.H{"error": "Failed to load ride"})
+			return
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&booking, booking.ID).Error; err != nil {
+			tx.Rollback()
+			c.JSON(500, gin.H{"error": "Failed to load booking"})
+			return
+		}
+		booking.Ride = ride
+
+		// Only pending bookings can be answered; accepted ones can still be
+		// called off until the ride leaves
+		if booking.Status != models.BookingStatusPending &&
+			(booking.Status != models.BookingStatusAccepted || input.Status == "accepted") {
+			tx.Rollback()
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Booking is already %s", booking.Status)})
+			return
+		}
+		if ride.Status != models.RideAvailable && ride.Status != models.RideBooked {
+			tx.Rollback()
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Ride is already %s", ride.Status)})
+			return
+		}
+
 		// Update booking status
+		wasAccepted := booking.Status == models.BookingStatusAccepted
 		booking.Status = models.BookingStatus(input.Status)
 		if err := tx.Save(&booking).Error; err != nil {
 			tx.Rollback()
@@ -287,22 +429,55 @@ func UpdateBookingStatus(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		// Bookings turned down because this one took the ride
+		var displaced []models.Booking
+
 		// Update ride status based on booking status
 		if input.Status == "accepted" {
-			if err := tx.Model(&booking.Ride).Update("status", "booked").Error; err != nil {
+			// Rides that track capacity stay open to other parcels until full.
+			// Pending bookings already hold their space, so they still fit.
+			if !ride.HasCapacity() || ride.IsFull() {
+				if err := tx.Model(&booking.Ride).Update("status", models.RideBooked).Error; err != nil {
+					tx.Rollback()
+					c.JSON(500, gin.H{"error": "Failed to update ride status"})
+					return
+				}
+			}
+
+			// Without capacity data the ride carries a single booking
+			if !ride.HasCapacity() {
+				if err := tx.Where("ride_id = ? AND id <> ? AND status = ?", ride.ID, booking.ID, models.BookingStatusPending).
+					Find(&displaced).Error; err != nil {
+					tx.Rollback()
+					c.JSON(500, gin.H{"error": "Failed to load other bookings"})
+					return
+				}
+				if len(displaced) > 0 {
+					if err := tx.Model(&models.Booking{}).
+						Where("ride_id = ? AND id <> ? AND status = ?", ride.ID, booking.ID, models.BookingStatusPending).
+						Update("status", models.BookingStatusRejected).Error; err != nil {
+						tx.Rollback()
+						c.JSON(500, gin.H{"error": "Failed to reject other bookings"})
+						return
+					}
+				}
+			}
+
+			// The client is charged for insurance once the booking goes ahead
+			if err := chargeInsurance(tx, booking, booking.InsurancePremium,
+				fmt.Sprintf("Insurance for booking %d", booking.ID)); err != nil {
 				tx.Rollback()
-				c.JSON(500, gin.H{"error": "Failed to update ride status"})
+				c.JSON(500, gin.H{"error": "Failed to record insurance premium"})
 				return
 			}
 
-			// Load necessary information for notifications
-			var client models.User
-			if err := tx.First(&client, booking.ClientID).Error; err != nil {
+			if err := markParcelRequestsBooked(tx, booking); err != nil {
 				tx.Rollback()
-				c.JSON(500, gin.H{"error": "Failed to load client information"})
+				c.JSON(500, gin.H{"error": "Failed to update parcel requests"})
 				return
 			}
 
+			// Load necessary information for notifications
 			var driver models.User
 			if err := tx.First(&driver, booking.Ride.DriverID).Error; err != nil {
 				tx.Rollback()
@@ -310,45 +485,19 @@ func UpdateBookingStatus(db *gorm.DB) gin.HandlerFunc {
 				return
 			}
 
-			var parcel models.Parcel
-			if err := tx.Where("ride_id = ?", booking.RideID).First(&parcel).Error; err != nil {
+			var parcels []models.Parcel
+			if err := tx.Where("booking_id = ?", booking.ID).Find(&parcels).Error; err != nil {
 				tx.Rollback()
 				c.JSON(500, gin.H{"error": "Failed to load parcel information"})
 				return
 			}
 
-			// Send SMS notifications
-			if err := utils.SendBookingAcceptedSMS(
-				client.PhoneNumber,
-				driver.Username,
-				driver.CarPlate,
-				parcel.ReceiverContact,
-				parcel.ReceiverName,
-			); err != nil {
-				// Log the error but don't fail the transaction
-				log.Printf("Failed to send SMS: %v", err)
-			}
-
-			// Send email notifications
-			if err := utils.SendBookingAcceptedEmail(
-				client.Email,
-				driver.Username,
-				driver.CarPlate,
-				parcel.ReceiverEmail,
-				parcel.ReceiverName,
-			); err != nil {
-				// Log the error but don't fail the transaction
-				log.Printf("Failed to send email: %v", err)
-			}
-
-			// Send FCM push notification to client
-			if client.FCMToken != "" {
-				ctx := context.Background()
-				payload := services.NotificationPayload{
-					Title: "Booking Accepted! 🎉",
-					Body:  fmt.Sprintf("%s has accepted your booking. Driver: %s (%s)", driver.Username, driver.CarMake, driver.CarPlate),
+			// Notify the client, and each receiver that their parcel is on the way
+			queued := []error{
+				notify(tx, Notification{
+					Event:  eventBookingAccepted,
+					UserID: booking.ClientID,
 					Data: map[string]interface{}{
-						"type":        "booking_accepted",
 						"bookingId":   fmt.Sprintf("%d", booking.ID),
 						"rideId":      fmt.Sprintf("%d", booking.Ride.ID),
 						"driverName":  driver.Username,
@@ -357,56 +506,68 @@ func UpdateBookingStatus(db *gorm.DB) gin.HandlerFunc {
 						"carMake":     driver.CarMake,
 						"carColor":    driver.CarColor,
 					},
+				}),
+			}
+			for _, parcel := range parcels {
+				message, err := utils.IncomingParcelMessage(parcel.ReceiverName, driver.Username, driver.CarPlate, parcel.TrackingCode)
+				if err != nil {
+					queued = append(queued, err)
+					continue
 				}
-				if err := services.SendNotificationToToken(ctx, client.FCMToken, payload); err != nil {
-					log.Printf("Failed to send FCM notification to client: %v", err)
-				}
+				queued = append(queued,
+					queueSMS(tx, parcel.ReceiverContact, message.SMS),
+					queueEmail(tx, parcel.ReceiverEmail, message.Subject, message.HTML),
+				)
+			}
+			if err := errors.Join(queued...); err != nil {
+				tx.Rollback()
+				c.JSON(500, gin.H{"error": "Failed to queue notifications"})
+				return
 			}
 
 		} else if input.Status == "cancelled" || input.Status == "rejected" {
-			// Reset ride status to available if booking is cancelled or rejected
-			if err := tx.Model(&booking.Ride).Update("status", "available").Error; err != nil {
+			if err := releaseRideCapacity(tx, booking); err != nil {
 				tx.Rollback()
-				c.JSON(500, gin.H{"error": "Failed to update ride status"})
+				c.JSON(500, gin.H{"error": "Failed to release space on the ride"})
 				return
 			}
 
-			if input.Status == "rejected" {
-				// Load client information for notifications
-				var client models.User
-				if err := tx.First(&client, booking.ClientID).Error; err != nil {
+			// Insurance was only charged once the booking was accepted
+			if wasAccepted {
+				if err := refundInsurance(tx, booking); err != nil {
 					tx.Rollback()
-					c.JSON(500, gin.H{"error": "Failed to load client information"})
+					c.JSON(500, gin.H{"error": "Failed to record insurance refund"})
 					return
 				}
+			}
 
-				// Send rejection notifications
-				if err := utils.SendBookingRejectedSMS(client.PhoneNumber); err != nil {
-					// Log the error but don't fail the transaction
-					log.Printf("Failed to send rejection SMS: %v", err)
+			// Reset ride status to available unless another booking still fills it
+			var accepted int64
+			tx.Model(&models.Booking{}).
+				Where("ride_id = ? AND id <> ? AND status = ?", booking.RideID, booking.ID, models.BookingStatusAccepted).
+				Count(&accepted)
+			if accepted == 0 || booking.Ride.HasCapacity() {
+				if err := tx.Model(&booking.Ride).Update("status", models.RideAvailable).Error; err != nil {
+					tx.Rollback()
+					c.JSON(500, gin.H{"error": "Failed to update ride status"})
+					return
 				}
+			}
 
-				if err := utils.SendBookingRejectedEmail(client.Email); err != nil {
-					// Log the error but don't fail the transaction
-					log.Printf("Failed to send rejection email: %v", err)
+			if input.Status == "rejected" {
+				if err := queueBookingRejected(tx, booking); err != nil {
+					tx.Rollback()
+					c.JSON(500, gin.H{"error": "Failed to queue notifications"})
+					return
 				}
+			}
+		}
 
-				// Send FCM push notification to client
-				if client.FCMToken != "" {
-					ctx := context.Background()
-					payload := services.NotificationPayload{
-						Title: "Booking Rejected",
-						Body:  "Unfortunately, the driver has rejected your booking request. Please try another ride.",
-						Data: map[string]interface{}{
-							"type":      "booking_rejected",
-							"bookingId": fmt.Sprintf("%d", booking.ID),
-							"rideId":    fmt.Sprintf("%d", booking.Ride.ID),
-						},
-					}
-					if err := services.SendNotificationToToken(ctx, client.FCMToken, payload); err != nil {
-						log.Printf("Failed to send FCM notification to client: %v", err)
-					}
-				}
+		for _, other := range displaced {
+			if err := queueBookingRejected(tx, other); err != nil {
+				tx.Rollback()
+				c.JSON(500, gin.H{"error": "Failed to queue notifications"})
+				return
 			}
 		}
 
@@ -417,10 +578,54 @@ func UpdateBookingStatus(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		c.JSON(200, gin.H{
-			"id":      booking.ID,
-			"status":  booking.Status,
-			"ride":    booking.Ride,
-			"message": "Booking status updated successfully",
+			"id":       booking.ID,
+			"status":   booking.Status,
+			"ride":     booking.Ride,
+			"rejected": len(displaced),
+			"message":  "Booking status updated successfully",
 		})
 	}
 }
+
+// chargeInsurance records that a client pays amount for insurance on
+// their booking
+func chargeInsurance(tx *gorm.DB, booking models.Booking, amount float64, description string) error {
+	if amount <= 0 {
+		return nil
+	}
+	return tx.Create(&models.LedgerEntry{
+		BookingID:   booking.ID,
+		UserID:      booking.ClientID,
+		Type:        models.LedgerInsurancePremium,
+		Amount:      amount,
+		Description: description,
+	}).Error
+}
+
+// refundInsurance reverses the insurance charged for an accepted booking
+// that is called off
+func refundInsurance(tx *gorm.DB, booking models.Booking) error {
+	if booking.InsurancePremium <= 0 {
+		return nil
+	}
+	return tx.Create(&models.LedgerEntry{
+		BookingID:   booking.ID,
+		UserID:      booking.ClientID,
+		Type:        models.LedgerInsuranceRefund,
+		Amount:      -booking.InsurancePremium,
+		Description: fmt.Sprintf("Insurance refund for cancelled booking %d", booking.ID),
+	}).Error
+}
+
+// queueBookingRejected tells a client the driver turned their booking down
+// once tx commits
+func queueBookingRejected(tx *gorm.DB, booking models.Booking) error {
+	return notify(tx, Notification{
+		Event:  eventBookingRejected,
+		UserID: booking.ClientID,
+		Data: map[string]interface{}{
+			"bookingId": fmt.Sprintf("%d", booking.ID),
+			"rideId":    fmt.Sprintf("%d", booking.RideID),
+		},
+	})
+}
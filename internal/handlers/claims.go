@@ -0,0 +1,365 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// claimWindow is how long after delivery or failure a claim may be filed
+	claimWindow = 14 * 24 * time.Hour
+	// maxClaimPhotos limits the evidence attached to one claim
+	maxClaimPhotos = 5
+)
+
+// GetInsuranceTiers lists the insurance cover clients can buy for parcels
+func GetInsuranceTiers() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"tiers": models.InsuranceTiers})
+	}
+}
+
+// FileClaim lets a client claim for an insured parcel that arrived damaged or
+// was lost. Photos of the damage are uploaded as multipart files "photos".
+func FileClaim(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+
+		var input struct {
+			ParcelID      uint    `form:"parcelId" binding:"required"`
+			Type          string  `form:"type" binding:"required,oneof=damage loss"`
+			Description   string  `form:"description" binding:"required,max=2000"`
+			AmountClaimed float64 `form:"amountClaimed" binding:"required,gt=0"`
+		}
+		if err := c.ShouldBind(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var parcel models.Parcel
+		if err := db.First(&parcel, input.ParcelID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Parcel not found"})
+			return
+		}
+
+		if parcel.ClientID != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the sender can claim for this parcel"})
+			return
+		}
+
+		if parcel.InsuranceTier == models.InsuranceNone || parcel.BookingID == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "This parcel is not insured"})
+			return
+		}
+
+		// Damage shows on delivery, loss once the delivery has failed
+		switch {
+		case input.Type == models.ClaimTypeDamage && parcel.Status != models.ParcelStatusDelivered:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Damage can only be claimed for delivered parcels"})
+			return
+		case input.Type == models.ClaimTypeLoss &&
+			parcel.Status != models.ParcelStatusFailed && parcel.Status != models.ParcelStatusReturned:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Loss can only be claimed for failed deliveries"})
+			return
+		}
+
+		if time.Since(parcel.StatusUpdatedAt) > claimWindow {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The period for claiming on this parcel has ended"})
+			return
+		}
+
+		if input.AmountClaimed > parcel.CoverageAmount {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":          "Amount claimed exceeds the parcel's cover",
+				"coverageAmount": parcel.CoverageAmount,
+			})
+			return
+		}
+
+		var open int64
+		db.Model(&models.Claim{}).
+			Where("parcel_id = ? AND status <> ?", parcel.ID, models.ClaimStatusRejected).
+			Count(&open)
+		if open > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "A claim has already been filed for this parcel"})
+			return
+		}
+
+		form, err := c.MultipartForm()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Photos of the parcel are required"})
+			return
+		}
+		files := form.File["photos"]
+		if input.Type == models.ClaimTypeDamage && len(files) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Photos of the damage are required"})
+			return
+		}
+		if len(files) > maxClaimPhotos {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d photos can be attached", maxClaimPhotos)})
+			return
+		}
+
+		claim := models.Claim{
+			BookingID:     *parcel.BookingID,
+			ParcelID:      parcel.ID,
+			ClientID:      userID,
+			Type:          input.Type,
+			Description:   input.Description,
+			AmountClaimed: input.AmountClaimed,
+			Status:        models.ClaimStatusSubmitted,
+		}
+		for _, file := range files {
+			url, err := services.UploadImage(file, "claims")
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload claim photo"})
+				return
+			}
+			claim.Photos = append(claim.Photos, models.ClaimPhoto{ImageURL: url})
+		}
+
+		if err := db.Create(&claim).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to file claim"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, claimResponse(claim))
+	}
+}
+
+// GetClientClaims lists the claims filed by the client
+func GetClientClaims(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+
+		var claims []models.Claim
+		if err := db.Preload("Photos").
+			Where("client_id = ?", userID).
+			Order("created_at DESC").
+			Find(&claims).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch claims"})
+			return
+		}
+
+		results := make([]gin.H, 0, len(claims))
+		for _, claim := range claims {
+			results = append(results, claimResponse(claim))
+		}
+		c.JSON(http.StatusOK, gin.H{"claims": results})
+	}
+}
+
+// GetClaim returns one of the client's claims
+func GetClaim(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+
+		var claim models.Claim
+		if err := db.Preload("Photos").First(&claim, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Claim not found"})
+			return
+		}
+
+		if claim.ClientID != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		c.JSON(http.StatusOK, claimResponse(claim))
+	}
+}
+
+// ListClaims lets admins review claims, optionally filtered by status
+func ListClaims(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+		if err != nil || limit < 1 || limit > 100 {
+			limit = 20
+		}
+
+		query := db.Model(&models.Claim{})
+		if status := c.Query("status"); status != "" {
+			query = query.Where("status = ?", status)
+		}
+
+		var total int64
+		query.Count(&total)
+
+		var claims []models.Claim
+		if err := query.Preload("Photos").
+			Order("created_at ASC").
+			Offset((page - 1) * limit).
+			Limit(limit).
+			Find(&claims).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch claims"})
+			return
+		}
+
+		results := make([]gin.H, 0, len(claims))
+		for _, claim := range claims {
+			results = append(results, claimResponse(claim))
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"claims": results,
+			"pagination": gin.H{
+				"page":       page,
+				"limit":      limit,
+				"total":      total,
+				"totalPages": (total + int64(limit) - 1) / int64(limit),
+			},
+		})
+	}
+}
+
+// ResolveClaim lets an admin move a claim under review, reject it, or approve
+// a payout. Approved payouts are recorded in the ledger against the booking.
+func ResolveClaim(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input struct {
+			Status         string  `json:"status" binding:"required,oneof=under_review approved rejected"`
+			AmountApproved float64 `json:"amountApproved" binding:"gte=0"`
+			Note           string  `json:"note" binding:"max=2000"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var claim models.Claim
+		if err := db.Preload("Photos").Preload("Parcel").First(&claim, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Claim not found"})
+			return
+		}
+
+		if claim.IsResolved() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Claim is already %s", claim.Status)})
+			return
+		}
+
+		if input.Status == models.ClaimStatusApproved {
+			if input.AmountApproved <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "amountApproved is required to approve a claim"})
+				return
+			}
+			if claim.Parcel != nil && input.AmountApproved > claim.Parcel.CoverageAmount {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":          "Amount approved exceeds the parcel's cover",
+					"coverageAmount": claim.Parcel.CoverageAmount,
+				})
+				return
+			}
+		} else {
+			input.AmountApproved = 0
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			updates := map[string]interface{}{
+				"status":          input.Status,
+				"amount_approved": input.AmountApproved,
+				"resolution_note": input.Note,
+			}
+			if input.Status != models.ClaimStatusUnderReview {
+				updates["resolved_at"] = time.Now()
+			}
+
+			// Only one admin can resolve a claim
+			result := tx.Model(&models.Claim{}).
+				Where("id = ? AND status IN ?", claim.ID, []string{models.ClaimStatusSubmitted, models.ClaimStatusUnderReview}).
+				Updates(updates)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return fmt.Errorf("claim %d was resolved concurrently", claim.ID)
+			}
+
+			if input.Status != models.ClaimStatusApproved {
+				return nil
+			}
+			entry := models.LedgerEntry{
+				BookingID:   claim.BookingID,
+				ClaimID:     &claim.ID,
+				UserID:      claim.ClientID,
+				Type:        models.LedgerClaimPayout,
+				Amount:      -input.AmountApproved,
+				Description: fmt.Sprintf("Payout for %s claim %d", claim.Type, claim.ID),
+			}
+			return tx.Create(&entry).Error
+		})
+		if err != nil {
+			log.Printf("Failed to resolve claim %d: %v", claim.ID, err)
+			c.JSON(http.StatusConflict, gin.H{"error": "Failed to update claim, reload and try again"})
+			return
+		}
+
+		if err := db.Preload("Photos").First(&claim, claim.ID).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load claim"})
+			return
+		}
+
+		notifyClaimStatus(db, hub, claim)
+		c.JSON(http.StatusOK, claimResponse(claim))
+	}
+}
+
+// notifyClaimStatus tells the client their claim changed status
+func notifyClaimStatus(db *gorm.DB, hub *services.Hub, claim models.Claim) {
+	data := gin.H{
+		"claimId":        claim.ID,
+		"parcelId":       claim.ParcelID,
+		"status":         claim.Status,
+		"amountApproved": claim.AmountApproved,
+	}
+
+	if message, err := json.Marshal(services.WebSocketMessage{Type: "claim_status", Data: data}); err == nil {
+		hub.BroadcastToUser(claim.ClientID, message)
+	}
+
+	notifyUser(db, Notification{
+		Event:  eventClaimStatus,
+		UserID: claim.ClientID,
+		Data: map[string]interface{}{
+			"claimId":        fmt.Sprintf("%d", claim.ID),
+			"status":         string(claim.Status),
+			"amountApproved": fmt.Sprintf("%.2f", claim.AmountApproved),
+		},
+	})
+}
+
+// claimResponse formats a claim with full photo URLs
+func claimResponse(claim models.Claim) gin.H {
+	photos := make([]string, 0, len(claim.Photos))
+	for _, photo := range claim.Photos {
+		photos = append(photos, services.GetImageURL(photo.ImageURL))
+	}
+
+	return gin.H{
+		"id":             claim.ID,
+		"bookingId":      claim.BookingID,
+		"parcelId":       claim.ParcelID,
+		"type":           claim.Type,
+		"description":    claim.Description,
+		"amountClaimed":  claim.AmountClaimed,
+		"amountApproved": claim.AmountApproved,
+		"status":         claim.Status,
+		"resolutionNote": claim.ResolutionNote,
+		"resolvedAt":     claim.ResolvedAt,
+		"photos":         photos,
+		"createdAt":      claim.CreatedAt,
+	}
+}
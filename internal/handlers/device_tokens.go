@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// deviceTokens returns the FCM tokens of every device a user is signed in on
+func deviceTokens(db *gorm.DB, userID uint) ([]string, error) {
+	var tokens []string
+	err := db.Model(&models.DeviceToken{}).Where("user_id = ?", userID).Pluck("token", &tokens).Error
+	return tokens, err
+}
+
+// saveDeviceToken records a device of the user. A token seen before moves to
+// this user, since whoever signed in last owns the device.
+func saveDeviceToken(db *gorm.DB, device models.DeviceToken) error {
+	device.LastSeenAt = time.Now()
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "token"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_id", "platform", "app_version", "last_seen_at", "updated_at"}),
+	}).Create(&device).Error
+}
+
+// PruneUnregisteredTokens deletes tokens FCM reports as no longer registered,
+// so devices the app was removed from stop being sent notifications
+func PruneUnregisteredTokens(db *gorm.DB) {
+	services.OnUnregisteredToken(func(ctx context.Context, token string) {
+		result := db.WithContext(ctx).Where("token = ?", token).Delete(&models.DeviceToken{})
+		if result.Error != nil {
+			log.Printf("Failed to delete unregistered device token: %v", result.Error)
+			return
+		}
+		if result.RowsAffected > 0 {
+			log.Printf("Deleted unregistered device token %s", services.TokenPrefix(token))
+		}
+	})
+}
+
+// GetDevices lists the devices the user receives push notifications on
+func GetDevices(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var devices []models.DeviceToken
+		if err := db.Where("user_id = ?", c.GetUint("userId")).
+			Order("last_seen_at DESC").
+			Find(&devices).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch devices"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"devices": devices})
+	}
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"log"
 	"sort"
 	"strconv"
 	"time"
@@ -13,8 +14,16 @@ import (
 	"gorm.io/gorm"
 )
 
-// UpdateDriverLocation handles driver location updates
-func UpdateDriverLocation(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
+// driverLocationInput is a single position report from a driver
+type driverLocationInput struct {
+	Lat     float64 `json:"lat" binding:"required"`
+	Lng     float64 `json:"lng" binding:"required"`
+	Heading float64 `json:"heading" binding:"required"`
+}
+
+// UpdateDriverLocation handles driver location updates. Drivers connected
+// over WebSocket should send "location" frames instead.
+func UpdateDriverLocation(db *gorm.DB, hub *services.Hub, batcher *LocationBatcher) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		driverID := c.GetUint("userId")
 		userType := c.GetString("userType")
@@ -24,104 +33,99 @@ func UpdateDriverLocation(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 			return
 		}
 
-		var input struct {
-			Lat     float64 `json:"lat" binding:"required"`
-			Lng     float64 `json:"lng" binding:"required"`
-			Heading float64 `json:"heading" binding:"required"`
-		}
-
+		var input driverLocationInput
 		if err := c.ShouldBindJSON(&input); err != nil {
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
 
-		// Validate coordinates
-		if input.Lat < -90 || input.Lat > 90 {
-			c.JSON(400, gin.H{"error": "Invalid latitude"})
-			return
-		}
-		if input.Lng < -180 || input.Lng > 180 {
-			c.JSON(400, gin.H{"error": "Invalid longitude"})
+		response, err := updateDriverLocation(db, hub, batcher, driverID, userType, input)
+		if err != nil {
+			respondActionError(c, err)
 			return
 		}
 
-		ctx := context.Background()
+		c.JSON(200, response)
+	}
+}
 
-		// Update location in Redis
-		if err := services.SetDriverLocation(ctx, driverID, input.Lat, input.Lng, input.Heading); err != nil {
-			c.JSON(500, gin.H{"error": "Failed to update location"})
-			return
-		}
+// updateDriverLocation stores a driver's position in Redis, queues it for
+// batched persistence and forwards it to the client of the active ride
+func updateDriverLocation(db *gorm.DB, hub *services.Hub, batcher *LocationBatcher, driverID uint, userType string, input driverLocationInput) (gin.H, error) {
+	if userType != string(models.UserTypeDriver) {
+		return nil, newActionError(403, "Only drivers can update location")
+	}
 
-		// Update or create location record in database
-		var location models.DriverLocation
-		result := db.Where("driver_id = ?", driverID).First(&location)
+	// Validate coordinates
+	if input.Lat < -90 || input.Lat > 90 {
+		return nil, newActionError(400, "Invalid latitude")
+	}
+	if input.Lng < -180 || input.Lng > 180 {
+		return nil, newActionError(400, "Invalid longitude")
+	}
 
-		if result.Error == gorm.ErrRecordNotFound {
-			// Create new location record
-			location = models.DriverLocation{
-				DriverID:  driverID,
-				Latitude:  input.Lat,
-				Longitude: input.Lng,
-				Heading:   input.Heading,
-				IsOnline:  true,
-				LastSeen:  time.Now(),
-			}
-			if err := db.Create(&location).Error; err != nil {
-				c.JSON(500, gin.H{"error": "Failed to create location record"})
-				return
-			}
-		} else if result.Error != nil {
-			c.JSON(500, gin.H{"error": "Failed to fetch location record"})
-			return
-		} else {
-			// Update existing location record
-			location.Latitude = input.Lat
-			location.Longitude = input.Lng
-			location.Heading = input.Heading
-			location.IsOnline = true
-			location.LastSeen = time.Now()
-			if err := db.Save(&location).Error; err != nil {
-				c.JSON(500, gin.H{"error": "Failed to update location record"})
-				return
-			}
-		}
+	ctx := context.Background()
 
-		// Publish location update to WebSocket clients
-		update := services.DriverLocationUpdate{
-			DriverID: driverID,
-		}
-		update.Location.Lat = input.Lat
-		update.Location.Lng = input.Lng
-		update.Location.Heading = input.Heading
-
-		// Check if driver has an active ride (accepted or started)
-		var activeRide models.RideRequest
-		if err := db.Where("driver_id = ? AND status IN (?)", driverID, []string{
-			models.RideStatusAccepted,
-			models.RideStatusArrived,
-			models.RideStatusStarted,
-		}).First(&activeRide).Error; err == nil {
-			// Driver has an active ride, send targeted update to the client
-			hub.SendDriverLocationUpdateToClient(activeRide.ClientID, update)
-		} else {
-			// No active ride, broadcast to all clients (for tracking available drivers)
-			hub.SendDriverLocationUpdate(update)
-		}
+	// Update location in Redis
+	if err := services.SetDriverLocation(ctx, driverID, input.Lat, input.Lng, input.Heading); err != nil {
+		return nil, newActionError(500, "Failed to update location")
+	}
 
-		c.JSON(200, gin.H{
-			"message": "Location updated successfully",
-			"location": gin.H{
-				"lat":     input.Lat,
-				"lng":     input.Lng,
-				"heading": input.Heading,
-			},
-		})
+	// Persist to the database on the next batch flush
+	batcher.Add(driverID, input.Lat, input.Lng, input.Heading)
+	services.TrackSessionDistance(ctx, driverID, input.Lat, input.Lng)
+
+	// Publish location update to WebSocket clients
+	update := services.DriverLocationUpdate{
+		DriverID: driverID,
+	}
+	update.Location.Lat = input.Lat
+	update.Location.Lng = input.Lng
+	update.Location.Heading = input.Heading
+
+	if clientID := activeRideClient(db, driverID); clientID != 0 {
+		// Driver has an active ride, send targeted update to the client
+		hub.SendDriverLocationUpdateToClient(clientID, update)
+	} else if isAvailable, err := services.GetDriverAvailability(ctx, driverID); err == nil && isAvailable {
+		// Show a coarse, anonymous marker to clients viewing this area
+		hub.PublishMapDriver(driverID, input.Lat, input.Lng, true)
 	}
+
+	return gin.H{
+		"message": "Location updated successfully",
+		"location": gin.H{
+			"lat":     input.Lat,
+			"lng":     input.Lng,
+			"heading": input.Heading,
+		},
+	}, nil
+}
+
+// activeRideClient returns the client of the driver's accepted, arrived or
+// started ride, or 0 if there is none. Lookups are cached briefly in Redis
+// since drivers report their location every few seconds.
+func activeRideClient(db *gorm.DB, driverID uint) uint {
+	ctx := context.Background()
+	if clientID, err := services.GetDriverActiveClient(ctx, driverID); err == nil {
+		return clientID
+	}
+
+	var clientID uint
+	var activeRide models.RideRequest
+	if err := db.Select("client_id").Where("driver_id = ? AND status IN (?)", driverID, []string{
+		models.RideStatusAccepted,
+		models.RideStatusArrived,
+		models.RideStatusStarted,
+	}).First(&activeRide).Error; err == nil {
+		clientID = activeRide.ClientID
+	}
+
+	services.SetDriverActiveClient(ctx, driverID, clientID)
+	return clientID
 }
 
 // UpdateDriverAvailability handles driver availability updates
-func UpdateDriverAvailability(db *gorm.DB) gin.HandlerFunc {
+func UpdateDriverAvailability(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		driverID := c.GetUint("userId")
 		userType := c.GetString("userType")
@@ -145,6 +149,17 @@ func UpdateDriverAvailability(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		// Drivers on an enforced break cannot go online
+		if *input.IsAvailable {
+			if breakEnd := breakEndsAt(db, driverID, time.Now()); breakEnd != nil {
+				c.JSON(403, gin.H{
+					"error":      "You have reached the online limit and must take a break",
+					"breakUntil": breakEnd,
+				})
+				return
+			}
+		}
+
 		ctx := context.Background()
 
 		// Update availability in Redis
@@ -156,8 +171,19 @@ func UpdateDriverAvailability(db *gorm.DB) gin.HandlerFunc {
 		// Update availability in database
 		var location models.DriverLocation
 		if err := db.Where("driver_id = ?", driverID).First(&location).Error; err != nil {
-			c.JSON(404, gin.H{"error": "Driver location not found"})
-			return
+			// The first position may still be waiting for a batch flush
+			lat, lng, heading, redisErr := services.GetDriverLocation(ctx, driverID)
+			if err != gorm.ErrRecordNotFound || redisErr != nil {
+				c.JSON(404, gin.H{"error": "Driver location not found"})
+				return
+			}
+			location = models.DriverLocation{
+				DriverID:  driverID,
+				Latitude:  lat,
+				Longitude: lng,
+				Heading:   heading,
+				IsOnline:  true,
+			}
 		}
 
 		location.IsAvailable = *input.IsAvailable
@@ -168,6 +194,20 @@ func UpdateDriverAvailability(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		// Add or remove the driver's marker on client maps
+		hub.PublishMapDriver(driverID, location.Latitude, location.Longitude, location.IsAvailable)
+
+		// Going available starts a shift session, going offline ends it
+		var sessionErr error
+		if *input.IsAvailable {
+			sessionErr = openDriverSession(db, driverID)
+		} else {
+			sessionErr = closeDriverSession(db, driverID, models.SessionEndOffline)
+		}
+		if sessionErr != nil {
+			log.Printf("Failed to update session of driver %d: %v", driverID, sessionErr)
+		}
+
 		c.JSON(200, gin.H{
 			"message":     "Availability updated successfully",
 			"isAvailable": *input.IsAvailable,
@@ -241,6 +281,13 @@ func GetNearbyDrivers(db *gorm.DB) gin.HandlerFunc {
 				continue
 			}
 
+			// Prefer the real-time position; the database copy is batched
+			if driverLat, driverLng, heading, err := services.GetDriverLocation(ctx, location.DriverID); err == nil {
+				location.Latitude = driverLat
+				location.Longitude = driverLng
+				location.Heading = heading
+			}
+
 			// Calculate distance
 			distance := utils.HaversineDistance(lat, lng, location.Latitude, location.Longitude)
 
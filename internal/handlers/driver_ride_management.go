@@ -3,6 +3,7 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"strconv"
 
 	"github.com/chachabrian/mooveit-backend/internal/models"
@@ -30,28 +31,41 @@ func AcceptRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 			return
 		}
 
+		response, err := acceptRide(db, hub)(driverID, userType, uint(rideID))
+		if err != nil {
+			respondActionError(c, err)
+			return
+		}
+
+		c.JSON(200, response)
+	}
+}
+
+// acceptRide assigns a pending ride request to the driver
+func acceptRide(db *gorm.DB, hub *services.Hub) func(driverID uint, userType string, rideID uint) (gin.H, error) {
+	return func(driverID uint, userType string, rideID uint) (gin.H, error) {
+		if userType != string(models.UserTypeDriver) {
+			return nil, newActionError(403, "Only drivers can accept rides")
+		}
+
 		var rideRequest models.RideRequest
 		if err := db.Preload("Client").First(&rideRequest, rideID).Error; err != nil {
-			c.JSON(404, gin.H{"error": "Ride not found"})
-			return
+			return nil, newActionError(404, "Ride not found")
 		}
 
 		// Check if ride is still pending
 		if rideRequest.Status != models.RideStatusPending {
-			c.JSON(400, gin.H{"error": "Ride is no longer available"})
-			return
+			return nil, newActionError(400, "Ride is no longer available")
 		}
 
 		// Check if driver is available
 		var driverLocation models.DriverLocation
 		if err := db.Where("driver_id = ?", driverID).First(&driverLocation).Error; err != nil {
-			c.JSON(400, gin.H{"error": "Driver location not found"})
-			return
+			return nil, newActionError(400, "Driver location not found")
 		}
 
 		if !driverLocation.IsAvailable {
-			c.JSON(400, gin.H{"error": "Driver is not available"})
-			return
+			return nil, newActionError(400, "Driver is not available")
 		}
 
 		// Start transaction
@@ -67,27 +81,26 @@ func AcceptRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		rideRequest.Status = models.RideStatusAccepted
 		if err := tx.Save(&rideRequest).Error; err != nil {
 			tx.Rollback()
-			c.JSON(500, gin.H{"error": "Failed to accept ride"})
-			return
+			return nil, newActionError(500, "Failed to accept ride")
 		}
 
 		// Make driver unavailable
 		driverLocation.IsAvailable = false
 		if err := tx.Save(&driverLocation).Error; err != nil {
 			tx.Rollback()
-			c.JSON(500, gin.H{"error": "Failed to update driver availability"})
-			return
+			return nil, newActionError(500, "Failed to update driver availability")
 		}
 
 		// Commit transaction
 		if err := tx.Commit().Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to complete transaction"})
-			return
+			return nil, newActionError(500, "Failed to complete transaction")
 		}
 
 		// Update Redis
 		ctx := context.Background()
 		services.SetDriverAvailability(ctx, driverID, false)
+		services.ClearDriverActiveClient(ctx, driverID)
+		hub.PublishMapDriver(driverID, driverLocation.Latitude, driverLocation.Longitude, false)
 
 		// Calculate ETA for driver to reach pickup location
 		distance := utils.HaversineDistance(
@@ -99,9 +112,7 @@ func AcceptRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		// Get client information for notifications
 		var client models.User
 		if err := db.Where("id = ?", rideRequest.ClientID).First(&client).Error; err != nil {
-			tx.Rollback()
-			c.JSON(500, gin.H{"error": "Failed to get client information"})
-			return
+			return nil, newActionError(500, "Failed to get client information")
 		}
 
 		// Notify client via WebSocket
@@ -112,21 +123,19 @@ func AcceptRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		}
 		hub.SendRideAccepted(rideRequest.ClientID, accepted)
 
-		// Send FCM push notification to client
-		ctx = context.Background()
-		if client.FCMToken != "" {
-			var driver models.User
-			if err := db.First(&driver, driverID).Error; err == nil {
-				vehicleDetails := driver.CarMake + " " + driver.CarColor + " - " + driver.CarPlate
-				go services.SendRideAcceptedNotification(
-					ctx,
-					client.FCMToken,
-					rideRequest.ID,
-					driver.Username,
-					vehicleDetails,
-					eta,
-				)
-			}
+		var driver models.User
+		if err := db.First(&driver, driverID).Error; err == nil {
+			notifyUser(db, Notification{
+				Event:  eventRideAccepted,
+				UserID: rideRequest.ClientID,
+				Data: map[string]interface{}{
+					"rideId":         rideRequest.ID,
+					"driverName":     driver.Username,
+					"vehicleDetails": driver.CarMake + " " + driver.CarColor + " - " + driver.CarPlate,
+					"eta":            eta,
+					"notificationId": fmt.Sprintf("ride_accepted_%d", rideRequest.ID),
+				},
+			})
 		}
 
 		// Notify driver with pickup details
@@ -156,12 +165,12 @@ func AcceptRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		notificationData, _ := json.Marshal(driverNotification)
 		hub.BroadcastToUser(driverID, notificationData)
 
-		c.JSON(200, gin.H{
+		return gin.H{
 			"message": "Ride accepted successfully",
 			"rideId":  rideRequest.ID,
 			"status":  rideRequest.Status,
 			"eta":     eta,
-		})
+		}, nil
 	}
 }
 
@@ -182,30 +191,37 @@ func RejectRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 			return
 		}
 
+		response, err := rejectRide(db, hub)(userType, uint(rideID))
+		if err != nil {
+			respondActionError(c, err)
+			return
+		}
+
+		c.JSON(200, response)
+	}
+}
+
+// rejectRide declines a pending ride request
+func rejectRide(db *gorm.DB, hub *services.Hub) func(userType string, rideID uint) (gin.H, error) {
+	return func(userType string, rideID uint) (gin.H, error) {
+		if userType != string(models.UserTypeDriver) {
+			return nil, newActionError(403, "Only drivers can reject rides")
+		}
+
 		var rideRequest models.RideRequest
 		if err := db.Preload("Client").First(&rideRequest, rideID).Error; err != nil {
-			c.JSON(404, gin.H{"error": "Ride not found"})
-			return
+			return nil, newActionError(404, "Ride not found")
 		}
 
 		// Check if ride is still pending
 		if rideRequest.Status != models.RideStatusPending {
-			c.JSON(400, gin.H{"error": "Ride is no longer available"})
-			return
-		}
-
-		// Get client information for notifications
-		var client models.User
-		if err := db.Where("id = ?", rideRequest.ClientID).First(&client).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to get client information"})
-			return
+			return nil, newActionError(400, "Ride is no longer available")
 		}
 
 		// Update ride status to cancelled
 		rideRequest.Status = models.RideStatusCancelled
 		if err := db.Save(&rideRequest).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to reject ride"})
-			return
+			return nil, newActionError(500, "Failed to reject ride")
 		}
 
 		// Send WebSocket notification to client
@@ -215,26 +231,25 @@ func RejectRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		}
 		hub.SendRideRejected(rideRequest.ClientID, rejected)
 
-		// Send FCM push notification to client
-		ctx := context.Background()
-		if client.FCMToken != "" {
-			go services.SendRideRejectedNotification(
-				ctx,
-				client.FCMToken,
-				rideRequest.ID,
-			)
-		}
+		notifyUser(db, Notification{
+			Event:  eventRideRejected,
+			UserID: rideRequest.ClientID,
+			Data: map[string]interface{}{
+				"rideId":         rideRequest.ID,
+				"notificationId": fmt.Sprintf("ride_rejected_%d", rideRequest.ID),
+			},
+		})
 
 		// Also publish to Redis for any other subscribers
-		services.PublishRideUpdate(ctx, uint(rideID), "rejected", gin.H{
+		services.PublishRideUpdate(context.Background(), rideID, "rejected", gin.H{
 			"reason": "Driver rejected the ride",
 		})
 
-		c.JSON(200, gin.H{
+		return gin.H{
 			"message": "Ride rejected successfully",
 			"rideId":  rideRequest.ID,
 			"status":  rideRequest.Status,
-		})
+		}, nil
 	}
 }
 
@@ -283,42 +298,53 @@ func DriverArrived(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 			return
 		}
 
+		response, err := driverArrived(db, hub)(driverID, userType, uint(rideID))
+		if err != nil {
+			respondActionError(c, err)
+			return
+		}
+
+		c.JSON(200, response)
+	}
+}
+
+// driverArrived marks that the assigned driver reached the pickup location
+func driverArrived(db *gorm.DB, hub *services.Hub) func(driverID uint, userType string, rideID uint) (gin.H, error) {
+	return func(driverID uint, userType string, rideID uint) (gin.H, error) {
+		if userType != string(models.UserTypeDriver) {
+			return nil, newActionError(403, "Only drivers can mark arrival")
+		}
+
 		var rideRequest models.RideRequest
 		if err := db.Preload("Client").First(&rideRequest, rideID).Error; err != nil {
-			c.JSON(404, gin.H{"error": "Ride not found"})
-			return
+			return nil, newActionError(404, "Ride not found")
 		}
 
 		// Check if driver is assigned to this ride
 		if rideRequest.DriverID == nil || *rideRequest.DriverID != driverID {
-			c.JSON(403, gin.H{"error": "Unauthorized to update this ride"})
-			return
+			return nil, newActionError(403, "Unauthorized to update this ride")
 		}
 
 		// Check if ride is in accepted status
 		if rideRequest.Status != models.RideStatusAccepted {
-			c.JSON(400, gin.H{"error": "Ride must be accepted before marking arrival"})
-			return
+			return nil, newActionError(400, "Ride must be accepted before marking arrival")
 		}
 
 		// Update ride status to arrived
 		rideRequest.Status = models.RideStatusArrived
 		if err := db.Save(&rideRequest).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to update ride status"})
-			return
+			return nil, newActionError(500, "Failed to update ride status")
 		}
 
 		// Get client and driver information for notifications
 		var client models.User
 		if err := db.Where("id = ?", rideRequest.ClientID).First(&client).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to get client information"})
-			return
+			return nil, newActionError(500, "Failed to get client information")
 		}
 
 		var driver models.User
 		if err := db.Where("id = ?", driverID).First(&driver).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to get driver information"})
-			return
+			return nil, newActionError(500, "Failed to get driver information")
 		}
 
 		// Notify client that driver has arrived
@@ -328,16 +354,15 @@ func DriverArrived(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		}
 		hub.SendDriverArrived(rideRequest.ClientID, arrived)
 
-		// Send FCM push notification to client
-		ctx := context.Background()
-		if client.FCMToken != "" {
-			go services.SendDriverArrivedNotification(
-				ctx,
-				client.FCMToken,
-				rideRequest.ID,
-				driver.Username,
-			)
-		}
+		notifyUser(db, Notification{
+			Event:  eventDriverArrived,
+			UserID: rideRequest.ClientID,
+			Data: map[string]interface{}{
+				"rideId":         rideRequest.ID,
+				"driverName":     driver.Username,
+				"notificationId": fmt.Sprintf("driver_arrived_%d", rideRequest.ID),
+			},
+		})
 
 		// Also send a general status update notification
 		statusUpdate := services.WebSocketMessage{
@@ -369,11 +394,11 @@ func DriverArrived(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		driverData, _ := json.Marshal(driverNotification)
 		hub.BroadcastToUser(driverID, driverData)
 
-		c.JSON(200, gin.H{
+		return gin.H{
 			"message": "Driver arrival confirmed successfully",
 			"rideId":  rideRequest.ID,
 			"status":  rideRequest.Status,
-		})
+		}, nil
 	}
 }
 
@@ -395,42 +420,53 @@ func StartRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 			return
 		}
 
+		response, err := startRide(db, hub)(driverID, userType, uint(rideID))
+		if err != nil {
+			respondActionError(c, err)
+			return
+		}
+
+		c.JSON(200, response)
+	}
+}
+
+// startRide begins an accepted ride once the client is on board
+func startRide(db *gorm.DB, hub *services.Hub) func(driverID uint, userType string, rideID uint) (gin.H, error) {
+	return func(driverID uint, userType string, rideID uint) (gin.H, error) {
+		if userType != string(models.UserTypeDriver) {
+			return nil, newActionError(403, "Only drivers can start rides")
+		}
+
 		var rideRequest models.RideRequest
 		if err := db.Preload("Client").First(&rideRequest, rideID).Error; err != nil {
-			c.JSON(404, gin.H{"error": "Ride not found"})
-			return
+			return nil, newActionError(404, "Ride not found")
 		}
 
 		// Check if driver is assigned to this ride
 		if rideRequest.DriverID == nil || *rideRequest.DriverID != driverID {
-			c.JSON(403, gin.H{"error": "Unauthorized to start this ride"})
-			return
+			return nil, newActionError(403, "Unauthorized to start this ride")
 		}
 
 		// Check if ride is in correct status (accepted or arrived)
 		if rideRequest.Status != models.RideStatusAccepted && rideRequest.Status != models.RideStatusArrived {
-			c.JSON(400, gin.H{"error": "Ride must be accepted before starting"})
-			return
+			return nil, newActionError(400, "Ride must be accepted before starting")
 		}
 
 		// Update ride status to started
 		rideRequest.Status = models.RideStatusStarted
 		if err := db.Save(&rideRequest).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to start ride"})
-			return
+			return nil, newActionError(500, "Failed to start ride")
 		}
 
 		// Get client and driver information for notifications
 		var client models.User
 		if err := db.Where("id = ?", rideRequest.ClientID).First(&client).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to get client information"})
-			return
+			return nil, newActionError(500, "Failed to get client information")
 		}
 
 		var driver models.User
 		if err := db.Where("id = ?", driverID).First(&driver).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to get driver information"})
-			return
+			return nil, newActionError(500, "Failed to get driver information")
 		}
 
 		// Notify client that ride has started
@@ -440,16 +476,15 @@ func StartRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		}
 		hub.SendRideStarted(rideRequest.ClientID, started)
 
-		// Send FCM push notification to client
-		ctx := context.Background()
-		if client.FCMToken != "" {
-			go services.SendRideStartedNotification(
-				ctx,
-				client.FCMToken,
-				rideRequest.ID,
-				driver.Username,
-			)
-		}
+		notifyUser(db, Notification{
+			Event:  eventRideStarted,
+			UserID: rideRequest.ClientID,
+			Data: map[string]interface{}{
+				"rideId":         rideRequest.ID,
+				"driverName":     driver.Username,
+				"notificationId": fmt.Sprintf("ride_started_%d", rideRequest.ID),
+			},
+		})
 
 		// Also send a general status update notification
 		statusUpdate := services.WebSocketMessage{
@@ -481,10 +516,10 @@ func StartRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		driverData, _ := json.Marshal(driverNotification)
 		hub.BroadcastToUser(driverID, driverData)
 
-		c.JSON(200, gin.H{
+		return gin.H{
 			"message": "Ride started successfully",
 			"rideId":  rideRequest.ID,
 			"status":  rideRequest.Status,
-		})
+		}, nil
 	}
 }
@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxOnlineStreak is how long a driver may stay online before a break is enforced
+func maxOnlineStreak() time.Duration {
+	return utils.EnvDuration("DRIVER_MAX_ONLINE", 12*time.Hour)
+}
+
+// fatigueBreak is the rest required after reaching maxOnlineStreak. Sessions
+// separated by a shorter gap count as one continuous streak.
+func fatigueBreak() time.Duration {
+	return utils.EnvDuration("DRIVER_FATIGUE_BREAK", 8*time.Hour)
+}
+
+// DriverSessionStats is a session with the activity recorded during it
+type DriverSessionStats struct {
+	models.DriverSession
+	OnlineMinutes  int     `json:"onlineMinutes"`
+	OnTripMinutes  int     `json:"onTripMinutes"`
+	IdleMinutes    int     `json:"idleMinutes"`
+	TripsCompleted int     `json:"tripsCompleted"`
+	Earnings       float64 `json:"earnings"`
+}
+
+// openDriverSession starts a session unless the driver already has one open.
+// The unique index on open sessions turns a concurrent second start into a
+// no-op.
+func openDriverSession(db *gorm.DB, driverID uint) error {
+	session := models.DriverSession{DriverID: driverID, StartedAt: time.Now()}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&session)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	if err := services.StartSessionDistance(context.Background(), driverID); err != nil {
+		log.Printf("Failed to start distance tracking for driver %d: %v", driverID, err)
+	}
+	return nil
+}
+
+// closeDriverSession ends the driver's open session, if any
+func closeDriverSession(db *gorm.DB, driverID uint, reason string) error {
+	var session models.DriverSession
+	err := db.Where("driver_id = ? AND ended_at IS NULL", driverID).First(&session).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	session.EndedAt = &now
+	session.EndReason = reason
+	if distance, err := services.StopSessionDistance(context.Background(), driverID); err == nil {
+		session.DistanceKm = distance
+	}
+
+	return db.Save(&session).Error
+}
+
+// sessionStats adds the trips completed during a session to it
+func sessionStats(db *gorm.DB, session models.DriverSession) DriverSessionStats {
+	end := time.Now()
+	if session.EndedAt != nil {
+		end = *session.EndedAt
+	} else if distance, err := services.GetSessionDistance(context.Background(), session.DriverID); err == nil {
+		session.DistanceKm = distance
+	}
+
+	var trips struct {
+		Count    int
+		Minutes  int
+		Earnings float64
+	}
+	db.Model(&models.TripCompletion{}).
+		Select("COUNT(*) AS count, COALESCE(SUM(actual_duration), 0) AS minutes, COALESCE(SUM(actual_fare), 0) AS earnings").
+		Where("driver_id = ? AND created_at BETWEEN ? AND ?", session.DriverID, session.StartedAt, end).
+		Scan(&trips)
+
+	online := int(end.Sub(session.StartedAt).Minutes())
+	idle := online - trips.Minutes
+	if idle < 0 {
+		idle = 0
+	}
+
+	return DriverSessionStats{
+		DriverSession:  session,
+		OnlineMinutes:  online,
+		OnTripMinutes:  trips.Minutes,
+		IdleMinutes:    idle,
+		TripsCompleted: trips.Count,
+		Earnings:       trips.Earnings,
+	}
+}
+
+// onlineStreak returns how long the driver has been online without a full
+// break, counting back from now across recent sessions
+func onlineStreak(db *gorm.DB, driverID uint, now time.Time) time.Duration {
+	var sessions []models.DriverSession
+	db.Where("driver_id = ? AND (ended_at IS NULL OR ended_at > ?)", driverID, now.Add(-maxOnlineStreak()-fatigueBreak()*2)).
+		Order("started_at DESC").
+		Find(&sessions)
+
+	var streak time.Duration
+	resumedAt := now
+	for _, session := range sessions {
+		end := now
+		if session.EndedAt != nil {
+			end = *session.EndedAt
+		}
+		if resumedAt.Sub(end) >= fatigueBreak() {
+			break
+		}
+		streak += end.Sub(session.StartedAt)
+		resumedAt = session.StartedAt
+	}
+	return streak
+}
+
+// breakEndsAt returns when a driver's enforced break ends, or nil if the
+// driver may go online
+func breakEndsAt(db *gorm.DB, driverID uint, now time.Time) *time.Time {
+	var last models.DriverSession
+	if err := db.Where("driver_id = ? AND ended_at IS NOT NULL", driverID).
+		Order("ended_at DESC").
+		First(&last).Error; err != nil {
+		return nil
+	}
+
+	if last.EndReason != models.SessionEndFatigue {
+		return nil
+	}
+	breakEnd := last.EndedAt.Add(fatigueBreak())
+	if now.After(breakEnd) {
+		return nil
+	}
+	return &breakEnd
+}
+
+// enforceFatigueLimit takes a driver offline for a break once their online
+// streak reaches the limit. Drivers on a trip are left to finish it.
+func enforceFatigueLimit(db *gorm.DB, hub *services.Hub, session models.DriverSession) {
+	now := time.Now()
+	if onlineStreak(db, session.DriverID, now) < maxOnlineStreak() {
+		return
+	}
+	if activeRideClient(db, session.DriverID) != 0 {
+		return
+	}
+
+	ctx := context.Background()
+	if err := closeDriverSession(db, session.DriverID, models.SessionEndFatigue); err != nil {
+		log.Printf("Failed to end session of driver %d: %v", session.DriverID, err)
+		return
+	}
+
+	var location models.DriverLocation
+	if err := db.Where("driver_id = ?", session.DriverID).First(&location).Error; err == nil {
+		db.Model(&location).Update("is_available", false)
+		hub.PublishMapDriver(session.DriverID, location.Latitude, location.Longitude, false)
+	}
+	services.SetDriverAvailability(ctx, session.DriverID, false)
+
+	breakEnd := now.Add(fatigueBreak())
+	log.Printf("Driver %d reached %s online, break enforced until %s", session.DriverID, maxOnlineStreak(), breakEnd.Format(time.RFC3339))
+
+	message := services.WebSocketMessage{
+		Type: "fatigue_break",
+		Data: gin.H{
+			"onlineHours": maxOnlineStreak().Hours(),
+			"breakUntil":  breakEnd,
+		},
+	}
+	if data, err := json.Marshal(message); err == nil {
+		hub.BroadcastToUser(session.DriverID, data)
+	}
+
+	notifyUser(db, Notification{
+		Event:  eventFatigueBreak,
+		UserID: session.DriverID,
+		Data: map[string]interface{}{
+			"hours":      fmt.Sprintf("%d", int(maxOnlineStreak().Hours())),
+			"breakUntil": breakEnd.Format("15:04"),
+		},
+	})
+}
+
+// GetDriverSessions returns the driver's session history
+func GetDriverSessions(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		driverID := c.GetUint("userId")
+		userType := c.GetString("userType")
+
+		if userType != string(models.UserTypeDriver) {
+			c.JSON(403, gin.H{"error": "Only drivers can view sessions"})
+			return
+		}
+
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+		if err != nil || limit < 1 || limit > 100 {
+			limit = 10
+		}
+
+		offset := (page - 1) * limit
+
+		var sessions []models.DriverSession
+		if err := db.Where("driver_id = ?", driverID).
+			Order("started_at DESC").
+			Offset(offset).
+			Limit(limit).
+			Find(&sessions).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to fetch sessions"})
+			return
+		}
+
+		var total int64
+		db.Model(&models.DriverSession{}).Where("driver_id = ?", driverID).Count(&total)
+
+		results := make([]DriverSessionStats, 0, len(sessions))
+		for _, session := range sessions {
+			results = append(results, sessionStats(db, session))
+		}
+
+		c.JSON(200, gin.H{
+			"sessions": results,
+			"pagination": gin.H{
+				"page":       page,
+				"limit":      limit,
+				"total":      total,
+				"totalPages": (total + int64(limit) - 1) / int64(limit),
+			},
+		})
+	}
+}
+
+// GetDriverSessionSummary totals the driver's sessions over a date range
+// (default: the last 7 days) and reports their fatigue status
+func GetDriverSessionSummary(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		driverID := c.GetUint("userId")
+		userType := c.GetString("userType")
+
+		if userType != string(models.UserTypeDriver) {
+			c.JSON(403, gin.H{"error": "Only drivers can view sessions"})
+			return
+		}
+
+		now := time.Now()
+		to := now
+		from := now.AddDate(0, 0, -7)
+		if value := c.Query("from"); value != "" {
+			parsed, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Invalid from date, use YYYY-MM-DD"})
+				return
+			}
+			from = parsed
+		}
+		if value := c.Query("to"); value != "" {
+			parsed, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Invalid to date, use YYYY-MM-DD"})
+				return
+			}
+			to = parsed.AddDate(0, 0, 1) // include the whole day
+		}
+		if !from.Before(to) {
+			c.JSON(400, gin.H{"error": "from must be before to"})
+			return
+		}
+
+		var sessions []models.DriverSession
+		if err := db.Where("driver_id = ? AND started_at >= ? AND started_at < ?", driverID, from, to).
+			Find(&sessions).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to fetch sessions"})
+			return
+		}
+
+		var online, onTrip, idle, trips int
+		var distance, earnings float64
+		for _, session := range sessions {
+			stats := sessionStats(db, session)
+			online += stats.OnlineMinutes
+			onTrip += stats.OnTripMinutes
+			idle += stats.IdleMinutes
+			trips += stats.TripsCompleted
+			distance += stats.DistanceKm
+			earnings += stats.Earnings
+		}
+
+		streak := onlineStreak(db, driverID, now)
+		remaining := maxOnlineStreak() - streak
+		if remaining < 0 {
+			remaining = 0
+		}
+		fatigue := gin.H{
+			"onlineStreakMinutes": int(streak.Minutes()),
+			"limitMinutes":        int(maxOnlineStreak().Minutes()),
+			"remainingMinutes":    int(remaining.Minutes()),
+		}
+		if breakEnd := breakEndsAt(db, driverID, now); breakEnd != nil {
+			fatigue["breakUntil"] = breakEnd
+			fatigue["remainingMinutes"] = 0
+		}
+
+		c.JSON(200, gin.H{
+			"from":           from,
+			"to":             to,
+			"sessions":       len(sessions),
+			"onlineMinutes":  online,
+			"onTripMinutes":  onTrip,
+			"idleMinutes":    idle,
+			"distanceKm":     distance,
+			"tripsCompleted": trips,
+			"earnings":       earnings,
+			"fatigue":        fatigue,
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+	"gorm.io/gorm"
+)
+
+const (
+	// defaultDriverOfflineAfter is how long a driver may go without reporting
+	// a location before being taken offline. It must comfortably exceed
+	// locationFlushInterval since LastSeen is persisted in batches.
+	defaultDriverOfflineAfter = 5 * time.Minute
+	// driverSweepInterval is how often stale drivers are looked for
+	driverSweepInterval = time.Minute
+)
+
+// DriverSweeper takes drivers offline when their app stops reporting its
+// location, so they no longer receive ride offers
+type DriverSweeper struct {
+	db           *gorm.DB
+	hub          *services.Hub
+	offlineAfter time.Duration
+}
+
+// NewDriverSweeper creates a sweeper using DRIVER_OFFLINE_AFTER (e.g. "5m")
+// as the allowed silence
+func NewDriverSweeper(db *gorm.DB, hub *services.Hub) *DriverSweeper {
+	offlineAfter := utils.EnvDuration("DRIVER_OFFLINE_AFTER", defaultDriverOfflineAfter)
+	if offlineAfter <= locationFlushInterval {
+		log.Printf("Warning: DRIVER_OFFLINE_AFTER must exceed %s, using %s", locationFlushInterval, defaultDriverOfflineAfter)
+		offlineAfter = defaultDriverOfflineAfter
+	}
+
+	return &DriverSweeper{db: db, hub: hub, offlineAfter: offlineAfter}
+}
+
+// Run sweeps for stale drivers until the process exits
+func (s *DriverSweeper) Run() {
+	ticker := time.NewTicker(driverSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.Sweep()
+		s.EnforceFatigue()
+	}
+}
+
+// Sweep takes every driver silent for longer than the threshold offline
+func (s *DriverSweeper) Sweep() {
+	cutoff := time.Now().Add(-s.offlineAfter)
+
+	var stale []models.DriverLocation
+	if err := s.db.Where("is_online = ? AND last_seen < ?", true, cutoff).Find(&stale).Error; err != nil {
+		log.Printf("Failed to find stale drivers: %v", err)
+		return
+	}
+
+	for _, location := range stale {
+		s.takeOffline(location, cutoff)
+	}
+}
+
+// EnforceFatigue sends drivers who reached the online limit on a break
+func (s *DriverSweeper) EnforceFatigue() {
+	var open []models.DriverSession
+	if err := s.db.Where("ended_at IS NULL").Find(&open).Error; err != nil {
+		log.Printf("Failed to find long driver sessions: %v", err)
+		return
+	}
+
+	for _, session := range open {
+		enforceFatigueLimit(s.db, s.hub, session)
+	}
+}
+
+// takeOffline marks a stale driver offline and re-dispatches rides they were offered
+func (s *DriverSweeper) takeOffline(location models.DriverLocation, cutoff time.Time) {
+	ctx := context.Background()
+
+	// A position may have reached Redis but not yet been flushed
+	if updated, err := services.GetDriverLocationUpdatedAt(ctx, location.DriverID); err == nil && updated.After(cutoff) {
+		return
+	}
+
+	// The conditional update lets only one instance claim the driver
+	result := s.db.Model(&models.DriverLocation{}).
+		Where("id = ? AND is_online = ? AND last_seen < ?", location.ID, true, cutoff).
+		Updates(map[string]interface{}{"is_online": false, "is_available": false})
+	if result.Error != nil {
+		log.Printf("Failed to take driver %d offline: %v", location.DriverID, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+
+	log.Printf("Driver %d taken offline after %s without a location update", location.DriverID, s.offlineAfter)
+
+	services.SetDriverAvailability(ctx, location.DriverID, false)
+	if err := closeDriverSession(s.db, location.DriverID, models.SessionEndTimeout); err != nil {
+		log.Printf("Failed to end session of driver %d: %v", location.DriverID, err)
+	}
+	if location.IsAvailable {
+		s.hub.PublishMapDriver(location.DriverID, location.Latitude, location.Longitude, false)
+	}
+
+	s.redispatchOffers(ctx, location.DriverID)
+
+	notifyUser(s.db, Notification{
+		Event:  eventDriverOffline,
+		UserID: location.DriverID,
+		Data: map[string]interface{}{
+			"minutes": fmt.Sprintf("%d", int(s.offlineAfter.Minutes())),
+			"reason":  "location_timeout",
+		},
+	})
+}
+
+// redispatchOffers offers rides still pending with the stale driver to other drivers
+func (s *DriverSweeper) redispatchOffers(ctx context.Context, driverID uint) {
+	rideIDs, err := services.TakeDriverOffers(ctx, driverID)
+	if err != nil {
+		log.Printf("Failed to load ride offers of driver %d: %v", driverID, err)
+		return
+	}
+
+	for _, rideID := range rideIDs {
+		var rideRequest models.RideRequest
+		if err := s.db.Preload("Client").First(&rideRequest, rideID).Error; err != nil {
+			continue
+		}
+		if rideRequest.Status != models.RideStatusPending || rideRequest.Client == nil {
+			continue
+		}
+
+		sent, err := offerRideToNearbyDrivers(s.db, s.hub, rideRequest, *rideRequest.Client)
+		if err != nil {
+			log.Printf("Failed to re-dispatch ride %d: %v", rideID, err)
+			continue
+		}
+		log.Printf("Re-dispatched ride %d to %d drivers after driver %d went offline", rideID, sent, driverID)
+	}
+}
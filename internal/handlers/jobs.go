@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// ListDeadJobs lists outbound notifications that ran out of retries
+func ListDeadJobs() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit < 1 || limit > 1000 {
+			limit = 50
+		}
+
+		jobs, err := services.DeadJobs(c.Request.Context(), limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load failed jobs"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"jobs": jobs})
+	}
+}
+
+// RetryDeadJob puts a failed job back on the queue
+func RetryDeadJob() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ok, err := services.RetryDeadJob(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry job"})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Job queued for retry"})
+	}
+}
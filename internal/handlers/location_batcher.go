@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// locationFlushInterval is how often buffered driver positions are written to the database
+const locationFlushInterval = 30 * time.Second
+
+// LocationBatcher buffers driver positions and persists only the latest one
+// per driver on each flush. Redis stays the real-time source of positions;
+// the database copy is allowed to lag by up to one flush interval.
+type LocationBatcher struct {
+	db       *gorm.DB
+	interval time.Duration
+	mutex    sync.Mutex
+	pending  map[uint]models.DriverLocation
+}
+
+// NewLocationBatcher creates a batcher that flushes every locationFlushInterval
+func NewLocationBatcher(db *gorm.DB) *LocationBatcher {
+	return &LocationBatcher{
+		db:       db,
+		interval: locationFlushInterval,
+		pending:  make(map[uint]models.DriverLocation),
+	}
+}
+
+// Add records a driver's latest position, replacing any unflushed one
+func (b *LocationBatcher) Add(driverID uint, lat, lng, heading float64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.pending[driverID] = models.DriverLocation{
+		DriverID:  driverID,
+		Latitude:  lat,
+		Longitude: lng,
+		Heading:   heading,
+		IsOnline:  true,
+		LastSeen:  time.Now(),
+	}
+}
+
+// Run flushes buffered positions until the process exits
+func (b *LocationBatcher) Run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := b.Flush(); err != nil {
+			log.Printf("Failed to flush driver locations: %v", err)
+		}
+	}
+}
+
+// Flush upserts all buffered positions in a single statement. Availability
+// is left untouched so it is never overwritten by a stale batch.
+func (b *LocationBatcher) Flush() error {
+	b.mutex.Lock()
+	if len(b.pending) == 0 {
+		b.mutex.Unlock()
+		return nil
+	}
+	locations := make([]models.DriverLocation, 0, len(b.pending))
+	for _, location := range b.pending {
+		locations = append(locations, location)
+	}
+	b.pending = make(map[uint]models.DriverLocation)
+	b.mutex.Unlock()
+
+	err := b.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "driver_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"latitude", "longitude", "heading", "is_online", "last_seen", "updated_at",
+		}),
+	}).Create(&locations).Error
+	if err != nil {
+		// Put the positions back unless a newer one arrived meanwhile
+		b.mutex.Lock()
+		for _, location := range locations {
+			if _, ok := b.pending[location.DriverID]; !ok {
+				b.pending[location.DriverID] = location
+			}
+		}
+		b.mutex.Unlock()
+		return err
+	}
+
+	return nil
+}
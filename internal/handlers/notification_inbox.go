@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// notificationPruneInterval is how often old notifications are deleted
+const notificationPruneInterval = time.Hour
+
+// notificationRetention is how long notifications stay in the inbox
+func notificationRetention() time.Duration {
+	return utils.EnvDuration("NOTIFICATION_RETENTION", 90*24*time.Hour)
+}
+
+// unreadNotificationCount counts the notifications a user has not read
+func unreadNotificationCount(db *gorm.DB, userID uint) (int64, error) {
+	var count int64
+	err := db.Model(&models.Notification{}).
+		Where("user_id = ? AND read_at IS NULL", userID).
+		Count(&count).Error
+	return count, err
+}
+
+// notificationResponse formats a notification with its data decoded
+func notificationResponse(notification models.Notification) gin.H {
+	var data map[string]interface{}
+	if notification.Data != "" {
+		if err := json.Unmarshal([]byte(notification.Data), &data); err != nil {
+			log.Printf("Failed to decode data of notification %d: %v", notification.ID, err)
+		}
+	}
+
+	return gin.H{
+		"id":        notification.ID,
+		"event":     notification.Event,
+		"title":     notification.Title,
+		"body":      notification.Body,
+		"data":      data,
+		"read":      notification.ReadAt != nil,
+		"readAt":    notification.ReadAt,
+		"createdAt": notification.CreatedAt,
+	}
+}
+
+// broadcastUnreadCount keeps the badge on the user's other devices in step
+func broadcastUnreadCount(db *gorm.DB, hub *services.Hub, userID uint) int64 {
+	unread, err := unreadNotificationCount(db, userID)
+	if err != nil {
+		log.Printf("Failed to count unread notifications of user %d: %v", userID, err)
+		return 0
+	}
+
+	message, err := json.Marshal(services.WebSocketMessage{
+		Type: "notification_unread_count",
+		Data: gin.H{"unreadCount": unread},
+	})
+	if err == nil {
+		hub.BroadcastToUser(userID, message)
+	}
+	return unread
+}
+
+// ListNotifications lists the user's inbox, newest first. ?unread=true lists
+// only notifications not yet read.
+func ListNotifications(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+		if err != nil || limit < 1 || limit > 100 {
+			limit = 20
+		}
+
+		query := db.Model(&models.Notification{}).Where("user_id = ?", userID)
+		if c.Query("unread") == "true" {
+			query = query.Where("read_at IS NULL")
+		}
+
+		var total int64
+		query.Count(&total)
+
+		var notifications []models.Notification
+		if err := query.Order("created_at DESC, id DESC").
+			Offset((page - 1) * limit).
+			Limit(limit).
+			Find(&notifications).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch notifications"})
+			return
+		}
+
+		unread, err := unreadNotificationCount(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count unread notifications"})
+			return
+		}
+
+		results := make([]gin.H, 0, len(notifications))
+		for _, notification := range notifications {
+			results = append(results, notificationResponse(notification))
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"notifications": results,
+			"unreadCount":   unread,
+			"pagination": gin.H{
+				"page":       page,
+				"limit":      limit,
+				"total":      total,
+				"totalPages": (total + int64(limit) - 1) / int64(limit),
+			},
+		})
+	}
+}
+
+// GetUnreadNotificationCount returns how many notifications the user has not read
+func GetUnreadNotificationCount(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		unread, err := unreadNotificationCount(db, c.GetUint("userId"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count unread notifications"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"unreadCount": unread})
+	}
+}
+
+// MarkNotificationRead marks one of the user's notifications read
+func MarkNotificationRead(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+
+		var notification models.Notification
+		if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&notification).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+			return
+		}
+
+		if notification.ReadAt == nil {
+			now := time.Now()
+			if err := db.Model(&notification).Update("read_at", now).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark notification read"})
+				return
+			}
+			notification.ReadAt = &now
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"notification": notificationResponse(notification),
+			"unreadCount":  broadcastUnreadCount(db, hub, userID),
+		})
+	}
+}
+
+// MarkAllNotificationsRead marks every notification of the user read
+func MarkAllNotificationsRead(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+
+		result := db.Model(&models.Notification{}).
+			Where("user_id = ? AND read_at IS NULL", userID).
+			Update("read_at", time.Now())
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark notifications read"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":     "Notifications marked read",
+			"marked":      result.RowsAffected,
+			"unreadCount": broadcastUnreadCount(db, hub, userID),
+		})
+	}
+}
+
+// NotificationPruner deletes notifications older than the retention period
+type NotificationPruner struct {
+	db *gorm.DB
+}
+
+// NewNotificationPruner creates a pruner keeping notifications for
+// NOTIFICATION_RETENTION (e.g. "2160h", 90 days by default)
+func NewNotificationPruner(db *gorm.DB) *NotificationPruner {
+	return &NotificationPruner{db: db}
+}
+
+// Run prunes notifications until the process exits
+func (p *NotificationPruner) Run() {
+	ticker := time.NewTicker(notificationPruneInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.Prune()
+	}
+}
+
+// Prune deletes notifications and delivery records past the retention period
+func (p *NotificationPruner) Prune() {
+	cutoff := time.Now().Add(-notificationRetention())
+
+	result := p.db.Where("created_at < ?", cutoff).Delete(&models.Notification{})
+	if result.Error != nil {
+		log.Printf("Failed to prune notifications: %v", result.Error)
+		return
+	}
+	if err := p.db.Unscoped().Where("created_at < ?", cutoff).Delete(&models.NotificationDelivery{}).Error; err != nil {
+		log.Printf("Failed to prune notification deliveries: %v", err)
+	}
+
+	if result.RowsAffected > 0 {
+		log.Printf("Pruned %d notifications older than %s", result.RowsAffected, notificationRetention())
+	}
+}
@@ -107,10 +107,8 @@ func UpdateNotificationPreferences(db *gorm.DB) gin.HandlerFunc {
 
 		// Handle topic subscription for available rides
 		if input.AvailableRidesPush != nil && oldAvailableRidesPush != preferences.AvailableRidesPush {
-			var user models.User
-			if err := db.First(&user, userID).Error; err == nil && user.FCMToken != "" {
+			if tokens, err := deviceTokens(db, userID); err == nil && len(tokens) > 0 {
 				ctx := context.Background()
-				tokens := []string{user.FCMToken}
 
 				if preferences.AvailableRidesPush && preferences.PushEnabled {
 					// Subscribe to available rides topic
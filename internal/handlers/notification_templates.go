@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+)
+
+// Notification events
+const (
+	eventBookingCreated    = "booking_created"
+	eventBookingAccepted   = "booking_accepted"
+	eventBookingRejected   = "booking_rejected"
+	eventBookingInProgress = "booking_in_progress"
+	eventBookingDelivered  = "booking_delivered"
+	eventBookingCompleted  = "booking_completed"
+	eventBookingExpired    = "booking_expired"
+	eventRideCancelled     = "ride_cancelled"
+	eventRideRescheduled   = "ride_rescheduled"
+	eventRideRequest       = "ride_request"
+	eventParcelRequest     = "parcel_request"
+	eventRideAccepted      = "ride_accepted"
+	eventRideRejected      = "ride_rejected"
+	eventDriverArrived     = "driver_arrived"
+	eventRideStarted       = "ride_started"
+	eventRideCompleted     = "ride_completed"
+	eventClaimStatus       = "claim_status"
+	eventDriverOffline     = "driver_offline"
+	eventFatigueBreak      = "fatigue_break"
+)
+
+// Preference categories users can turn off. Events without a category are
+// always sent.
+const (
+	categoryBooking     = "booking"
+	categoryRideRequest = "ride_request"
+	categoryRideStatus  = "ride_status"
+)
+
+// notificationEvent is how an event is delivered. Its text on each channel
+// comes from the message templates of the same name; a channel the templates
+// leave empty is not used for the event.
+type notificationEvent struct {
+	category  string
+	sound     string
+	channelID string
+	priority  string
+}
+
+var notificationEvents = map[string]notificationEvent{
+	eventBookingCreated:    {category: categoryBooking},
+	eventBookingAccepted:   {category: categoryBooking},
+	eventBookingRejected:   {category: categoryBooking},
+	eventBookingInProgress: {category: categoryBooking},
+	eventBookingDelivered:  {category: categoryBooking},
+	eventBookingCompleted:  {category: categoryBooking},
+	eventBookingExpired:    {category: categoryBooking},
+	eventRideCancelled:     {category: categoryBooking},
+	eventRideRescheduled:   {category: categoryBooking},
+	eventRideRequest: {
+		category:  categoryRideRequest,
+		sound:     "ringtone", // ringtone.mp3 on Android, ringtone.caf on iOS
+		channelID: "ride_requests",
+		priority:  "high",
+	},
+	eventParcelRequest: {
+		category:  categoryRideRequest,
+		channelID: "mooveit_rides",
+	},
+	eventRideAccepted: {category: categoryRideStatus},
+	eventRideRejected: {
+		category: categoryRideStatus,
+		sound:    "default",
+		priority: "high",
+	},
+	eventDriverArrived: {category: categoryRideStatus},
+	eventRideStarted:   {category: categoryRideStatus},
+	eventRideCompleted: {category: categoryRideStatus},
+	eventClaimStatus:   {},
+	// Drivers must know they stopped receiving requests
+	eventDriverOffline: {sound: "default", priority: "high"},
+	eventFatigueBreak:  {sound: "default", priority: "high"},
+}
+
+// CheckNotificationTemplates makes sure every event has English templates,
+// so a missing file fails at startup rather than when the event happens
+func CheckNotificationTemplates() error {
+	for event := range notificationEvents {
+		if !utils.HasMessage(event, utils.DefaultLanguage) {
+			return fmt.Errorf("no %s templates for notification event %q", utils.DefaultLanguage, event)
+		}
+	}
+	return nil
+}
@@ -6,17 +6,21 @@ import (
 
 	"github.com/chachabrian/mooveit-backend/internal/models"
 	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
-// RegisterFCMToken registers or updates a user's FCM token
+// RegisterFCMToken registers the FCM token of one of the user's devices.
+// Registering again refreshes when the device was last seen.
 func RegisterFCMToken(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.GetUint("userId")
 
 		var input struct {
-			FCMToken string `json:"fcmToken" binding:"required"`
+			FCMToken   string `json:"fcmToken" binding:"required"`
+			Platform   string `json:"platform" binding:"omitempty,oneof=android ios web"`
+			AppVersion string `json:"appVersion" binding:"max=50"`
 		}
 
 		if err := c.ShouldBindJSON(&input); err != nil {
@@ -24,8 +28,12 @@ func RegisterFCMToken(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		// Update user's FCM token
-		if err := db.Model(&models.User{}).Where("id = ?", userID).Update("fcm_token", input.FCMToken).Error; err != nil {
+		if err := saveDeviceToken(db, models.DeviceToken{
+			UserID:     userID,
+			Token:      input.FCMToken,
+			Platform:   input.Platform,
+			AppVersion: input.AppVersion,
+		}); err != nil {
 			c.JSON(500, gin.H{"error": "Failed to register FCM token"})
 			return
 		}
@@ -76,19 +84,33 @@ func RegisterFCMToken(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-// RemoveFCMToken removes a user's FCM token
+// RemoveFCMToken stops push notifications to one of the user's devices,
+// given as ?fcmToken= or in the body, or to all of them when none is given
 func RemoveFCMToken(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.GetUint("userId")
 
-		// Clear user's FCM token
-		if err := db.Model(&models.User{}).Where("id = ?", userID).Update("fcm_token", "").Error; err != nil {
+		var input struct {
+			FCMToken string `json:"fcmToken"`
+		}
+		_ = c.ShouldBindJSON(&input) // the body is optional
+		if token := c.Query("fcmToken"); token != "" {
+			input.FCMToken = token
+		}
+
+		query := db.Where("user_id = ?", userID)
+		if input.FCMToken != "" {
+			query = query.Where("token = ?", input.FCMToken)
+		}
+		result := query.Delete(&models.DeviceToken{})
+		if result.Error != nil {
 			c.JSON(500, gin.H{"error": "Failed to remove FCM token"})
 			return
 		}
 
 		c.JSON(200, gin.H{
 			"message": "FCM token removed successfully",
+			"removed": result.RowsAffected,
 		})
 	}
 }
@@ -124,34 +146,27 @@ func SendBroadcastNotificationHandler(db *gorm.DB) gin.HandlerFunc {
 			input.UserType = "all"
 		}
 
-		// Get tokens based on user type
-		var users []models.User
-		query := db.Where("fcm_token != ?", "")
+		// Get the tokens of every device of the chosen users
+		query := db.Model(&models.DeviceToken{}).
+			Joins("JOIN users ON users.id = device_tokens.user_id AND users.deleted_at IS NULL")
 
 		if input.UserType == "drivers" {
-			query = query.Where("user_type = ?", models.UserTypeDriver)
+			query = query.Where("users.user_type = ?", models.UserTypeDriver)
 		} else if input.UserType == "clients" {
-			query = query.Where("user_type = ?", models.UserTypeClient)
+			query = query.Where("users.user_type = ?", models.UserTypeClient)
 		}
 
-		if err := query.Find(&users).Error; err != nil {
+		var tokens []string
+		if err := query.Pluck("device_tokens.token", &tokens).Error; err != nil {
 			c.JSON(500, gin.H{"error": "Failed to fetch user tokens"})
 			return
 		}
 
-		if len(users) == 0 {
+		if len(tokens) == 0 {
 			c.JSON(400, gin.H{"error": "No users with FCM tokens found"})
 			return
 		}
 
-		// Extract tokens
-		tokens := make([]string, 0, len(users))
-		for _, u := range users {
-			if u.FCMToken != "" {
-				tokens = append(tokens, u.FCMToken)
-			}
-		}
-
 		// Send broadcast notification
 		ctx := context.Background()
 		ctx = context.WithValue(ctx, "timestamp", time.Now().Unix())
@@ -183,26 +198,21 @@ func NotifyScheduledRidesAvailable(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		// Get all client tokens
-		var clients []models.User
-		if err := db.Where("user_type = ? AND fcm_token != ?", models.UserTypeClient, "").Find(&clients).Error; err != nil {
+		// Get the tokens of every client device
+		var tokens []string
+		if err := db.Model(&models.DeviceToken{}).
+			Joins("JOIN users ON users.id = device_tokens.user_id AND users.deleted_at IS NULL").
+			Where("users.user_type = ?", models.UserTypeClient).
+			Pluck("device_tokens.token", &tokens).Error; err != nil {
 			c.JSON(500, gin.H{"error": "Failed to fetch client tokens"})
 			return
 		}
 
-		if len(clients) == 0 {
+		if len(tokens) == 0 {
 			c.JSON(400, gin.H{"error": "No clients with FCM tokens found"})
 			return
 		}
 
-		// Extract tokens
-		tokens := make([]string, 0, len(clients))
-		for _, client := range clients {
-			if client.FCMToken != "" {
-				tokens = append(tokens, client.FCMToken)
-			}
-		}
-
 		// Send notification
 		ctx := context.Background()
 		response, err := services.SendScheduledRidesAvailableNotification(ctx, tokens, input.Count)
@@ -225,36 +235,46 @@ func TestNotification(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.GetUint("userId")
 
-		// Get user's FCM token
-		var user models.User
-		if err := db.First(&user, userID).Error; err != nil {
+		// Get the user's devices
+		tokens, err := deviceTokens(db, userID)
+		if err != nil {
 			c.JSON(500, gin.H{"error": "Failed to get user information"})
 			return
 		}
 
-		if user.FCMToken == "" {
+		if len(tokens) == 0 {
 			c.JSON(400, gin.H{"error": "No FCM token registered for this user"})
 			return
 		}
 
+		message, err := utils.RenderMessage("test_notification", userLanguage(db, userID), nil)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to render test notification", "details": err.Error()})
+			return
+		}
+
 		// Send test notification
 		ctx := context.Background()
 		payload := services.NotificationPayload{
-			Title: "Test Notification",
-			Body:  "This is a test notification from MooveIt",
+			Title: message.Title,
+			Body:  message.Body,
 			Data: map[string]interface{}{
 				"type":   "test",
 				"userId": userID,
 			},
 		}
 
-		if err := services.SendNotificationToToken(ctx, user.FCMToken, payload); err != nil {
+		response, err := services.SendNotificationToMultipleTokens(ctx, tokens, payload)
+		if err != nil {
 			c.JSON(500, gin.H{"error": "Failed to send test notification", "details": err.Error()})
 			return
 		}
 
-		c.JSON(200, gin.H{
-			"message": "Test notification sent successfully",
-		})
+		result := gin.H{"message": "Test notification sent successfully", "devices": len(tokens)}
+		if response != nil {
+			result["successCount"] = response.SuccessCount
+			result["failureCount"] = response.FailureCount
+		}
+		c.JSON(200, result)
 	}
 }
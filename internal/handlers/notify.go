@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Notification is an event to tell a user about
+type Notification struct {
+	Event  string
+	UserID uint
+	// Data fills in the event's templates and is passed on to the app
+	Data map[string]interface{}
+}
+
+// notify saves a notification to the user's inbox and sends it on every
+// channel their preferences allow. The messages are queued through the
+// outbox, so when db is a transaction nothing is sent unless it commits.
+// Each channel used is recorded as a NotificationDelivery.
+func notify(db *gorm.DB, n Notification) error {
+	event, ok := notificationEvents[n.Event]
+	if !ok {
+		return fmt.Errorf("unknown notification event %q", n.Event)
+	}
+
+	var user models.User
+	if err := db.First(&user, n.UserID).Error; err != nil {
+		return err
+	}
+
+	var preferences models.NotificationPreference
+	if err := db.Where("user_id = ?", n.UserID).First(&preferences).Error; err == gorm.ErrRecordNotFound {
+		preferences = *models.DefaultPreferences(n.UserID)
+	} else if err != nil {
+		return err
+	}
+
+	tokens, err := deviceTokens(db, n.UserID)
+	if err != nil {
+		return err
+	}
+
+	rendered, err := utils.RenderMessage(n.Event, user.PreferredLanguage, n.Data)
+	if err != nil {
+		return fmt.Errorf("render %s notification: %w", n.Event, err)
+	}
+
+	stored, err := json.Marshal(n.Data)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		inbox := models.Notification{
+			UserID: user.ID,
+			Event:  n.Event,
+			Title:  rendered.Title,
+			Body:   rendered.Body,
+			Data:   string(stored),
+		}
+		if err := tx.Create(&inbox).Error; err != nil {
+			return err
+		}
+		unread, err := unreadNotificationCount(tx, user.ID)
+		if err != nil {
+			return err
+		}
+
+		message, err := json.Marshal(services.WebSocketMessage{
+			Type: "notification",
+			Data: gin.H{"notification": notificationResponse(inbox), "unreadCount": unread},
+		})
+		if err != nil {
+			return err
+		}
+
+		data := make(map[string]interface{}, len(n.Data)+2)
+		for key, value := range n.Data {
+			data[key] = value
+		}
+		data["type"] = n.Event
+		data["inboxId"] = fmt.Sprintf("%d", inbox.ID)
+
+		// The app shows notifications while it is open whatever the
+		// preferences; they only decide what reaches the user outside it
+		type delivery struct {
+			channel string
+			jobType string
+			payload interface{}
+		}
+		deliveries := []delivery{
+			{models.ChannelWebSocket, services.JobWebSocket, services.WebSocketJob{UserID: user.ID, Message: message}},
+		}
+
+		enabled := categoryEnabled(preferences, event.category)
+		if enabled && preferences.PushEnabled && len(tokens) > 0 && rendered.Title != "" {
+			deliveries = append(deliveries, delivery{models.ChannelPush, services.JobPush, services.PushJob{
+				Tokens: tokens,
+				Notification: services.NotificationPayload{
+					Title:     rendered.Title,
+					Body:      rendered.Body,
+					Data:      data,
+					Sound:     event.sound,
+					ChannelID: event.channelID,
+					Priority:  event.priority,
+				},
+			}})
+		}
+		if enabled && preferences.SMSEnabled && user.PhoneNumber != "" && rendered.SMS != "" {
+			deliveries = append(deliveries, delivery{models.ChannelSMS, services.JobSMS,
+				services.SMSJob{To: []string{user.PhoneNumber}, Message: rendered.SMS}})
+		}
+		if enabled && preferences.EmailEnabled && user.Email != "" && rendered.HTML != "" {
+			deliveries = append(deliveries, delivery{models.ChannelEmail, services.JobEmail,
+				services.EmailJob{To: []string{user.Email}, Subject: rendered.Subject, Body: rendered.HTML}})
+		}
+
+		for _, d := range deliveries {
+			record := models.NotificationDelivery{
+				UserID:  user.ID,
+				Event:   n.Event,
+				Channel: d.channel,
+				Status:  models.DeliveryQueued,
+			}
+			if err := tx.Create(&record).Error; err != nil {
+				return err
+			}
+			if err := queueJobRef(tx, d.jobType, fmt.Sprintf("delivery:%d", record.ID), d.payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// notifyUser sends a notification outside any transaction, logging failures
+func notifyUser(db *gorm.DB, n Notification) {
+	if err := notify(db, n); err != nil {
+		log.Printf("Failed to notify user %d of %s: %v", n.UserID, n.Event, err)
+	}
+}
+
+// userLanguage is the language a user wants messages in
+func userLanguage(db *gorm.DB, userID uint) string {
+	var user models.User
+	if err := db.Select("preferred_language").First(&user, userID).Error; err != nil {
+		return utils.DefaultLanguage
+	}
+	return user.PreferredLanguage
+}
+
+// categoryEnabled reports whether the user wants notifications of a category
+func categoryEnabled(preferences models.NotificationPreference, category string) bool {
+	switch category {
+	case categoryBooking:
+		return preferences.BookingAlerts
+	case categoryRideRequest:
+		return preferences.RideRequestAlerts
+	case categoryRideStatus:
+		return preferences.RideStatusAlerts
+	}
+	return true
+}
+
+// TrackNotificationDeliveries records how each attempt to deliver a
+// notification went
+func TrackNotificationDeliveries(db *gorm.DB) {
+	services.OnJobAttempt(func(job services.Job, err error) {
+		var id uint
+		if _, scanErr := fmt.Sscanf(job.Ref, "delivery:%d", &id); scanErr != nil {
+			return
+		}
+
+		updates := map[string]interface{}{"attempts": job.Attempts}
+		switch {
+		case err == nil:
+			updates["status"] = models.DeliverySent
+			updates["sent_at"] = time.Now()
+			updates["last_error"] = ""
+		case job.FailedAt != nil:
+			updates["status"] = models.DeliveryFailed
+			updates["last_error"] = err.Error()
+		default:
+			updates["status"] = models.DeliveryRetrying
+			updates["last_error"] = err.Error()
+		}
+
+		if err := db.Model(&models.NotificationDelivery{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+			log.Printf("Failed to record delivery %d: %v", id, err)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// outboxPollInterval is how often committed outbox messages are queued
+	outboxPollInterval = time.Second
+	// outboxBatchSize is how many messages are queued per poll
+	outboxBatchSize = 100
+	// outboxRetention is how long queued messages are kept for inspection
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+// queueJob records a job in the outbox as part of tx
+func queueJob(tx *gorm.DB, jobType string, payload interface{}) error {
+	return queueJobRef(tx, jobType, "", payload)
+}
+
+// queueJobRef records a job in the outbox with a reference to what it is for
+func queueJobRef(tx *gorm.DB, jobType, ref string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&models.OutboxMessage{JobType: jobType, Payload: string(data), Ref: ref}).Error
+}
+
+// queueSMS records an SMS to send once tx commits
+func queueSMS(tx *gorm.DB, phone, message string) error {
+	if phone == "" {
+		return nil
+	}
+	return queueJob(tx, services.JobSMS, services.SMSJob{To: []string{phone}, Message: message})
+}
+
+// queueEmail records an email to send once tx commits
+func queueEmail(tx *gorm.DB, email, subject, body string) error {
+	if email == "" {
+		return nil
+	}
+	return queueJob(tx, services.JobEmail, services.EmailJob{To: []string{email}, Subject: subject, Body: body})
+}
+
+// OutboxRelay moves committed outbox messages onto the job queue
+type OutboxRelay struct {
+	db          *gorm.DB
+	lastCleanup time.Time
+}
+
+// NewOutboxRelay creates a relay for the outbox table
+func NewOutboxRelay(db *gorm.DB) *OutboxRelay {
+	return &OutboxRelay{db: db}
+}
+
+// Run relays messages until the process exits
+func (r *OutboxRelay) Run() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for r.Relay() == outboxBatchSize {
+			// Keep going while there is a backlog
+		}
+
+		if time.Since(r.lastCleanup) > time.Hour {
+			r.Cleanup()
+			r.lastCleanup = time.Now()
+		}
+	}
+}
+
+// Relay queues a batch of messages and returns how many were queued.
+// Locked rows are skipped so several instances can relay at once.
+func (r *OutboxRelay) Relay() int {
+	ctx := context.Background()
+	relayed := 0
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var messages []models.OutboxMessage
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("enqueued_at IS NULL").
+			Order("id").
+			Limit(outboxBatchSize).
+			Find(&messages).Error; err != nil {
+			return err
+		}
+
+		ids := make([]uint, 0, len(messages))
+		for _, message := range messages {
+			job := services.Job{
+				ID:        fmt.Sprintf("outbox-%d", message.ID),
+				Type:      message.JobType,
+				Ref:       message.Ref,
+				Payload:   json.RawMessage(message.Payload),
+				CreatedAt: message.CreatedAt,
+			}
+			if err := services.EnqueueJob(ctx, job); err != nil {
+				log.Printf("Failed to queue outbox message %d: %v", message.ID, err)
+				break
+			}
+			ids = append(ids, message.ID)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		relayed = len(ids)
+		return tx.Model(&models.OutboxMessage{}).Where("id IN ?", ids).Update("enqueued_at", time.Now()).Error
+	})
+	if err != nil {
+		log.Printf("Failed to relay outbox: %v", err)
+		return 0
+	}
+	return relayed
+}
+
+// Cleanup deletes messages queued longer ago than the retention period
+func (r *OutboxRelay) Cleanup() {
+	if err := r.db.Where("enqueued_at < ?", time.Now().Add(-outboxRetention)).
+		Delete(&models.OutboxMessage{}).Error; err != nil {
+		log.Printf("Failed to clean up outbox: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ParcelTracking is what anyone holding a tracking code may see about a
+// parcel. It leaves out contact details and the delivery code.
+type ParcelTracking struct {
+	TrackingCode    string          `json:"trackingCode"`
+	Status          string          `json:"status"`
+	StatusText      string          `json:"statusText"`
+	StatusUpdatedAt time.Time       `json:"statusUpdatedAt"`
+	ReceiverName    string          `json:"receiverName"`
+	Destination     string          `json:"destination"`
+	Driver          *TrackingDriver `json:"driver,omitempty"`
+	DriverLocation  *utils.Point    `json:"driverLocation,omitempty"`
+	ETAMinutes      *int            `json:"etaMinutes,omitempty"`
+	History         []TrackingEvent `json:"history"`
+}
+
+// TrackingDriver identifies the vehicle carrying a parcel
+type TrackingDriver struct {
+	Name     string `json:"name"`
+	CarMake  string `json:"carMake"`
+	CarColor string `json:"carColor"`
+	CarPlate string `json:"carPlate"`
+}
+
+// TrackingEvent is a status change shown on the tracking timeline
+type TrackingEvent struct {
+	Status     string    `json:"status"`
+	StatusText string    `json:"statusText"`
+	Note       string    `json:"note,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// InTransit reports whether the driver's live position is being shared
+func (t ParcelTracking) InTransit() bool {
+	return t.Status == models.ParcelStatusPickedUp || t.Status == models.ParcelStatusInTransit
+}
+
+// MapURL is an embeddable map centered on the driver's position
+func (t ParcelTracking) MapURL() string {
+	if t.DriverLocation == nil {
+		return ""
+	}
+	lat, lng := t.DriverLocation.Lat, t.DriverLocation.Lng
+	return fmt.Sprintf("https://www.openstreetmap.org/export/embed.html?bbox=%f,%f,%f,%f&marker=%f,%f",
+		lng-0.01, lat-0.01, lng+0.01, lat+0.01, lat, lng)
+}
+
+// loadParcelTracking builds the public tracking view of a parcel. The
+// driver's position and ETA are only included while the parcel is on its way.
+func loadParcelTracking(db *gorm.DB, code string) (*ParcelTracking, error) {
+	var parcel models.Parcel
+	if err := db.Preload("Ride.Driver").Where("tracking_code = ?", code).First(&parcel).Error; err != nil {
+		return nil, err
+	}
+
+	var events []models.ParcelStatusEvent
+	if err := db.Where("parcel_id = ?", parcel.ID).Order("created_at ASC").Find(&events).Error; err != nil {
+		return nil, err
+	}
+
+	tracking := &ParcelTracking{
+		TrackingCode:    parcel.TrackingCode,
+		Status:          parcel.Status,
+		StatusText:      utils.ParcelStatusText(parcel.Status),
+		StatusUpdatedAt: parcel.StatusUpdatedAt,
+		ReceiverName:    parcel.ReceiverName,
+		Destination:     parcel.Destination,
+		History:         make([]TrackingEvent, 0, len(events)),
+	}
+	for _, event := range events {
+		tracking.History = append(tracking.History, TrackingEvent{
+			Status:     event.Status,
+			StatusText: utils.ParcelStatusText(event.Status),
+			Note:       event.Note,
+			Time:       event.CreatedAt,
+		})
+	}
+
+	if !tracking.InTransit() {
+		return tracking, nil
+	}
+
+	if driver := parcel.Ride.Driver; driver != nil {
+		tracking.Driver = &TrackingDriver{
+			Name:     driver.Username,
+			CarMake:  driver.CarMake,
+			CarColor: driver.CarColor,
+			CarPlate: driver.CarPlate,
+		}
+	}
+
+	lat, lng, _, err := services.GetDriverLocation(context.Background(), parcel.Ride.DriverID)
+	if err != nil {
+		// No recent position, e.g. the driver's app is in the background
+		return tracking, nil
+	}
+	tracking.DriverLocation = &utils.Point{Lat: lat, Lng: lng}
+
+	if parcel.DestinationLat != nil && parcel.DestinationLng != nil {
+		distance := utils.HaversineDistance(lat, lng, *parcel.DestinationLat, *parcel.DestinationLng)
+		eta := utils.CalculateETA(distance, 30) // Assuming 30 km/h average speed
+		tracking.ETAMinutes = &eta
+	}
+
+	return tracking, nil
+}
+
+// TrackParcel returns a parcel's public tracking information as JSON
+func TrackParcel(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tracking, err := loadParcelTracking(db, c.Param("code"))
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Parcel not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load tracking information"})
+			return
+		}
+
+		c.JSON(http.StatusOK, tracking)
+	}
+}
+
+// TrackParcelPage renders the tracking page linked from receiver messages.
+// While the parcel is on its way the page polls TrackParcel for the driver's
+// position.
+func TrackParcelPage(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tracking, err := loadParcelTracking(db, c.Param("code"))
+		if err == gorm.ErrRecordNotFound {
+			c.HTML(http.StatusNotFound, "track.html", gin.H{"Code": c.Param("code")})
+			return
+		}
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, "track.html", gin.H{"Code": c.Param("code"), "Error": true})
+			return
+		}
+
+		c.HTML(http.StatusOK, "track.html", gin.H{"Code": tracking.TrackingCode, "Tracking": tracking})
+	}
+}
@@ -1,24 +1,49 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/chachabrian/mooveit-backend/internal/models"
 	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// errBookingClosed is returned when parcels are added to a booking that is no
+// longer pending or accepted
+var errBookingClosed = errors.New("booking is closed")
+
+// CreateParcel adds a parcel to a ride. It is booked together with the
+// client's other parcels by CreateBooking, or straight away when bookingId
+// names one of the client's open bookings on the ride.
 func CreateParcel(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+
 		var input struct {
-			RideID            uint   `form:"rideId" binding:"required"`
-			ParcelDescription string `form:"parcelDescription" binding:"required"`
-			ReceiverName      string `form:"receiverName" binding:"required"`
-			ReceiverContact   string `form:"receiverContact" binding:"required"`
-			ReceiverEmail     string `form:"receiverEmail" binding:"required,email"`
-			Destination       string `form:"destination" binding:"required"`
+			RideID            uint     `form:"rideId" binding:"required"`
+			BookingID         uint     `form:"bookingId"`
+			ParcelDescription string   `form:"parcelDescription" binding:"required"`
+			ReceiverName      string   `form:"receiverName" binding:"required"`
+			ReceiverContact   string   `form:"receiverContact" binding:"required"`
+			ReceiverEmail     string   `form:"receiverEmail" binding:"required,email"`
+			Destination       string   `form:"destination" binding:"required"`
+			DestinationLat    *float64 `form:"destinationLat" binding:"omitempty,min=-90,max=90"`
+			DestinationLng    *float64 `form:"destinationLng" binding:"omitempty,min=-180,max=180"`
+			WeightKg          float64  `form:"weightKg" binding:"required,gt=0"`
+			LengthCm          float64  `form:"lengthCm" binding:"omitempty,gt=0"`
+			WidthCm           float64  `form:"widthCm" binding:"omitempty,gt=0"`
+			HeightCm          float64  `form:"heightCm" binding:"omitempty,gt=0"`
+			Category          string   `form:"category" binding:"omitempty,oneof=general fragile perishable furniture"`
+			DeclaredValue     float64  `form:"declaredValue" binding:"omitempty,gte=0"`
+			InsuranceTier     string   `form:"insuranceTier" binding:"omitempty,oneof=none basic standard premium"`
 		}
 
 		// Parse form data
@@ -27,6 +52,34 @@ func CreateParcel(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		// Dimensions are all or nothing, a partial set gives no volume
+		dimensions := 0
+		for _, value := range []float64{input.LengthCm, input.WidthCm, input.HeightCm} {
+			if value > 0 {
+				dimensions++
+			}
+		}
+		if dimensions != 0 && dimensions != 3 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "lengthCm, widthCm and heightCm must be given together"})
+			return
+		}
+		if input.Category == "" {
+			input.Category = models.ParcelCategoryGeneral
+		}
+
+		// Insurance is priced on the declared value
+		var premium, coverage float64
+		if input.InsuranceTier == "" {
+			input.InsuranceTier = models.InsuranceNone
+		}
+		if tier, ok := models.FindInsuranceTier(input.InsuranceTier); ok {
+			if input.DeclaredValue <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "declaredValue is required to insure a parcel"})
+				return
+			}
+			premium, coverage = tier.Quote(input.DeclaredValue)
+		}
+
 		// Handle file upload
 		file, err := c.FormFile("parcelImage")
 		if err != nil {
@@ -51,18 +104,101 @@ func CreateParcel(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		// Reject parcels that could never fit the truck, even when empty
+		volume := input.LengthCm * input.WidthCm * input.HeightCm / 1e6
+		if (ride.CapacityKg != nil && input.WeightKg > *ride.CapacityKg) ||
+			(ride.CapacityM3 != nil && volume > *ride.CapacityM3) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Parcel is too large for this truck"})
+			return
+		}
+
+		var booking *models.Booking
+		if input.BookingID != 0 {
+			booking = &models.Booking{}
+			if err := db.First(booking, input.BookingID).Error; err != nil ||
+				booking.ClientID != userID || booking.RideID != input.RideID {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+				return
+			}
+			if booking.Status != models.BookingStatusPending && booking.Status != models.BookingStatusAccepted {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Cannot add parcels to a %s booking", booking.Status)})
+				return
+			}
+		}
+
+		trackingCode, err := utils.GenerateTrackingCode()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tracking code"})
+			return
+		}
+
 		// Create parcel record with image URL
 		parcel := models.Parcel{
 			RideID:            input.RideID,
+			ClientID:          userID,
 			ParcelImage:       imageURL, // Store full URL (S3) or relative path (local)
 			ParcelDescription: input.ParcelDescription,
 			ReceiverName:      input.ReceiverName,
 			ReceiverContact:   input.ReceiverContact,
 			ReceiverEmail:     input.ReceiverEmail,
 			Destination:       input.Destination,
+			DestinationLat:    input.DestinationLat,
+			DestinationLng:    input.DestinationLng,
+			WeightKg:          input.WeightKg,
+			LengthCm:          input.LengthCm,
+			WidthCm:           input.WidthCm,
+			HeightCm:          input.HeightCm,
+			Category:          input.Category,
+			DeclaredValue:     input.DeclaredValue,
+			InsuranceTier:     input.InsuranceTier,
+			InsurancePremium:  premium,
+			CoverageAmount:    coverage,
+			TrackingCode:      trackingCode,
+			Status:            models.ParcelStatusCreated,
+			StatusUpdatedAt:   time.Now(),
 		}
 
-		if err := db.Create(&parcel).Error; err != nil {
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if booking != nil {
+				if err := reserveRideCapacity(tx, ride.ID, parcel.WeightKg, parcel.VolumeM3()); err != nil {
+					return err
+				}
+				// The booking may have been answered since it was read
+				if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(booking, booking.ID).Error; err != nil {
+					return err
+				}
+				if booking.Status != models.BookingStatusPending && booking.Status != models.BookingStatusAccepted {
+					return errBookingClosed
+				}
+				if err := tx.Model(booking).Updates(map[string]interface{}{
+					"reserved_kg":       gorm.Expr("reserved_kg + ?", parcel.WeightKg),
+					"reserved_m3":       gorm.Expr("reserved_m3 + ?", parcel.VolumeM3()),
+					"insurance_premium": gorm.Expr("insurance_premium + ?", parcel.InsurancePremium),
+					"total_price":       gorm.Expr("total_price + ?", parcel.InsurancePremium),
+				}).Error; err != nil {
+					return err
+				}
+				parcel.BookingID = &booking.ID
+			}
+			if err := tx.Create(&parcel).Error; err != nil {
+				return err
+			}
+			// Accepted bookings were already charged for their other parcels
+			if booking != nil && booking.Status == models.BookingStatusAccepted {
+				return chargeInsurance(tx, *booking, parcel.InsurancePremium,
+					fmt.Sprintf("Insurance for parcel %s on booking %d", parcel.TrackingCode, booking.ID))
+			}
+			return nil
+		})
+		if err == errRideFull {
+			c.JSON(http.StatusConflict, gin.H{"error": "Not enough space left on this ride for this parcel"})
+			return
+		}
+		if err == errBookingClosed {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Cannot add parcels to a %s booking", booking.Status)})
+			return
+		}
+		if err != nil {
 			// Log the actual error
 			fmt.Printf("Database error: %v\n", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -72,36 +208,241 @@ func CreateParcel(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		db.Create(&models.ParcelStatusEvent{
+			ParcelID:  parcel.ID,
+			Status:    models.ParcelStatusCreated,
+			ChangedBy: userID,
+		})
+
 		c.JSON(http.StatusCreated, parcel)
 	}
 }
 
+// GetParcelDetails returns the parcels of a booking to its client or driver.
+// The first parcel's details are also given at the top level for older apps.
 func GetParcelDetails(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		bookingId := c.Param("id")
+		userID := c.GetUint("userId")
 
 		var booking models.Booking
-		if err := db.Preload("Ride").First(&booking, bookingId).Error; err != nil {
+		if err := db.Preload("Ride").Preload("Parcels").First(&booking, bookingId).Error; err != nil {
 			c.JSON(404, gin.H{"error": "Booking not found"})
 			return
 		}
 
-		var parcel models.Parcel
-		if err := db.Where("ride_id = ?", booking.RideID).First(&parcel).Error; err != nil {
+		if booking.ClientID != userID && booking.Ride.DriverID != userID {
+			c.JSON(403, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		if len(booking.Parcels) == 0 {
 			c.JSON(404, gin.H{"error": "Parcel details not found"})
 			return
 		}
 
-		// Get full image URL (handles both S3 and local storage)
-		imageURL := services.GetImageURL(parcel.ParcelImage)
+		parcels := make([]gin.H, 0, len(booking.Parcels))
+		for _, parcel := range booking.Parcels {
+			parcels = append(parcels, parcelResponse(parcel))
+		}
+
+		response := parcelResponse(booking.Parcels[0])
+		response["parcels"] = parcels
+		c.JSON(200, response)
+	}
+}
+
+// parcelResponse formats a parcel for its sender or driver
+func parcelResponse(parcel models.Parcel) gin.H {
+	return gin.H{
+		"id":                parcel.ID,
+		"parcelImage":       services.GetImageURL(parcel.ParcelImage), // handles both S3 and local storage
+		"parcelDescription": parcel.ParcelDescription,
+		"receiverName":      parcel.ReceiverName,
+		"receiverContact":   parcel.ReceiverContact,
+		"receiverEmail":     parcel.ReceiverEmail,
+		"destination":       parcel.Destination,
+		"weightKg":          parcel.WeightKg,
+		"lengthCm":          parcel.LengthCm,
+		"widthCm":           parcel.WidthCm,
+		"heightCm":          parcel.HeightCm,
+		"category":          parcel.Category,
+		"declaredValue":     parcel.DeclaredValue,
+		"insuranceTier":     parcel.InsuranceTier,
+		"insurancePremium":  parcel.InsurancePremium,
+		"coverageAmount":    parcel.CoverageAmount,
+		"trackingCode":      parcel.TrackingCode,
+		"status":            parcel.Status,
+		"statusUpdatedAt":   parcel.StatusUpdatedAt,
+	}
+}
+
+// UpdateParcelStatus lets the driver carrying a parcel move it through the
+// delivery lifecycle. The receiver is told about every change.
+func UpdateParcelStatus(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+		userType := c.GetString("userType")
+
+		if userType != string(models.UserTypeDriver) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can update parcel status"})
+			return
+		}
+
+		var input struct {
+			// Delivery is completed through CompleteDelivery with the receiver's code
+			Status string `json:"status" binding:"required,oneof=picked_up in_transit failed returned"`
+			Note   string `json:"note" binding:"max=500"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var parcel models.Parcel
+		if err := db.Preload("Ride").First(&parcel, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Parcel not found"})
+			return
+		}
+
+		if parcel.Ride.DriverID != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the driver carrying this parcel can update it"})
+			return
+		}
+
+		// The parcel only leaves the sender once its booking is accepted
+		var booking models.Booking
+		if parcel.BookingID == nil ||
+			db.Where("id = ? AND status IN ?", *parcel.BookingID,
+				[]models.BookingStatus{models.BookingStatusAccepted, models.BookingStatusInProgress}).
+				First(&booking).Error != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The booking for this parcel has not been accepted"})
+			return
+		}
+
+		if !parcel.CanTransitionTo(input.Status) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Cannot change parcel status from %s to %s", parcel.Status, input.Status),
+			})
+			return
+		}
+
+		if err := changeParcelStatus(db, &parcel, input.Status, input.Note, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update parcel status"})
+			return
+		}
+
+		notifyParcelStatus(hub, parcel, input.Note)
+
+		// The receiver confirms delivery with a code sent once the parcel is picked up
+		if parcel.Status == models.ParcelStatusPickedUp {
+			if err := issueDeliveryCode(db, &parcel); err != nil {
+				log.Printf("Failed to issue delivery code for parcel %d: %v", parcel.ID, err)
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":         "Parcel status updated successfully",
+			"parcelId":        parcel.ID,
+			"trackingCode":    parcel.TrackingCode,
+			"status":          parcel.Status,
+			"statusUpdatedAt": parcel.StatusUpdatedAt,
+		})
+	}
+}
+
+// GetParcelHistory returns a parcel's status changes to its sender or driver
+func GetParcelHistory(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+
+		var parcel models.Parcel
+		if err := db.Preload("Ride").First(&parcel, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Parcel not found"})
+			return
+		}
+
+		if !canViewParcel(parcel, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
+			return
+		}
 
-		c.JSON(200, gin.H{
-			"parcelImage":       imageURL,
-			"parcelDescription": parcel.ParcelDescription,
-			"receiverName":      parcel.ReceiverName,
-			"receiverContact":   parcel.ReceiverContact,
-			"receiverEmail":     parcel.ReceiverEmail,
-			"destination":       parcel.Destination,
+		var events []models.ParcelStatusEvent
+		if err := db.Where("parcel_id = ?", parcel.ID).Order("created_at ASC").Find(&events).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch parcel history"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"parcelId":     parcel.ID,
+			"trackingCode": parcel.TrackingCode,
+			"status":       parcel.Status,
+			"history":      events,
 		})
 	}
 }
+
+// canViewParcel reports whether the user sent the parcel or is carrying it
+func canViewParcel(parcel models.Parcel, userID uint) bool {
+	return parcel.ClientID == userID || parcel.Ride.DriverID == userID
+}
+
+// changeParcelStatus moves a parcel to a new status, records the change and
+// queues the receiver's SMS and email about it
+func changeParcelStatus(db *gorm.DB, parcel *models.Parcel, status, note string, changedBy uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&models.Parcel{}).
+			Where("id = ? AND status = ?", parcel.ID, parcel.Status).
+			Updates(map[string]interface{}{"status": status, "status_updated_at": now})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("parcel %d status changed concurrently", parcel.ID)
+		}
+
+		event := models.ParcelStatusEvent{
+			ParcelID:  parcel.ID,
+			Status:    status,
+			Note:      note,
+			ChangedBy: changedBy,
+		}
+		if err := tx.Create(&event).Error; err != nil {
+			return err
+		}
+
+		message, err := utils.ParcelStatusMessage(parcel.ReceiverName, parcel.TrackingCode, status, note)
+		if err != nil {
+			return err
+		}
+		if err := errors.Join(
+			queueSMS(tx, parcel.ReceiverContact, message.SMS),
+			queueEmail(tx, parcel.ReceiverEmail, message.Subject, message.HTML),
+		); err != nil {
+			return err
+		}
+
+		parcel.Status = status
+		parcel.StatusUpdatedAt = now
+		return nil
+	})
+}
+
+// notifyParcelStatus tells the sender over WebSocket that a parcel changed
+// status. The receiver's messages were queued with the change.
+func notifyParcelStatus(hub *services.Hub, parcel models.Parcel, note string) {
+	message := services.WebSocketMessage{
+		Type: "parcel_status",
+		Data: gin.H{
+			"parcelId":     parcel.ID,
+			"trackingCode": parcel.TrackingCode,
+			"status":       parcel.Status,
+			"note":         note,
+			"updatedAt":    parcel.StatusUpdatedAt,
+		},
+	}
+	if data, err := json.Marshal(message); err == nil {
+		hub.BroadcastToUser(parcel.ClientID, data)
+	}
+}
@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// errDeliveryCodeLimit is returned when a parcel has been sent all the
+// delivery codes it may have
+var errDeliveryCodeLimit = errors.New("delivery code limit reached")
+
+// issueDeliveryCode generates a new delivery code for a parcel and sends it
+// to the receiver. Any previous code stops working.
+func issueDeliveryCode(db *gorm.DB, parcel *models.Parcel) error {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	timestamp := time.Now().Format("20060102150405.000000")
+	uniqueKey := fmt.Sprintf("%s-delivery-%s-%s", parcel.TrackingCode, timestamp, hex.EncodeToString(nonce))
+	code := utils.GenerateOTP(uniqueKey)
+
+	message, err := utils.DeliveryCodeMessage(parcel.ReceiverName, parcel.TrackingCode, code)
+	if err != nil {
+		return err
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Parcel{}).
+			Where("id = ? AND delivery_codes_sent < ?", parcel.ID, models.MaxDeliveryCodes).
+			Updates(map[string]interface{}{
+				"delivery_code":       code,
+				"delivery_attempts":   0,
+				"delivery_codes_sent": gorm.Expr("delivery_codes_sent + 1"),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errDeliveryCodeLimit
+		}
+		return queueSMS(tx, parcel.ReceiverContact, message.SMS)
+	}); err != nil {
+		return err
+	}
+
+	parcel.DeliveryCode = code
+	return nil
+}
+
+// ResendDeliveryCode sends the receiver a fresh delivery code. The driver or
+// sender can request it, e.g. after too many wrong attempts.
+func ResendDeliveryCode(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+
+		var parcel models.Parcel
+		if err := db.Preload("Ride").First(&parcel, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Parcel not found"})
+			return
+		}
+
+		if !canViewParcel(parcel, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		if parcel.Status != models.ParcelStatusPickedUp && parcel.Status != models.ParcelStatusInTransit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Parcel is not out for delivery"})
+			return
+		}
+
+		err := issueDeliveryCode(db, &parcel)
+		if errors.Is(err, errDeliveryCodeLimit) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "No more delivery codes can be sent for this parcel, contact support"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send delivery code"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "A new delivery code has been sent to the receiver"})
+	}
+}
+
+// CompleteDelivery marks a parcel delivered once the driver enters the code
+// the receiver was sent. A photo of the parcel and the receiver's signature
+// can be attached as multipart files "photo" and "signature".
+func CompleteDelivery(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+		userType := c.GetString("userType")
+
+		if userType != string(models.UserTypeDriver) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can complete deliveries"})
+			return
+		}
+
+		var input struct {
+			Code       string   `form:"code" binding:"required,len=4,numeric"`
+			ReceivedBy string   `form:"receivedBy" binding:"max=100"`
+			Lat        *float64 `form:"lat" binding:"omitempty,min=-90,max=90"`
+			Lng        *float64 `form:"lng" binding:"omitempty,min=-180,max=180"`
+		}
+		if err := c.ShouldBind(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var parcel models.Parcel
+		if err := db.Preload("Ride").First(&parcel, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Parcel not found"})
+			return
+		}
+
+		if parcel.Ride.DriverID != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the driver carrying this parcel can deliver it"})
+			return
+		}
+
+		if !parcel.CanTransitionTo(models.ParcelStatusDelivered) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Parcel is not out for delivery"})
+			return
+		}
+
+		if parcel.DeliveryCode == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No delivery code has been sent, request a new one"})
+			return
+		}
+
+		// Count the attempt before checking it, so parallel guesses can't
+		// get past the limit
+		result := db.Model(&models.Parcel{}).
+			Where("id = ? AND delivery_attempts < ?", parcel.ID, models.MaxDeliveryAttempts).
+			Update("delivery_attempts", gorm.Expr("delivery_attempts + 1"))
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check delivery code"})
+			return
+		}
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many incorrect codes, request a new one"})
+			return
+		}
+
+		if !matchesDeliveryCode(parcel, input.Code) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":             "Incorrect delivery code",
+				"attemptsRemaining": models.MaxDeliveryAttempts - parcel.DeliveryAttempts - 1,
+			})
+			return
+		}
+
+		proof := models.ProofOfDelivery{
+			ParcelID:    parcel.ID,
+			DriverID:    userID,
+			OTPVerified: true,
+			ReceivedBy:  input.ReceivedBy,
+			Latitude:    input.Lat,
+			Longitude:   input.Lng,
+			DeliveredAt: time.Now(),
+		}
+
+		// Optional evidence of the hand-over
+		if file, err := c.FormFile("photo"); err == nil {
+			url, err := services.UploadImage(file, "deliveries")
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload delivery photo"})
+				return
+			}
+			proof.PhotoURL = url
+		}
+		if file, err := c.FormFile("signature"); err == nil {
+			url, err := services.UploadImage(file, "signatures")
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload signature"})
+				return
+			}
+			proof.SignatureURL = url
+		}
+
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&proof).Error; err != nil {
+				return err
+			}
+			return changeParcelStatus(tx, &parcel, models.ParcelStatusDelivered, "", userID)
+		}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save proof of delivery"})
+			return
+		}
+
+		notifyParcelStatus(hub, parcel, "")
+		go completeBookingDeliveries(db, hub, parcel)
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":      "Parcel delivered successfully",
+			"trackingCode": parcel.TrackingCode,
+			"status":       parcel.Status,
+			"proof":        proofResponse(proof),
+		})
+	}
+}
+
+// GetDeliveryProof returns a parcel's proof of delivery to its sender or driver
+func GetDeliveryProof(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+
+		var parcel models.Parcel
+		if err := db.Preload("Ride").First(&parcel, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Parcel not found"})
+			return
+		}
+
+		if !canViewParcel(parcel, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		respondDeliveryProof(c, db, parcel)
+	}
+}
+
+// GetDeliveryProofByTrackingCode returns the proof of delivery to the
+// receiver, who proves who they are with the delivery code they were sent.
+// After MaxProofAttempts wrong codes the proof is only shown to the sender
+// and driver, so the code can't be guessed.
+func GetDeliveryProofByTrackingCode(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var parcel models.Parcel
+		if err := db.Where("tracking_code = ?", c.Param("code")).First(&parcel).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Parcel not found"})
+			return
+		}
+
+		// Count the attempt before checking it, so parallel guesses can't
+		// get past the limit
+		result := db.Model(&models.Parcel{}).
+			Where("id = ? AND proof_attempts < ?", parcel.ID, models.MaxProofAttempts).
+			Update("proof_attempts", gorm.Expr("proof_attempts + 1"))
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check delivery code"})
+			return
+		}
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many incorrect codes, ask the sender for the proof of delivery"})
+			return
+		}
+
+		if !matchesDeliveryCode(parcel, c.Query("deliveryCode")) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":             "Invalid delivery code",
+				"attemptsRemaining": models.MaxProofAttempts - parcel.ProofAttempts - 1,
+			})
+			return
+		}
+
+		db.Model(&parcel).Update("proof_attempts", 0)
+		respondDeliveryProof(c, db, parcel)
+	}
+}
+
+// matchesDeliveryCode checks a code against the one the parcel was delivered
+// with, which is kept after delivery so the receiver can view the proof
+func matchesDeliveryCode(parcel models.Parcel, code string) bool {
+	if parcel.DeliveryCode == "" || len(code) != len(parcel.DeliveryCode) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(code), []byte(parcel.DeliveryCode)) == 1
+}
+
+// respondDeliveryProof writes a parcel's proof of delivery as JSON
+func respondDeliveryProof(c *gin.Context, db *gorm.DB, parcel models.Parcel) {
+	var proof models.ProofOfDelivery
+	if err := db.Where("parcel_id = ?", parcel.ID).First(&proof).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Parcel has not been delivered"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"parcelId":     parcel.ID,
+		"trackingCode": parcel.TrackingCode,
+		"receiverName": parcel.ReceiverName,
+		"proof":        proofResponse(proof),
+	})
+}
+
+// proofResponse formats a proof of delivery with full image URLs
+func proofResponse(proof models.ProofOfDelivery) gin.H {
+	response := gin.H{
+		"otpVerified": proof.OTPVerified,
+		"receivedBy":  proof.ReceivedBy,
+		"deliveredAt": proof.DeliveredAt,
+	}
+	if proof.PhotoURL != "" {
+		response["photoUrl"] = services.GetImageURL(proof.PhotoURL)
+	}
+	if proof.SignatureURL != "" {
+		response["signatureUrl"] = services.GetImageURL(proof.SignatureURL)
+	}
+	if proof.Latitude != nil && proof.Longitude != nil {
+		response["location"] = gin.H{"lat": *proof.Latitude, "lng": *proof.Longitude}
+	}
+	return response
+}
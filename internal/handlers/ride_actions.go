@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+)
+
+// actionError is a failed ride action together with the HTTP status it maps
+// to, so REST handlers and WebSocket commands report failures the same way
+type actionError struct {
+	status  int
+	message string
+}
+
+func (e *actionError) Error() string {
+	return e.message
+}
+
+func newActionError(status int, message string) *actionError {
+	return &actionError{status: status, message: message}
+}
+
+// respondActionError writes an action error as a JSON error response
+func respondActionError(c *gin.Context, err error) {
+	if actionErr, ok := err.(*actionError); ok {
+		c.JSON(actionErr.status, gin.H{"error": actionErr.message})
+		return
+	}
+	c.JSON(500, gin.H{"error": err.Error()})
+}
+
+// errorCodes maps action error statuses to WebSocket error codes
+var errorCodes = map[int]string{
+	400: "bad_request",
+	403: "forbidden",
+	404: "not_found",
+	409: "conflict",
+	500: "internal_error",
+}
+
+// toCommandError converts an action error into a WebSocket command error
+func toCommandError(err error) error {
+	actionErr, ok := err.(*actionError)
+	if !ok {
+		return err
+	}
+
+	code, ok := errorCodes[actionErr.status]
+	if !ok {
+		code = "error"
+	}
+	return &services.CommandError{
+		Status:  actionErr.status,
+		Code:    code,
+		Message: actionErr.message,
+	}
+}
+
+// decodeCommand unmarshals and validates a command payload using the same
+// binding rules as the REST endpoints
+func decodeCommand(command services.Command, input interface{}) error {
+	if len(command.Data) > 0 {
+		if err := json.Unmarshal(command.Data, input); err != nil {
+			return &services.CommandError{Status: 400, Code: "bad_request", Message: "Invalid command data"}
+		}
+	}
+	if err := binding.Validator.ValidateStruct(input); err != nil {
+		return &services.CommandError{Status: 400, Code: "bad_request", Message: err.Error()}
+	}
+	return nil
+}
+
+// rideIDInput identifies the ride a WebSocket command acts on
+type rideIDInput struct {
+	RideID uint `json:"rideId" binding:"required"`
+}
+
+// RegisterWebSocketCommands exposes ride actions over the WebSocket protocol.
+// Each command runs the same logic as its REST endpoint.
+func RegisterWebSocketCommands(db *gorm.DB, hub *services.Hub, batcher *LocationBatcher) {
+	hub.HandleCommand("ride.request", func(client *services.Client, command services.Command) (interface{}, error) {
+		var input rideRequestInput
+		if err := decodeCommand(command, &input); err != nil {
+			return nil, err
+		}
+		result, err := requestRide(db, hub)(client.ID, client.UserType, input)
+		return result, toCommandError(err)
+	})
+
+	hub.HandleCommand("ride.cancel", func(client *services.Client, command services.Command) (interface{}, error) {
+		var input rideIDInput
+		if err := decodeCommand(command, &input); err != nil {
+			return nil, err
+		}
+		result, err := cancelRide(db, hub)(client.ID, client.UserType, input.RideID)
+		return result, toCommandError(err)
+	})
+
+	hub.HandleCommand("ride.accept", func(client *services.Client, command services.Command) (interface{}, error) {
+		var input rideIDInput
+		if err := decodeCommand(command, &input); err != nil {
+			return nil, err
+		}
+		result, err := acceptRide(db, hub)(client.ID, client.UserType, input.RideID)
+		return result, toCommandError(err)
+	})
+
+	hub.HandleCommand("ride.reject", func(client *services.Client, command services.Command) (interface{}, error) {
+		var input rideIDInput
+		if err := decodeCommand(command, &input); err != nil {
+			return nil, err
+		}
+		result, err := rejectRide(db, hub)(client.UserType, input.RideID)
+		return result, toCommandError(err)
+	})
+
+	hub.HandleCommand("ride.arrive", func(client *services.Client, command services.Command) (interface{}, error) {
+		var input rideIDInput
+		if err := decodeCommand(command, &input); err != nil {
+			return nil, err
+		}
+		result, err := driverArrived(db, hub)(client.ID, client.UserType, input.RideID)
+		return result, toCommandError(err)
+	})
+
+	hub.HandleCommand("ride.start", func(client *services.Client, command services.Command) (interface{}, error) {
+		var input rideIDInput
+		if err := decodeCommand(command, &input); err != nil {
+			return nil, err
+		}
+		result, err := startRide(db, hub)(client.ID, client.UserType, input.RideID)
+		return result, toCommandError(err)
+	})
+
+	hub.HandleCommand("ride.complete", func(client *services.Client, command services.Command) (interface{}, error) {
+		var input struct {
+			RideID uint `json:"rideId" binding:"required"`
+			tripCompletionInput
+		}
+		if err := decodeCommand(command, &input); err != nil {
+			return nil, err
+		}
+		result, err := completeTrip(db, hub)(client.ID, client.UserType, input.RideID, input.tripCompletionInput)
+		return result, toCommandError(err)
+	})
+
+	hub.HandleCommand("driver.location", func(client *services.Client, command services.Command) (interface{}, error) {
+		var input driverLocationInput
+		if err := decodeCommand(command, &input); err != nil {
+			return nil, err
+		}
+		result, err := updateDriverLocation(db, hub, batcher, client.ID, client.UserType, input)
+		return result, toCommandError(err)
+	})
+}
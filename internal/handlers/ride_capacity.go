@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"gorm.io/gorm"
+)
+
+// errRideFull is returned when a parcel does not fit in the space left on a ride
+var errRideFull = errors.New("not enough space left on this ride")
+
+// rideCapacity returns the load limits to set on a new ride. Values given by
+// the driver take precedence over those derived from the truck size.
+func rideCapacity(truckSize string, capacityKg, capacityM3 *float64) (kg, m3 *float64) {
+	if capacity, ok := models.CapacityForTruckSize(truckSize); ok {
+		kg, m3 = &capacity.WeightKg, &capacity.VolumeM3
+	}
+	if capacityKg != nil {
+		kg = capacityKg
+	}
+	if capacityM3 != nil {
+		m3 = capacityM3
+	}
+	return kg, m3
+}
+
+// reserveRideCapacity takes a parcel's weight and volume off the space left
+// on a ride. The check and the update are a single statement, so two clients
+// booking the last space at once cannot both succeed. Rides without capacity
+// data accept any booking.
+func reserveRideCapacity(tx *gorm.DB, rideID uint, weightKg, volumeM3 float64) error {
+	if weightKg <= 0 && volumeM3 <= 0 {
+		return nil
+	}
+
+	result := tx.Model(&models.Ride{}).
+		Where("id = ?", rideID).
+		Where("remaining_kg IS NULL OR remaining_kg >= ?", weightKg).
+		Where("remaining_m3 IS NULL OR remaining_m3 >= ?", volumeM3).
+		Updates(map[string]interface{}{
+			"remaining_kg": gorm.Expr("remaining_kg - ?", weightKg),
+			"remaining_m3": gorm.Expr("remaining_m3 - ?", volumeM3),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errRideFull
+	}
+	return nil
+}
+
+// releaseRideCapacity gives the space held by a booking back to its ride
+func releaseRideCapacity(tx *gorm.DB, booking models.Booking) error {
+	if booking.ReservedKg <= 0 && booking.ReservedM3 <= 0 {
+		return nil
+	}
+
+	return tx.Model(&models.Ride{}).
+		Where("id = ?", booking.RideID).
+		Updates(map[string]interface{}{
+			"remaining_kg": gorm.Expr("LEAST(capacity_kg, remaining_kg + ?)", booking.ReservedKg),
+			"remaining_m3": gorm.Expr("LEAST(capacity_m3, remaining_m3 + ?)", booking.ReservedM3),
+		}).Error
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"gorm.io/gorm"
+)
+
+// geocodeTimeout bounds how long creating a ride waits for the geocoder
+const geocodeTimeout = 5 * time.Second
+
+// geocodeRide fills in a ride's missing coordinates and normalised place
+// names. Coordinates given by the driver are kept. Failures are logged and
+// leave the fields empty, the ride is still usable without them. The ride
+// is only marked geocoded when the geocoder answered for both ends, so
+// rides missed during an outage are retried by the backfill.
+func geocodeRide(ctx context.Context, ride *models.Ride) {
+	settled := true
+
+	if place, err := services.GeocodePlace(ctx, ride.CurrentLocation); err == nil {
+		ride.OriginName = place.Name
+		if ride.OriginLat == nil {
+			ride.OriginLat, ride.OriginLng = &place.Lat, &place.Lng
+		}
+	} else {
+		log.Printf("Failed to geocode origin %q: %v", ride.CurrentLocation, err)
+		settled = settled && errors.Is(err, services.ErrPlaceNotFound)
+	}
+
+	if place, err := services.GeocodePlace(ctx, ride.Destination); err == nil {
+		ride.DestinationName = place.Name
+		if ride.DestinationLat == nil {
+			ride.DestinationLat, ride.DestinationLng = &place.Lat, &place.Lng
+		}
+	} else {
+		log.Printf("Failed to geocode destination %q: %v", ride.Destination, err)
+		settled = settled && errors.Is(err, services.ErrPlaceNotFound)
+	}
+
+	if settled {
+		now := time.Now()
+		ride.GeocodedAt = &now
+	}
+}
+
+// hasCoordinates reports whether the driver gave both ends of the ride
+func hasCoordinates(ride models.Ride) bool {
+	return ride.OriginLat != nil && ride.OriginLng != nil &&
+		ride.DestinationLat != nil && ride.DestinationLng != nil
+}
+
+// saveRideGeocoding stores what geocodeRide filled in
+func saveRideGeocoding(db *gorm.DB, ride *models.Ride) error {
+	return db.Model(ride).
+		Select("origin_lat", "origin_lng", "origin_name", "destination_lat", "destination_lng", "destination_name", "geocoded_at").
+		Updates(ride).Error
+}
+
+// nameRidePlaces looks up the place names of a ride created with its
+// coordinates. The geocoder is shared and rate limited, so this runs after
+// the ride is saved rather than holding up its creation.
+func nameRidePlaces(db *gorm.DB, ride models.Ride) {
+	geocodeRide(context.Background(), &ride)
+	if err := saveRideGeocoding(db, &ride); err != nil {
+		log.Printf("Failed to save place names of ride %d: %v", ride.ID, err)
+	}
+}
+
+// BackfillRideCoordinates geocodes rides created before coordinates were
+// stored, or while the geocoder was unavailable. Each ride is attempted once
+// per run; it runs in the background at startup.
+func BackfillRideCoordinates(db *gorm.DB) {
+	ctx := context.Background()
+	total := 0
+	lastID := uint(0)
+
+	for {
+		var rides []models.Ride
+		if err := db.Where("geocoded_at IS NULL AND id > ?", lastID).Order("id").Limit(50).Find(&rides).Error; err != nil {
+			log.Printf("Failed to load rides to geocode: %v", err)
+			return
+		}
+		if len(rides) == 0 {
+			break
+		}
+
+		for _, ride := range rides {
+			lastID = ride.ID
+			geocodeRide(ctx, &ride)
+			if err := saveRideGeocoding(db, &ride); err != nil {
+				log.Printf("Failed to save coordinates of ride %d: %v", ride.ID, err)
+				return
+			}
+			if ride.GeocodedAt != nil {
+				total++
+			}
+		}
+	}
+
+	if total > 0 {
+		log.Printf("Geocoded %d existing rides", total)
+	}
+}
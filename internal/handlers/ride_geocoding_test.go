@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+)
+
+func TestGeocodeRide(t *testing.T) {
+	t.Setenv("GEOCODER", "stub")
+	services.InitGeocoder()
+
+	driverLat, driverLng := -1.3000, 36.8000
+	ride := models.Ride{
+		CurrentLocation: "Westlands, Nairobi",
+		Destination:     "mombasa old town",
+		OriginLat:       &driverLat,
+		OriginLng:       &driverLng,
+	}
+	geocodeRide(context.Background(), &ride)
+
+	// The driver's pin is more precise than the town centre
+	if *ride.OriginLat != driverLat || *ride.OriginLng != driverLng {
+		t.Errorf("origin moved to %v,%v, want the driver's %v,%v", *ride.OriginLat, *ride.OriginLng, driverLat, driverLng)
+	}
+	if ride.OriginName != "Nairobi" {
+		t.Errorf("origin name = %q, want Nairobi", ride.OriginName)
+	}
+
+	if ride.DestinationLat == nil || ride.DestinationLng == nil {
+		t.Fatal("destination coordinates not filled in")
+	}
+	if *ride.DestinationLat != -4.0435 || *ride.DestinationLng != 39.6682 {
+		t.Errorf("destination = %v,%v, want Mombasa", *ride.DestinationLat, *ride.DestinationLng)
+	}
+	if ride.DestinationName != "Mombasa" {
+		t.Errorf("destination name = %q, want Mombasa", ride.DestinationName)
+	}
+	if ride.GeocodedAt == nil {
+		t.Error("GeocodedAt not set")
+	}
+}
+
+func TestGeocodeRideUnknownPlace(t *testing.T) {
+	t.Setenv("GEOCODER", "stub")
+	services.InitGeocoder()
+
+	ride := models.Ride{CurrentLocation: "Atlantis", Destination: "Kisumu"}
+	geocodeRide(context.Background(), &ride)
+
+	if ride.OriginLat != nil || ride.OriginName != "" {
+		t.Errorf("unknown origin was filled in: %v %q", ride.OriginLat, ride.OriginName)
+	}
+	if ride.DestinationName != "Kisumu" {
+		t.Errorf("destination name = %q, want Kisumu", ride.DestinationName)
+	}
+	// The ride is still marked so the backfill does not retry it forever
+	if ride.GeocodedAt == nil {
+		t.Error("GeocodedAt not set")
+	}
+}
+
+func TestGeocodeRideGeocoderDown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	// Registered first so it runs after the environment is restored
+	t.Cleanup(services.InitGeocoder)
+	t.Setenv("GEOCODER", "")
+	t.Setenv("NOMINATIM_URL", server.URL)
+	services.InitGeocoder()
+
+	ride := models.Ride{CurrentLocation: "Nairobi", Destination: "Kisumu"}
+	geocodeRide(context.Background(), &ride)
+
+	// Left for the backfill to retry once the geocoder is back
+	if ride.GeocodedAt != nil {
+		t.Error("GeocodedAt set although the geocoder did not answer")
+	}
+}
+
+func TestHasCoordinates(t *testing.T) {
+	lat, lng := -1.2921, 36.8219
+	if hasCoordinates(models.Ride{OriginLat: &lat, OriginLng: &lng, DestinationLat: &lat}) {
+		t.Error("ride without a destination longitude has coordinates")
+	}
+	if !hasCoordinates(models.Ride{OriginLat: &lat, OriginLng: &lng, DestinationLat: &lat, DestinationLng: &lng}) {
+		t.Error("ride with both ends has no coordinates")
+	}
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"strconv"
 
 	"github.com/chachabrian/mooveit-backend/internal/models"
@@ -12,6 +13,20 @@ import (
 	"gorm.io/gorm"
 )
 
+// rideRequestInput is the pickup and destination of a ride request
+type rideRequestInput struct {
+	Pickup struct {
+		Lat     float64 `json:"lat" binding:"required"`
+		Lng     float64 `json:"lng" binding:"required"`
+		Address string  `json:"address" binding:"required"`
+	} `json:"pickup" binding:"required"`
+	Destination struct {
+		Lat     float64 `json:"lat" binding:"required"`
+		Lng     float64 `json:"lng" binding:"required"`
+		Address string  `json:"address" binding:"required"`
+	} `json:"destination" binding:"required"`
+}
+
 // RequestRide handles ride requests from clients
 func RequestRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -23,34 +38,37 @@ func RequestRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 			return
 		}
 
-		var input struct {
-			Pickup struct {
-				Lat     float64 `json:"lat" binding:"required"`
-				Lng     float64 `json:"lng" binding:"required"`
-				Address string  `json:"address" binding:"required"`
-			} `json:"pickup" binding:"required"`
-			Destination struct {
-				Lat     float64 `json:"lat" binding:"required"`
-				Lng     float64 `json:"lng" binding:"required"`
-				Address string  `json:"address" binding:"required"`
-			} `json:"destination" binding:"required"`
-		}
-
+		var input rideRequestInput
 		if err := c.ShouldBindJSON(&input); err != nil {
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
 
+		response, err := requestRide(db, hub)(clientID, userType, input)
+		if err != nil {
+			respondActionError(c, err)
+			return
+		}
+
+		c.JSON(200, response)
+	}
+}
+
+// requestRide creates a ride request and offers it to nearby drivers
+func requestRide(db *gorm.DB, hub *services.Hub) func(clientID uint, userType string, input rideRequestInput) (gin.H, error) {
+	return func(clientID uint, userType string, input rideRequestInput) (gin.H, error) {
+		if userType != string(models.UserTypeClient) {
+			return nil, newActionError(403, "Only clients can request rides")
+		}
+
 		// Validate coordinates
 		if input.Pickup.Lat < -90 || input.Pickup.Lat > 90 ||
 			input.Destination.Lat < -90 || input.Destination.Lat > 90 {
-			c.JSON(400, gin.H{"error": "Invalid latitude"})
-			return
+			return nil, newActionError(400, "Invalid latitude")
 		}
 		if input.Pickup.Lng < -180 || input.Pickup.Lng > 180 ||
 			input.Destination.Lng < -180 || input.Destination.Lng > 180 {
-			c.JSON(400, gin.H{"error": "Invalid longitude"})
-			return
+			return nil, newActionError(400, "Invalid longitude")
 		}
 
 		// Calculate distance and estimated price
@@ -64,8 +82,7 @@ func RequestRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		// Get client information first to avoid nil pointer issues
 		var client models.User
 		if err := db.Where("id = ?", clientID).First(&client).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to get client information"})
-			return
+			return nil, newActionError(500, "Failed to get client information")
 		}
 
 		// Create ride request
@@ -84,86 +101,12 @@ func RequestRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		}
 
 		if err := db.Create(&rideRequest).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to create ride request"})
-			return
-		}
-
-		// Find nearby available drivers
-		var locations []models.DriverLocation
-		if err := db.Where("is_online = ? AND is_available = ?", true, true).Find(&locations).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to find available drivers"})
-			return
-		}
-
-		// If no drivers found, return pending status
-		if len(locations) == 0 {
-			c.JSON(200, gin.H{
-				"message": "Ride request created. No drivers available at the moment.",
-				"rideId":  rideRequest.ID,
-				"status":  rideRequest.Status,
-			})
-			return
+			return nil, newActionError(500, "Failed to create ride request")
 		}
 
-		// Send ride request notifications to nearby drivers
-		notificationsSent := 0
-		ctx := context.Background()
-
-		for _, location := range locations {
-			driverDistance := utils.HaversineDistance(
-				input.Pickup.Lat, input.Pickup.Lng,
-				location.Latitude, location.Longitude,
-			)
-
-			// Only notify drivers within reasonable distance (e.g., 10km)
-			if driverDistance <= 10.0 {
-				// Create notification data
-				notificationData := gin.H{
-					"rideId":     rideRequest.ID,
-					"clientId":   clientID,
-					"clientName": client.Username,
-					"pickup": gin.H{
-						"lat":     input.Pickup.Lat,
-						"lng":     input.Pickup.Lng,
-						"address": input.Pickup.Address,
-					},
-					"destination": gin.H{
-						"lat":     input.Destination.Lat,
-						"lng":     input.Destination.Lng,
-						"address": input.Destination.Address,
-					},
-					"price":         price,
-					"distance":      driverDistance,
-					"duration":      duration,
-					"estimatedTime": utils.CalculateETA(driverDistance, 30),
-				}
-
-				// Create WebSocket message
-				rideNotification := services.WebSocketMessage{
-					Type: "ride_request",
-					Data: notificationData,
-				}
-
-				// Send FCM push notification to driver
-				var driver models.User
-				if err := db.First(&driver, location.DriverID).Error; err == nil && driver.FCMToken != "" {
-					go services.SendRideRequestNotification(
-						ctx,
-						driver.FCMToken,
-						rideRequest.ID,
-						client.Username,
-						input.Pickup.Address,
-						input.Destination.Address,
-						price,
-					)
-				}
-
-				// Marshal and send notification
-				if notificationBytes, err := json.Marshal(rideNotification); err == nil {
-					hub.BroadcastToUser(location.DriverID, notificationBytes)
-					notificationsSent++
-				}
-			}
+		notificationsSent, err := offerRideToNearbyDrivers(db, hub, rideRequest, client)
+		if err != nil {
+			return nil, err
 		}
 
 		responseMessage := "Ride request created."
@@ -173,14 +116,103 @@ func RequestRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 			responseMessage = "Ride request created. No drivers available at the moment."
 		}
 
-		c.JSON(200, gin.H{
+		return gin.H{
 			"message": responseMessage,
 			"rideId":  rideRequest.ID,
 			"status":  rideRequest.Status,
-		})
+		}, nil
 	}
 }
 
+// offerRideToNearbyDrivers sends a pending ride request to online, available
+// drivers within range and returns how many were notified. Drivers the ride was
+// already offered to are skipped, so it can be called again to re-dispatch.
+func offerRideToNearbyDrivers(db *gorm.DB, hub *services.Hub, rideRequest models.RideRequest, client models.User) (int, error) {
+	// Find nearby available drivers
+	var locations []models.DriverLocation
+	if err := db.Where("is_online = ? AND is_available = ?", true, true).Find(&locations).Error; err != nil {
+		return 0, newActionError(500, "Failed to find available drivers")
+	}
+
+	// Send ride request notifications to nearby drivers
+	notificationsSent := 0
+	ctx := context.Background()
+
+	alreadyOffered, err := services.GetRideOfferedDrivers(ctx, rideRequest.ID)
+	if err != nil {
+		alreadyOffered = map[uint]bool{}
+	}
+
+	for _, location := range locations {
+		if alreadyOffered[location.DriverID] {
+			continue
+		}
+
+		// Prefer the real-time position; the database copy is batched
+		if lat, lng, _, err := services.GetDriverLocation(ctx, location.DriverID); err == nil {
+			location.Latitude = lat
+			location.Longitude = lng
+		}
+
+		driverDistance := utils.HaversineDistance(
+			rideRequest.PickupLat, rideRequest.PickupLng,
+			location.Latitude, location.Longitude,
+		)
+
+		// Only notify drivers within reasonable distance (e.g., 10km)
+		if driverDistance <= 10.0 {
+			// Create notification data
+			notificationData := gin.H{
+				"rideId":     rideRequest.ID,
+				"clientId":   client.ID,
+				"clientName": client.Username,
+				"pickup": gin.H{
+					"lat":     rideRequest.PickupLat,
+					"lng":     rideRequest.PickupLng,
+					"address": rideRequest.PickupAddr,
+				},
+				"destination": gin.H{
+					"lat":     rideRequest.DestLat,
+					"lng":     rideRequest.DestLng,
+					"address": rideRequest.DestAddr,
+				},
+				"price":         rideRequest.Price,
+				"distance":      driverDistance,
+				"duration":      rideRequest.Duration,
+				"estimatedTime": utils.CalculateETA(driverDistance, 30),
+			}
+
+			// Create WebSocket message
+			rideNotification := services.WebSocketMessage{
+				Type: "ride_request",
+				Data: notificationData,
+			}
+
+			notifyUser(db, Notification{
+				Event:  eventRideRequest,
+				UserID: location.DriverID,
+				Data: map[string]interface{}{
+					"rideId":         rideRequest.ID,
+					"clientName":     client.Username,
+					"pickupAddress":  rideRequest.PickupAddr,
+					"destAddress":    rideRequest.DestAddr,
+					"fare":           rideRequest.Price,
+					"notificationId": fmt.Sprintf("ride_request_%d", rideRequest.ID),
+				},
+			})
+
+			// Marshal and send notification
+			if notificationBytes, err := json.Marshal(rideNotification); err == nil {
+				hub.BroadcastToUser(location.DriverID, notificationBytes)
+				services.RecordRideOffer(ctx, rideRequest.ID, location.DriverID)
+				notificationsSent++
+			}
+		}
+	}
+
+	return notificationsSent, nil
+}
+
 // CancelRide handles ride cancellations
 func CancelRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -194,33 +226,41 @@ func CancelRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 			return
 		}
 
+		response, err := cancelRide(db, hub)(userID, userType, uint(rideID))
+		if err != nil {
+			respondActionError(c, err)
+			return
+		}
+
+		c.JSON(200, response)
+	}
+}
+
+// cancelRide cancels a ride request on behalf of its client or assigned driver
+func cancelRide(db *gorm.DB, hub *services.Hub) func(userID uint, userType string, rideID uint) (gin.H, error) {
+	return func(userID uint, userType string, rideID uint) (gin.H, error) {
 		var rideRequest models.RideRequest
 		if err := db.First(&rideRequest, rideID).Error; err != nil {
-			c.JSON(404, gin.H{"error": "Ride not found"})
-			return
+			return nil, newActionError(404, "Ride not found")
 		}
 
 		// Check if user is authorized to cancel this ride
 		if userType == string(models.UserTypeClient) && rideRequest.ClientID != userID {
-			c.JSON(403, gin.H{"error": "Unauthorized to cancel this ride"})
-			return
+			return nil, newActionError(403, "Unauthorized to cancel this ride")
 		}
 		if userType == string(models.UserTypeDriver) && (rideRequest.DriverID == nil || *rideRequest.DriverID != userID) {
-			c.JSON(403, gin.H{"error": "Unauthorized to cancel this ride"})
-			return
+			return nil, newActionError(403, "Unauthorized to cancel this ride")
 		}
 
 		// Check if ride can be cancelled
 		if rideRequest.Status == models.RideStatusCompleted || rideRequest.Status == models.RideStatusCancelled {
-			c.JSON(400, gin.H{"error": "Ride cannot be cancelled"})
-			return
+			return nil, newActionError(400, "Ride cannot be cancelled")
 		}
 
 		// Update ride status
 		rideRequest.Status = models.RideStatusCancelled
 		if err := db.Save(&rideRequest).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to cancel ride"})
-			return
+			return nil, newActionError(500, "Failed to cancel ride")
 		}
 
 		// If driver was assigned, make them available again
@@ -230,6 +270,7 @@ func CancelRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 				driverLocation.IsAvailable = true
 				db.Save(&driverLocation)
 			}
+			services.ClearDriverActiveClient(context.Background(), *rideRequest.DriverID)
 		}
 
 		// Notify relevant parties
@@ -259,11 +300,11 @@ func CancelRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 			hub.BroadcastToUser(rideRequest.ClientID, data)
 		}
 
-		c.JSON(200, gin.H{
+		return gin.H{
 			"message": "Ride cancelled successfully",
 			"rideId":  rideRequest.ID,
 			"status":  rideRequest.Status,
-		})
+		}, nil
 	}
 }
 
@@ -381,6 +422,9 @@ func UpdateRideStatus(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 			c.JSON(500, gin.H{"error": "Failed to update ride status"})
 			return
 		}
+		if rideRequest.DriverID != nil {
+			services.ClearDriverActiveClient(context.Background(), *rideRequest.DriverID)
+		}
 
 		// Notify relevant parties
 		statusUpdate := services.WebSocketMessage{
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultRidePageSize = 20
+	maxRidePageSize     = 100
+	// maxRideSearchRange is the longest date range a search may cover
+	maxRideSearchRange = 90 * 24 * time.Hour
+	// defaultRideSearchRadius applies when coordinates are given without a radius, in km
+	defaultRideSearchRadius = 10.0
+	maxRideSearchRadius     = 100.0
+)
+
+// errInvalidCursor is returned for a cursor that was not issued by this API
+var errInvalidCursor = errors.New("invalid cursor")
+
+// rideSort is an ordering of rides. Rides with equal values are ordered by ID
+// so pages never overlap.
+type rideSort struct {
+	column string
+	desc   bool
+}
+
+// rideSorts maps the sort query parameter to an ordering
+var rideSorts = map[string]rideSort{
+	"date":   {column: "date"},
+	"-date":  {column: "date", desc: true},
+	"price":  {column: "price"},
+	"-price": {column: "price", desc: true},
+}
+
+// rideCursor marks the last ride of a page
+type rideCursor struct {
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+// value returns the ride's sort value as stored in a cursor
+func (s rideSort) value(ride models.Ride) string {
+	if s.column == "price" {
+		return strconv.FormatFloat(ride.Price, 'f', -1, 64)
+	}
+	return ride.Date.Format(time.RFC3339Nano)
+}
+
+// parse converts a cursor value back into something the database can compare
+func (s rideSort) parse(value string) (interface{}, error) {
+	if s.column == "price" {
+		return strconv.ParseFloat(value, 64)
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// paginateRides returns the page of rides after cursor and the cursor of the
+// next page, which is empty on the last page. A limit of 0 returns every
+// ride after cursor.
+func paginateRides(query *gorm.DB, sort rideSort, cursor string, limit int) ([]models.Ride, string, error) {
+	column := "rides." + sort.column
+	direction, comparison := "ASC", ">"
+	if sort.desc {
+		direction, comparison = "DESC", "<"
+	}
+
+	if cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, "", errInvalidCursor
+		}
+		var after rideCursor
+		if err := json.Unmarshal(raw, &after); err != nil {
+			return nil, "", errInvalidCursor
+		}
+		value, err := sort.parse(after.Value)
+		if err != nil {
+			return nil, "", errInvalidCursor
+		}
+		query = query.Where(
+			fmt.Sprintf("%s %s ? OR (%s = ? AND rides.id > ?)", column, comparison, column),
+			value, value, after.ID,
+		)
+	}
+
+	query = query.Order(fmt.Sprintf("%s %s, rides.id ASC", column, direction))
+	if limit > 0 {
+		query = query.Limit(limit + 1)
+	}
+
+	var rides []models.Ride
+	if err := query.Find(&rides).Error; err != nil {
+		return nil, "", err
+	}
+
+	if limit == 0 || len(rides) <= limit {
+		return rides, "", nil
+	}
+
+	rides = rides[:limit]
+	last := rides[limit-1]
+	raw, err := json.Marshal(rideCursor{Value: sort.value(last), ID: last.ID})
+	if err != nil {
+		return nil, "", err
+	}
+	return rides, base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// ridePageSize reads the limit query parameter
+func ridePageSize(c *gin.Context) int {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultRidePageSize)))
+	if err != nil || limit < 1 || limit > maxRidePageSize {
+		return defaultRidePageSize
+	}
+	return limit
+}
+
+// optionalPageSize returns 0, meaning every ride, unless the client asked
+// for pages with a limit or cursor
+func optionalPageSize(c *gin.Context) int {
+	if c.Query("limit") == "" && c.Query("cursor") == "" {
+		return 0
+	}
+	return ridePageSize(c)
+}
+
+// respondRides writes a page of rides as a plain list, passing the cursor of
+// the next page in the X-Next-Cursor header
+func respondRides(c *gin.Context, rides []models.Ride, nextCursor string) {
+	if nextCursor != "" {
+		c.Header("X-Next-Cursor", nextCursor)
+	}
+	c.JSON(200, rides)
+}
+
+// parseSearchTime accepts either a full timestamp or a date
+func parseSearchTime(value string) (time.Time, error) {
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// parseFloatQuery reads an optional numeric query parameter
+func parseFloatQuery(c *gin.Context, key string) (*float64, error) {
+	value := c.Query(key)
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s", key)
+	}
+	return &parsed, nil
+}
+
+// withinDistance keeps rides whose stored coordinates lie within radiusKm of
+// a point. The bounding box lets the database skip most rows before the
+// exact great-circle distance is computed.
+func withinDistance(c *gin.Context, query *gorm.DB, prefix, latColumn, lngColumn string) (*gorm.DB, error) {
+	lat, err := parseFloatQuery(c, prefix+"Lat")
+	if err != nil {
+		return nil, err
+	}
+	lng, err := parseFloatQuery(c, prefix+"Lng")
+	if err != nil {
+		return nil, err
+	}
+	if lat == nil && lng == nil {
+		return query, nil
+	}
+	if lat == nil || lng == nil || *lat < -90 || *lat > 90 || *lng < -180 || *lng > 180 {
+		return nil, fmt.Errorf("%sLat and %sLng must both be valid coordinates", prefix, prefix)
+	}
+
+	radius := defaultRideSearchRadius
+	if value, err := parseFloatQuery(c, prefix+"RadiusKm"); err != nil {
+		return nil, err
+	} else if value != nil {
+		if *value <= 0 || *value > maxRideSearchRadius {
+			return nil, fmt.Errorf("%sRadiusKm must be between 0 and %.0f", prefix, maxRideSearchRadius)
+		}
+		radius = *value
+	}
+
+	bbox := utils.GetBoundingBox(*lat, *lng, radius)
+	return query.
+		Where(fmt.Sprintf("%s BETWEEN ? AND ? AND %s BETWEEN ? AND ?", latColumn, lngColumn),
+			bbox.SouthWest.Lat, bbox.NorthEast.Lat, bbox.SouthWest.Lng, bbox.NorthEast.Lng).
+		Where(fmt.Sprintf(`6371 * acos(LEAST(1, cos(radians(?)) * cos(radians(%[1]s)) * cos(radians(%[2]s) - radians(?)) + sin(radians(?)) * sin(radians(%[1]s)))) <= ?`, latColumn, lngColumn),
+			*lat, *lng, *lat, radius), nil
+}
+
+// searchRides applies the filters shared by ride searches to query
+func searchRides(c *gin.Context, query *gorm.DB) (*gorm.DB, error) {
+	// Text matches the driver's wording or the geocoded place name
+	if destination := c.Query("destination"); destination != "" {
+		pattern := "%" + strings.ToLower(destination) + "%"
+		query = query.Where("LOWER(rides.destination) LIKE ? OR LOWER(rides.destination_name) LIKE ?", pattern, pattern)
+	}
+	if currentLocation := c.Query("currentLocation"); currentLocation != "" {
+		pattern := "%" + strings.ToLower(currentLocation) + "%"
+		query = query.Where("LOWER(rides.current_location) LIKE ? OR LOWER(rides.origin_name) LIKE ?", pattern, pattern)
+	}
+
+	minPrice, err := parseFloatQuery(c, "minPrice")
+	if err != nil {
+		return nil, err
+	}
+	if minPrice != nil {
+		query = query.Where("rides.price >= ?", *minPrice)
+	}
+	maxPrice, err := parseFloatQuery(c, "maxPrice")
+	if err != nil {
+		return nil, err
+	}
+	if maxPrice != nil {
+		query = query.Where("rides.price <= ?", *maxPrice)
+	}
+
+	if value := c.Query("truckSize"); value != "" {
+		sizes := strings.Split(strings.ToLower(value), ",")
+		for i := range sizes {
+			sizes[i] = strings.TrimSpace(sizes[i])
+		}
+		query = query.Where("LOWER(rides.truck_size) IN ?", sizes)
+	}
+
+	minRating, err := parseFloatQuery(c, "minRating")
+	if err != nil {
+		return nil, err
+	}
+	if minRating != nil {
+		query = query.Where(`rides.driver_id IN (
+			SELECT driver_id FROM driver_ratings
+			WHERE deleted_at IS NULL
+			GROUP BY driver_id
+			HAVING AVG(rating) >= ?)`, *minRating)
+	}
+
+	if query, err = withinDistance(c, query, "origin", "rides.origin_lat", "rides.origin_lng"); err != nil {
+		return nil, err
+	}
+	return withinDistance(c, query, "destination", "rides.destination_lat", "rides.destination_lng")
+}
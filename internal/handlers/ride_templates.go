@@ -0,0 +1,702 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// rideGenerationInterval is how often upcoming rides are generated from templates
+const rideGenerationInterval = time.Hour
+
+// rideGenerationHorizon is how far ahead rides are generated from templates
+func rideGenerationHorizon() time.Duration {
+	return utils.EnvDuration("RIDE_GENERATION_HORIZON", 14*24*time.Hour)
+}
+
+// RideGenerator keeps the rides of recurring templates listed a horizon ahead
+type RideGenerator struct {
+	db  *gorm.DB
+	hub *services.Hub
+}
+
+// NewRideGenerator creates a generator using RIDE_GENERATION_HORIZON (e.g.
+// "336h") as how far ahead rides are listed
+func NewRideGenerator(db *gorm.DB, hub *services.Hub) *RideGenerator {
+	return &RideGenerator{db: db, hub: hub}
+}
+
+// Run generates rides until the process exits
+func (g *RideGenerator) Run() {
+	g.Generate()
+
+	ticker := time.NewTicker(rideGenerationInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		g.Generate()
+	}
+}
+
+// Generate lists the upcoming rides of every active template
+func (g *RideGenerator) Generate() {
+	var templates []models.RideTemplate
+	if err := g.db.Where("status = ?", models.RideTemplateActive).Find(&templates).Error; err != nil {
+		log.Printf("Failed to load ride templates: %v", err)
+		return
+	}
+
+	total := 0
+	for _, template := range templates {
+		rides, err := generateTemplateRides(g.db, g.hub, template)
+		total += len(rides)
+		// A template cancelled since the list was loaded just stops
+		if err != nil && err != errTemplateInactive {
+			log.Printf("Failed to generate rides for template %d: %v", template.ID, err)
+		}
+	}
+
+	if total > 0 {
+		log.Printf("Generated %d rides from templates", total)
+	}
+}
+
+// generateTemplateRides creates the template's rides departing within the
+// horizon that were neither generated before nor skipped
+func generateTemplateRides(db *gorm.DB, hub *services.Hub, template models.RideTemplate) ([]models.Ride, error) {
+	now := time.Now()
+	days := template.Occurrences(now, now.Add(rideGenerationHorizon()))
+	if len(days) == 0 {
+		return nil, nil
+	}
+
+	// Deleted rides count as generated so a driver's deletion sticks
+	var generated []time.Time
+	if err := db.Unscoped().Model(&models.Ride{}).
+		Where("template_id = ? AND occurrence_date IN ?", template.ID, days).
+		Pluck("occurrence_date", &generated).Error; err != nil {
+		return nil, err
+	}
+	var skipped []time.Time
+	if err := db.Model(&models.RideTemplateException{}).
+		Where("template_id = ? AND occurrence_date IN ?", template.ID, days).
+		Pluck("occurrence_date", &skipped).Error; err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool)
+	for _, day := range append(generated, skipped...) {
+		exists[day.Format("2006-01-02")] = true
+	}
+
+	var rides []models.Ride
+	for _, day := range days {
+		if exists[day.Format("2006-01-02")] {
+			continue
+		}
+
+		ride, err := templateRide(template, day)
+		if err != nil {
+			return rides, err
+		}
+		created, err := createTemplateRide(db, &ride)
+		if err != nil {
+			return rides, err
+		}
+		if !created {
+			continue
+		}
+
+		go notifyRequestsForRide(db, hub, ride)
+		rides = append(rides, ride)
+	}
+	return rides, nil
+}
+
+// errTemplateInactive is returned when a ride is generated for a template
+// that was cancelled
+var errTemplateInactive = errors.New("ride template is not active")
+
+// createTemplateRide saves a ride generated from its template. created is
+// false when another instance generated the same occurrence meanwhile.
+func createTemplateRide(db *gorm.DB, ride *models.Ride) (created bool, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Hold the template so it can't be cancelled until the ride exists,
+		// where cancelling it will find the ride
+		var template models.RideTemplate
+		if err := tx.Clauses(clause.Locking{Strength: "SHARE"}).
+			Where("id = ? AND status = ?", *ride.TemplateID, models.RideTemplateActive).
+			First(&template).Error; err == gorm.ErrRecordNotFound {
+			return errTemplateInactive
+		} else if err != nil {
+			return err
+		}
+
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(ride)
+		created = result.RowsAffected > 0
+		return result.Error
+	})
+	return created, err
+}
+
+// templateRide builds the ride a template runs on a day
+func templateRide(template models.RideTemplate, day time.Time) (models.Ride, error) {
+	departure, err := template.Departure(day)
+	if err != nil {
+		return models.Ride{}, err
+	}
+
+	capacityKg, capacityM3 := rideCapacity(template.TruckSize, template.CapacityKg, template.CapacityM3)
+	templateID := template.ID
+	now := time.Now()
+
+	return models.Ride{
+		DriverID:        template.DriverID,
+		CurrentLocation: template.CurrentLocation,
+		Destination:     template.Destination,
+		TruckSize:       template.TruckSize,
+		Price:           template.Price,
+		Date:            departure,
+		Status:          models.RideAvailable,
+		CapacityKg:      capacityKg,
+		CapacityM3:      capacityM3,
+		RemainingKg:     capacityKg,
+		RemainingM3:     capacityM3,
+		OriginLat:       template.OriginLat,
+		OriginLng:       template.OriginLng,
+		DestinationLat:  template.DestinationLat,
+		DestinationLng:  template.DestinationLng,
+		RoutePolyline:   template.RoutePolyline,
+		OriginName:      template.OriginName,
+		DestinationName: template.DestinationName,
+		GeocodedAt:      &now, // the template was geocoded when it was created
+		TemplateID:      &templateID,
+		OccurrenceDate:  &day,
+	}, nil
+}
+
+// cancelTemplateRide takes a generated ride off the market and cancels its
+// bookings, telling each client why
+func cancelTemplateRide(db *gorm.DB, hub *services.Hub, ride models.Ride, reason string) error {
+	var bookings []models.Booking
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("ride_id = ? AND status IN ?", ride.ID,
+			[]models.BookingStatus{models.BookingStatusPending, models.BookingStatusAccepted}).
+			Find(&bookings).Error; err != nil {
+			return err
+		}
+		if len(bookings) > 0 {
+			if err := tx.Model(&models.Booking{}).
+				Where("ride_id = ? AND status IN ?", ride.ID,
+					[]models.BookingStatus{models.BookingStatusPending, models.BookingStatusAccepted}).
+				Update("status", models.BookingStatusCancelled).Error; err != nil {
+				return err
+			}
+		}
+		for _, booking := range bookings {
+			if booking.Status != models.BookingStatusAccepted {
+				continue
+			}
+			if err := refundInsurance(tx, booking); err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&ride).Update("status", models.RideCancelled).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&ride).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, booking := range bookings {
+		notifyRideCancelled(db, hub, booking, ride, reason)
+	}
+	return nil
+}
+
+// notifyRideCancelled tells a client their booking was cancelled with its ride
+func notifyRideCancelled(db *gorm.DB, hub *services.Hub, booking models.Booking, ride models.Ride, reason string) {
+	data := gin.H{
+		"bookingId": booking.ID,
+		"rideId":    ride.ID,
+		"date":      ride.Date,
+		"reason":    reason,
+	}
+	if message, err := json.Marshal(services.WebSocketMessage{Type: "ride_cancelled", Data: data}); err == nil {
+		hub.BroadcastToUser(booking.ClientID, message)
+	}
+
+	notifyUser(db, Notification{
+		Event:  eventRideCancelled,
+		UserID: booking.ClientID,
+		Data: map[string]interface{}{
+			"bookingId":   fmt.Sprintf("%d", booking.ID),
+			"rideId":      fmt.Sprintf("%d", ride.ID),
+			"origin":      ride.CurrentLocation,
+			"destination": ride.Destination,
+			"date":        ride.Date.Format("Mon 2 Jan 15:04"),
+			"reason":      reason,
+		},
+	})
+}
+
+// loadDriverTemplate loads a template owned by the requesting driver
+func loadDriverTemplate(c *gin.Context, db *gorm.DB) (*models.RideTemplate, bool) {
+	var template models.RideTemplate
+	if err := db.First(&template, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Ride template not found"})
+		return nil, false
+	}
+	if template.DriverID != c.GetUint("userId") {
+		c.JSON(403, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+	return &template, true
+}
+
+// parseOccurrenceDate reads an occurrence date such as "2024-05-20"
+func parseOccurrenceDate(value string) (time.Time, error) {
+	return time.Parse("2006-01-02", value)
+}
+
+// CreateRideTemplate sets up a recurring ride and lists its first rides
+func CreateRideTemplate(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := c.GetUint("userId")
+		userType := c.GetString("userType")
+
+		if userType != string(models.UserTypeDriver) {
+			c.JSON(403, gin.H{"error": "Only drivers can create rides"})
+			return
+		}
+
+		var input struct {
+			CurrentLocation string   `json:"currentLocation" binding:"required"`
+			Destination     string   `json:"destination" binding:"required"`
+			TruckSize       string   `json:"truckSize" binding:"required"`
+			Price           float64  `json:"price" binding:"required"`
+			CapacityKg      *float64 `json:"capacityKg" binding:"omitempty,gt=0"`
+			CapacityM3      *float64 `json:"capacityM3" binding:"omitempty,gt=0"`
+			OriginLat       *float64 `json:"originLat" binding:"omitempty,min=-90,max=90"`
+			OriginLng       *float64 `json:"originLng" binding:"omitempty,min=-180,max=180"`
+			DestinationLat  *float64 `json:"destinationLat" binding:"omitempty,min=-90,max=90"`
+			DestinationLng  *float64 `json:"destinationLng" binding:"omitempty,min=-180,max=180"`
+			RoutePolyline   string   `json:"routePolyline" binding:"max=20000"`
+			Recurrence      string   `json:"recurrence" binding:"required,oneof=daily weekdays weekly"`
+			Days            []string `json:"days"`
+			DepartureTime   string   `json:"departureTime" binding:"required"`
+			TimeZone        string   `json:"timeZone"`
+			StartDate       string   `json:"startDate"`
+			Until           string   `json:"until"`
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		if (input.OriginLat == nil) != (input.OriginLng == nil) ||
+			(input.DestinationLat == nil) != (input.DestinationLng == nil) {
+			c.JSON(400, gin.H{"error": "Coordinates need both a latitude and a longitude"})
+			return
+		}
+
+		if input.RoutePolyline != "" {
+			if _, err := utils.DecodePolyline(input.RoutePolyline); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid routePolyline"})
+				return
+			}
+		}
+
+		capacityKg, capacityM3 := rideCapacity(input.TruckSize, input.CapacityKg, input.CapacityM3)
+		if capacityM3 != nil && capacityKg == nil {
+			c.JSON(400, gin.H{"error": "capacityKg is required for this truck size"})
+			return
+		}
+
+		template := models.RideTemplate{
+			DriverID:        userId,
+			CurrentLocation: input.CurrentLocation,
+			Destination:     input.Destination,
+			TruckSize:       input.TruckSize,
+			Price:           input.Price,
+			CapacityKg:      input.CapacityKg,
+			CapacityM3:      input.CapacityM3,
+			OriginLat:       input.OriginLat,
+			OriginLng:       input.OriginLng,
+			DestinationLat:  input.DestinationLat,
+			DestinationLng:  input.DestinationLng,
+			RoutePolyline:   input.RoutePolyline,
+			Recurrence:      input.Recurrence,
+			DepartureTime:   input.DepartureTime,
+			TimeZone:        "Africa/Nairobi",
+			StartDate:       time.Now(),
+			Status:          models.RideTemplateActive,
+		}
+
+		if input.Recurrence == models.RecurrenceWeekly {
+			if len(input.Days) == 0 {
+				c.JSON(400, gin.H{"error": "days is required for weekly rides"})
+				return
+			}
+			days, err := models.ParseDays(input.Days)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			template.Days = days
+		}
+
+		if _, err := time.Parse("15:04", input.DepartureTime); err != nil {
+			c.JSON(400, gin.H{"error": "departureTime must be given as HH:MM"})
+			return
+		}
+		if input.TimeZone != "" {
+			if _, err := time.LoadLocation(input.TimeZone); err != nil {
+				c.JSON(400, gin.H{"error": "Unknown timeZone"})
+				return
+			}
+			template.TimeZone = input.TimeZone
+		}
+		if input.StartDate != "" {
+			startDate, err := parseOccurrenceDate(input.StartDate)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "startDate must be given as YYYY-MM-DD"})
+				return
+			}
+			template.StartDate = startDate
+		}
+		if input.Until != "" {
+			until, err := parseOccurrenceDate(input.Until)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "until must be given as YYYY-MM-DD"})
+				return
+			}
+			if until.Before(template.StartDate.Truncate(24 * time.Hour)) {
+				c.JSON(400, gin.H{"error": "until must not be before startDate"})
+				return
+			}
+			template.Until = &until
+		}
+
+		// Geocode once; every generated ride reuses the coordinates
+		sample := models.Ride{
+			CurrentLocation: template.CurrentLocation,
+			Destination:     template.Destination,
+			OriginLat:       template.OriginLat,
+			OriginLng:       template.OriginLng,
+			DestinationLat:  template.DestinationLat,
+			DestinationLng:  template.DestinationLng,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), geocodeTimeout)
+		geocodeRide(ctx, &sample)
+		cancel()
+		template.OriginLat, template.OriginLng, template.OriginName = sample.OriginLat, sample.OriginLng, sample.OriginName
+		template.DestinationLat, template.DestinationLng, template.DestinationName = sample.DestinationLat, sample.DestinationLng, sample.DestinationName
+
+		if err := db.Create(&template).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to create ride template"})
+			return
+		}
+
+		rides, err := generateTemplateRides(db, hub, template)
+		if err != nil {
+			log.Printf("Failed to generate rides for template %d: %v", template.ID, err)
+		}
+
+		c.JSON(201, gin.H{"template": template, "rides": rides})
+	}
+}
+
+// GetRideTemplates lists the driver's recurring rides
+func GetRideTemplates(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := c.GetUint("userId")
+
+		var templates []models.RideTemplate
+		if err := db.Where("driver_id = ?", userId).Order("created_at DESC").Find(&templates).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to fetch ride templates"})
+			return
+		}
+
+		c.JSON(200, gin.H{"templates": templates})
+	}
+}
+
+// GetRideTemplate returns a recurring ride with its upcoming rides and
+// skipped days
+func GetRideTemplate(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		template, ok := loadDriverTemplate(c, db)
+		if !ok {
+			return
+		}
+
+		var rides []models.Ride
+		if err := db.Where("template_id = ? AND date > ?", template.ID, time.Now()).
+			Order("date ASC").
+			Find(&rides).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to fetch rides"})
+			return
+		}
+
+		var exceptions []models.RideTemplateException
+		if err := db.Where("template_id = ? AND occurrence_date >= ?", template.ID, time.Now().Truncate(24*time.Hour)).
+			Order("occurrence_date ASC").
+			Find(&exceptions).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to fetch skipped days"})
+			return
+		}
+
+		skipped := make([]string, 0, len(exceptions))
+		for _, exception := range exceptions {
+			skipped = append(skipped, exception.OccurrenceDate.Format("2006-01-02"))
+		}
+
+		c.JSON(200, gin.H{"template": template, "rides": rides, "skipped": skipped})
+	}
+}
+
+// SkipRideOccurrence cancels a recurring ride on a single day. A ride
+// already generated for that day is cancelled along with its bookings.
+func SkipRideOccurrence(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		template, ok := loadDriverTemplate(c, db)
+		if !ok {
+			return
+		}
+		if template.Status != models.RideTemplateActive {
+			c.JSON(400, gin.H{"error": "Ride template is cancelled"})
+			return
+		}
+
+		day, err := parseOccurrenceDate(c.Param("date"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Date must be given as YYYY-MM-DD"})
+			return
+		}
+		if !containsDay(template.Occurrences(time.Now(), day.AddDate(0, 0, 2)), day) {
+			c.JSON(400, gin.H{"error": "The ride does not run on that day"})
+			return
+		}
+
+		exception := models.RideTemplateException{TemplateID: template.ID, OccurrenceDate: day}
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&exception).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to skip ride"})
+			return
+		}
+
+		var ride models.Ride
+		if err := db.Where("template_id = ? AND occurrence_date = ?", template.ID, day).First(&ride).Error; err == nil {
+			if err := cancelTemplateRide(db, hub, ride, "The driver is not running this route that day."); err != nil {
+				c.JSON(500, gin.H{"error": "Failed to cancel ride"})
+				return
+			}
+		}
+
+		c.JSON(200, gin.H{"message": "Ride skipped", "date": day.Format("2006-01-02")})
+	}
+}
+
+// containsDay reports whether a day is in a list of occurrence dates
+func containsDay(days []time.Time, day time.Time) bool {
+	for _, d := range days {
+		if d.Equal(day) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateRideOccurrence changes the price or departure time of a recurring
+// ride on a single day. Clients holding bookings are told of a new time.
+func UpdateRideOccurrence(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		template, ok := loadDriverTemplate(c, db)
+		if !ok {
+			return
+		}
+		if template.Status != models.RideTemplateActive {
+			c.JSON(400, gin.H{"error": "Ride template is cancelled"})
+			return
+		}
+
+		day, err := parseOccurrenceDate(c.Param("date"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Date must be given as YYYY-MM-DD"})
+			return
+		}
+
+		var input struct {
+			Price         *float64 `json:"price" binding:"omitempty,gt=0"`
+			DepartureTime string   `json:"departureTime"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		var ride models.Ride
+		if err := db.Where("template_id = ? AND occurrence_date = ?", template.ID, day).First(&ride).Error; err != nil {
+			// Generate the occurrence early so it can be edited
+			if !containsDay(template.Occurrences(time.Now(), day.AddDate(0, 0, 2)), day) {
+				c.JSON(404, gin.H{"error": "The ride does not run on that day"})
+				return
+			}
+			var skipped int64
+			db.Model(&models.RideTemplateException{}).Where("template_id = ? AND occurrence_date = ?", template.ID, day).Count(&skipped)
+			if skipped > 0 {
+				c.JSON(404, gin.H{"error": "The ride was skipped on that day"})
+				return
+			}
+			if ride, err = templateRide(*template, day); err != nil {
+				c.JSON(500, gin.H{"error": "Failed to generate ride"})
+				return
+			}
+			created, err := createTemplateRide(db, &ride)
+			if err == errTemplateInactive {
+				c.JSON(400, gin.H{"error": "Ride template is cancelled"})
+				return
+			}
+			if err != nil {
+				c.JSON(500, gin.H{"error": "Failed to generate ride"})
+				return
+			}
+			// The generator got there first
+			if !created {
+				if err := db.Where("template_id = ? AND occurrence_date = ?", template.ID, day).First(&ride).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to generate ride"})
+					return
+				}
+			}
+		}
+
+		if ride.Status != models.RideAvailable && ride.Status != models.RideBooked {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Ride is already %s", ride.Status)})
+			return
+		}
+
+		updates := map[string]interface{}{}
+		if input.Price != nil {
+			var bookings int64
+			db.Model(&models.Booking{}).Where("ride_id = ? AND status IN ?", ride.ID,
+				[]models.BookingStatus{models.BookingStatusPending, models.BookingStatusAccepted}).Count(&bookings)
+			if bookings > 0 {
+				c.JSON(409, gin.H{"error": "The price cannot change once the ride has bookings"})
+				return
+			}
+			updates["price"] = *input.Price
+		}
+		timeChanged := false
+		if input.DepartureTime != "" {
+			edited := *template
+			edited.DepartureTime = input.DepartureTime
+			departure, err := edited.Departure(day)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "departureTime must be given as HH:MM"})
+				return
+			}
+			if departure.Before(time.Now()) {
+				c.JSON(400, gin.H{"error": "Ride date must be in the future"})
+				return
+			}
+			timeChanged = !departure.Equal(ride.Date)
+			updates["date"] = departure
+		}
+		if len(updates) == 0 {
+			c.JSON(400, gin.H{"error": "Nothing to update"})
+			return
+		}
+
+		if err := db.Model(&ride).Updates(updates).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to update ride"})
+			return
+		}
+
+		if timeChanged {
+			go notifyRideRescheduled(db, hub, ride)
+		}
+
+		c.JSON(200, ride)
+	}
+}
+
+// notifyRideRescheduled tells clients holding bookings on a ride its new time
+func notifyRideRescheduled(db *gorm.DB, hub *services.Hub, ride models.Ride) {
+	var bookings []models.Booking
+	if err := db.Where("ride_id = ? AND status IN ?", ride.ID,
+		[]models.BookingStatus{models.BookingStatusPending, models.BookingStatusAccepted}).
+		Find(&bookings).Error; err != nil {
+		log.Printf("Failed to load bookings of ride %d: %v", ride.ID, err)
+		return
+	}
+
+	for _, booking := range bookings {
+		data := gin.H{"bookingId": booking.ID, "rideId": ride.ID, "date": ride.Date}
+		if message, err := json.Marshal(services.WebSocketMessage{Type: "ride_rescheduled", Data: data}); err == nil {
+			hub.BroadcastToUser(booking.ClientID, message)
+		}
+
+		notifyUser(db, Notification{
+			Event:  eventRideRescheduled,
+			UserID: booking.ClientID,
+			Data: map[string]interface{}{
+				"bookingId":   fmt.Sprintf("%d", booking.ID),
+				"rideId":      fmt.Sprintf("%d", ride.ID),
+				"origin":      ride.CurrentLocation,
+				"destination": ride.Destination,
+				"date":        ride.Date.Format("Mon 2 Jan 15:04"),
+			},
+		})
+	}
+}
+
+// CancelRideTemplate ends a recurring ride. Its upcoming rides are cancelled
+// and clients holding bookings on them are notified.
+func CancelRideTemplate(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		template, ok := loadDriverTemplate(c, db)
+		if !ok {
+			return
+		}
+
+		if template.Status == models.RideTemplateCancelled {
+			c.JSON(400, gin.H{"error": "Ride template is already cancelled"})
+			return
+		}
+
+		if err := db.Model(template).Update("status", models.RideTemplateCancelled).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to cancel ride template"})
+			return
+		}
+
+		var rides []models.Ride
+		if err := db.Where("template_id = ? AND date > ? AND status IN ?", template.ID, time.Now(),
+			[]string{models.RideAvailable, models.RideBooked}).Find(&rides).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to load upcoming rides"})
+			return
+		}
+
+		cancelled := 0
+		for _, ride := range rides {
+			if err := cancelTemplateRide(db, hub, ride, "The driver stopped running this route."); err != nil {
+				log.Printf("Failed to cancel ride %d: %v", ride.ID, err)
+				continue
+			}
+			cancelled++
+		}
+
+		c.JSON(200, gin.H{"message": "Ride template cancelled", "cancelledRides": cancelled})
+	}
+}
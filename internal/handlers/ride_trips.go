@@ -0,0 +1,346 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// errBookingsUndelivered is returned when a ride is completed with parcels still on board
+var errBookingsUndelivered = errors.New("some bookings have not been delivered")
+
+// errParcelsUndelivered is returned when a booking is delivered before all of its parcels
+var errParcelsUndelivered = errors.New("some parcels have not been delivered")
+
+// errTripTransition is returned when a ride cannot move to the requested trip status
+var errTripTransition = errors.New("invalid trip status change")
+
+// errNoAcceptedBookings is returned when a ride departs with nothing to carry
+var errNoAcceptedBookings = errors.New("ride has no accepted bookings")
+
+// notifyBookingStatus tells a client their booking moved on
+func notifyBookingStatus(db *gorm.DB, hub *services.Hub, booking models.Booking, ride models.Ride) {
+	data := gin.H{
+		"bookingId":  booking.ID,
+		"rideId":     ride.ID,
+		"status":     booking.Status,
+		"rideStatus": ride.Status,
+	}
+	if message, err := json.Marshal(services.WebSocketMessage{Type: "booking_status", Data: data}); err == nil {
+		hub.BroadcastToUser(booking.ClientID, message)
+	}
+
+	event := "booking_" + string(booking.Status)
+	if _, ok := notificationEvents[event]; !ok {
+		return
+	}
+	place := ride.Destination
+	if booking.Status == models.BookingStatusInProgress {
+		place = ride.CurrentLocation
+	}
+
+	notifyUser(db, Notification{
+		Event:  event,
+		UserID: booking.ClientID,
+		Data: map[string]interface{}{
+			"bookingId": fmt.Sprintf("%d", booking.ID),
+			"rideId":    fmt.Sprintf("%d", ride.ID),
+			"place":     place,
+		},
+	})
+}
+
+// expireBooking expires a pending booking and gives its space back to the
+// ride. ok is false when the booking was answered meanwhile.
+func expireBooking(tx *gorm.DB, booking *models.Booking) (ok bool, err error) {
+	result := tx.Model(&models.Booking{}).
+		Where("id = ? AND status = ?", booking.ID, models.BookingStatusPending).
+		Update("status", models.BookingStatusExpired)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	booking.Status = models.BookingStatusExpired
+
+	if err := releaseRideCapacity(tx, *booking); err != nil {
+		return false, err
+	}
+	// A ride that was full has room again
+	if err := tx.Model(&models.Ride{}).
+		Where("id = ? AND status = ? AND remaining_kg > 0", booking.RideID, models.RideBooked).
+		Update("status", models.RideAvailable).Error; err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// advanceTrip moves a ride to a new trip status and its bookings along with
+// it, returning the bookings that changed
+func advanceTrip(tx *gorm.DB, ride *models.Ride, status string) ([]models.Booking, error) {
+	now := time.Now()
+	updates := map[string]interface{}{"status": status}
+	var changed []models.Booking
+
+	switch status {
+	case models.RideDeparted:
+		updates["departed_at"] = now
+
+		// The parcels of accepted bookings are on board
+		var accepted []models.Booking
+		if err := tx.Where("ride_id = ? AND status = ?", ride.ID, models.BookingStatusAccepted).
+			Find(&accepted).Error; err != nil {
+			return nil, err
+		}
+		if err := tx.Model(&models.Booking{}).
+			Where("ride_id = ? AND status = ?", ride.ID, models.BookingStatusAccepted).
+			Update("status", models.BookingStatusInProgress).Error; err != nil {
+			return nil, err
+		}
+		for _, booking := range accepted {
+			booking.Status = models.BookingStatusInProgress
+			changed = append(changed, booking)
+		}
+
+		// Bookings the driver never answered can no longer be carried
+		var pending []models.Booking
+		if err := tx.Where("ride_id = ? AND status = ?", ride.ID, models.BookingStatusPending).
+			Find(&pending).Error; err != nil {
+			return nil, err
+		}
+		for _, booking := range pending {
+			ok, err := expireBooking(tx, &booking)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				changed = append(changed, booking)
+			}
+		}
+
+	case models.RideArrived:
+		updates["arrived_at"] = now
+
+	case models.RideCompleted:
+		var undelivered int64
+		if err := tx.Model(&models.Booking{}).
+			Where("ride_id = ? AND status = ?", ride.ID, models.BookingStatusInProgress).
+			Count(&undelivered).Error; err != nil {
+			return nil, err
+		}
+		if undelivered > 0 {
+			return nil, errBookingsUndelivered
+		}
+
+		updates["completed_at"] = now
+		var delivered []models.Booking
+		if err := tx.Where("ride_id = ? AND status = ?", ride.ID, models.BookingStatusDelivered).
+			Find(&delivered).Error; err != nil {
+			return nil, err
+		}
+		if err := tx.Model(&models.Booking{}).
+			Where("ride_id = ? AND status = ?", ride.ID, models.BookingStatusDelivered).
+			Updates(map[string]interface{}{"status": models.BookingStatusCompleted, "completed_at": now}).Error; err != nil {
+			return nil, err
+		}
+		for _, booking := range delivered {
+			booking.Status = models.BookingStatusCompleted
+			booking.CompletedAt = &now
+			changed = append(changed, booking)
+		}
+	}
+
+	if err := tx.Model(ride).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// UpdateTripStatus lets a driver move a posted ride through its trip:
+// departed, in_transit, arrived and completed
+func UpdateTripStatus(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+		userType := c.GetString("userType")
+
+		if userType != string(models.UserTypeDriver) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can update trips"})
+			return
+		}
+
+		var input struct {
+			Status string `json:"status" binding:"required,oneof=departed in_transit arrived completed"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var ride models.Ride
+		if err := db.First(&ride, c.Param("rideId")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
+			return
+		}
+
+		if ride.DriverID != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the driver of this ride can update it"})
+			return
+		}
+
+		var changed []models.Booking
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// Lock the ride so concurrent updates are checked against the status the other left
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&ride, ride.ID).Error; err != nil {
+				return err
+			}
+			if !ride.CanTransitionTo(input.Status) {
+				return errTripTransition
+			}
+
+			if input.Status == models.RideDeparted {
+				var accepted int64
+				if err := tx.Model(&models.Booking{}).
+					Where("ride_id = ? AND status = ?", ride.ID, models.BookingStatusAccepted).
+					Count(&accepted).Error; err != nil {
+					return err
+				}
+				if accepted == 0 {
+					return errNoAcceptedBookings
+				}
+			}
+
+			var err error
+			changed, err = advanceTrip(tx, &ride, input.Status)
+			return err
+		})
+		switch {
+		case errors.Is(err, errTripTransition):
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Cannot change ride status from %s to %s", ride.Status, input.Status),
+			})
+			return
+		case errors.Is(err, errNoAcceptedBookings):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The ride has no accepted bookings"})
+			return
+		case errors.Is(err, errBookingsUndelivered):
+			c.JSON(http.StatusConflict, gin.H{"error": "Deliver every booking before completing the ride"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update ride status"})
+			return
+		}
+
+		go func() {
+			for _, booking := range changed {
+				notifyBookingStatus(db, hub, booking, ride)
+			}
+		}()
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":         "Ride status updated successfully",
+			"rideId":          ride.ID,
+			"status":          ride.Status,
+			"bookingsUpdated": len(changed),
+		})
+	}
+}
+
+// markBookingDelivered moves a booking on board to delivered once each of
+// its parcels was handed over or returned. ok is false when the booking was
+// not in progress.
+func markBookingDelivered(db *gorm.DB, booking *models.Booking) (ok bool, err error) {
+	var remaining int64
+	if err := db.Model(&models.Parcel{}).
+		Where("booking_id = ? AND status NOT IN ?", booking.ID,
+			[]string{models.ParcelStatusDelivered, models.ParcelStatusReturned}).
+		Count(&remaining).Error; err != nil {
+		return false, err
+	}
+	if remaining > 0 {
+		return false, errParcelsUndelivered
+	}
+
+	now := time.Now()
+	result := db.Model(&models.Booking{}).
+		Where("id = ? AND status = ?", booking.ID, models.BookingStatusInProgress).
+		Updates(map[string]interface{}{"status": models.BookingStatusDelivered, "delivered_at": now})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	booking.Status = models.BookingStatusDelivered
+	booking.DeliveredAt = &now
+	return true, nil
+}
+
+// MarkBookingDelivered lets the driver record that a booking was dropped off.
+// Each parcel must have gone through CompleteDelivery first.
+func MarkBookingDelivered(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+
+		var booking models.Booking
+		if err := db.Preload("Ride").First(&booking, c.Param("bookingId")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+			return
+		}
+
+		if booking.Ride.DriverID != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the driver of this ride can deliver this booking"})
+			return
+		}
+
+		ok, err := markBookingDelivered(db, &booking)
+		if errors.Is(err, errParcelsUndelivered) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Complete the delivery of every parcel in this booking first"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update booking status"})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Booking is %s, not in progress", booking.Status)})
+			return
+		}
+
+		go notifyBookingStatus(db, hub, booking, booking.Ride)
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":     "Booking delivered",
+			"bookingId":   booking.ID,
+			"status":      booking.Status,
+			"deliveredAt": booking.DeliveredAt,
+		})
+	}
+}
+
+// completeBookingDeliveries marks a parcel's booking delivered once none of
+// its parcels are left to hand over
+func completeBookingDeliveries(db *gorm.DB, hub *services.Hub, parcel models.Parcel) {
+	if parcel.BookingID == nil {
+		return
+	}
+
+	var booking models.Booking
+	if err := db.Preload("Ride").First(&booking, *parcel.BookingID).Error; err != nil {
+		return
+	}
+	ok, err := markBookingDelivered(db, &booking)
+	if errors.Is(err, errParcelsUndelivered) {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to mark booking %d delivered: %v", booking.ID, err)
+		return
+	}
+	if ok {
+		notifyBookingStatus(db, hub, booking, booking.Ride)
+	}
+}
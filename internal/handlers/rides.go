@@ -4,17 +4,17 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"strings"
 	"time"
 
 	"github.com/chachabrian/mooveit-backend/internal/models"
 	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 // CreateRide handles the creation of a new ride by a driver
-func CreateRide(db *gorm.DB) gin.HandlerFunc {
+func CreateRide(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userId := c.GetUint("userId")
 		userType := c.GetString("userType")
@@ -30,6 +30,13 @@ func CreateRide(db *gorm.DB) gin.HandlerFunc {
 			TruckSize       string    `json:"truckSize" binding:"required"`
 			Price           float64   `json:"price" binding:"required"`
 			Date            time.Time `json:"date" binding:"required"`
+			CapacityKg      *float64  `json:"capacityKg" binding:"omitempty,gt=0"`
+			CapacityM3      *float64  `json:"capacityM3" binding:"omitempty,gt=0"`
+			OriginLat       *float64  `json:"originLat" binding:"omitempty,min=-90,max=90"`
+			OriginLng       *float64  `json:"originLng" binding:"omitempty,min=-180,max=180"`
+			DestinationLat  *float64  `json:"destinationLat" binding:"omitempty,min=-90,max=90"`
+			DestinationLng  *float64  `json:"destinationLng" binding:"omitempty,min=-180,max=180"`
+			RoutePolyline   string    `json:"routePolyline" binding:"max=20000"`
 		}
 
 		if err := c.ShouldBindJSON(&input); err != nil {
@@ -37,12 +44,31 @@ func CreateRide(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		if (input.OriginLat == nil) != (input.OriginLng == nil) ||
+			(input.DestinationLat == nil) != (input.DestinationLng == nil) {
+			c.JSON(400, gin.H{"error": "Coordinates need both a latitude and a longitude"})
+			return
+		}
+
 		// Check if the scheduled time is in the future
 		if input.Date.Before(time.Now()) {
 			c.JSON(400, gin.H{"error": "Ride date must be in the future"})
 			return
 		}
 
+		if input.RoutePolyline != "" {
+			if _, err := utils.DecodePolyline(input.RoutePolyline); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid routePolyline"})
+				return
+			}
+		}
+
+		capacityKg, capacityM3 := rideCapacity(input.TruckSize, input.CapacityKg, input.CapacityM3)
+		if capacityM3 != nil && capacityKg == nil {
+			c.JSON(400, gin.H{"error": "capacityKg is required for this truck size"})
+			return
+		}
+
 		ride := models.Ride{
 			DriverID:        userId,
 			CurrentLocation: input.CurrentLocation,
@@ -50,7 +76,24 @@ func CreateRide(db *gorm.DB) gin.HandlerFunc {
 			TruckSize:       input.TruckSize,
 			Price:           input.Price,
 			Date:            input.Date,
-			Status:          "available",
+			Status:          models.RideAvailable,
+			CapacityKg:      capacityKg,
+			CapacityM3:      capacityM3,
+			RemainingKg:     capacityKg,
+			RemainingM3:     capacityM3,
+			OriginLat:       input.OriginLat,
+			OriginLng:       input.OriginLng,
+			DestinationLat:  input.DestinationLat,
+			DestinationLng:  input.DestinationLng,
+			RoutePolyline:   input.RoutePolyline,
+		}
+
+		// Coordinates are needed for matching; given ones only lack names
+		located := hasCoordinates(ride)
+		if !located {
+			ctx, cancel := context.WithTimeout(context.Background(), geocodeTimeout)
+			geocodeRide(ctx, &ride)
+			cancel()
 		}
 
 		if err := db.Create(&ride).Error; err != nil {
@@ -58,13 +101,29 @@ func CreateRide(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		if located {
+			go nameRidePlaces(db, ride)
+		}
+
+		// Tell the driver about open parcel requests along the route
+		go notifyRequestsForRide(db, hub, ride)
+
 		// Send push notification to clients who opted-in for available rides notifications
 		go func() {
 			ctx := context.Background()
+			// Topic subscribers can't be told apart, so this is in English
+			message, err := utils.RenderMessage("new_ride_available", utils.DefaultLanguage, map[string]interface{}{
+				"origin":      input.CurrentLocation,
+				"destination": input.Destination,
+				"price":       fmt.Sprintf("%.2f", input.Price),
+			})
+			if err != nil {
+				log.Printf("Failed to render new ride notification: %v", err)
+				return
+			}
 			payload := services.NotificationPayload{
-				Title: "New Ride Available! 🚛",
-				Body: fmt.Sprintf("From %s to %s - KES %.2f",
-					input.CurrentLocation, input.Destination, input.Price),
+				Title: message.Title,
+				Body:  message.Body,
 				Data: map[string]interface{}{
 					"type":            "new_ride_available",
 					"rideId":          fmt.Sprintf("%d", ride.ID),
@@ -87,67 +146,114 @@ func CreateRide(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-// GetAvailableRides retrieves all available rides with optional search
+// GetAvailableRides searches rides open for booking. Without a date range it
+// returns rides in the next 24 hours. Results are paged with an opaque cursor.
 func GetAvailableRides(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		destination := c.Query("destination")
-		currentLocation := c.Query("currentLocation")
+		now := time.Now()
+		from, to := now, now.Add(24*time.Hour)
+		if value := c.Query("from"); value != "" {
+			parsed, err := parseSearchTime(value)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Invalid from date, use YYYY-MM-DD or RFC 3339"})
+				return
+			}
+			from, to = parsed, parsed.Add(24*time.Hour)
+		}
+		if value := c.Query("to"); value != "" {
+			parsed, err := parseSearchTime(value)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Invalid to date, use YYYY-MM-DD or RFC 3339"})
+				return
+			}
+			if len(value) == len("2006-01-02") {
+				parsed = parsed.AddDate(0, 0, 1) // include the whole day
+			}
+			to = parsed
+		}
+		if from.Before(now) {
+			from = now
+		}
+		if !from.Before(to) {
+			c.JSON(400, gin.H{"error": "from must be before to"})
+			return
+		}
+		if to.Sub(from) > maxRideSearchRange {
+			c.JSON(400, gin.H{"error": "Date range cannot exceed 90 days"})
+			return
+		}
+
+		sort, ok := rideSorts[c.DefaultQuery("sort", "date")]
+		if !ok {
+			c.JSON(400, gin.H{"error": "sort must be one of date, -date, price, -price"})
+			return
+		}
 
-		var rides []models.Ride
 		query := db.Preload("Driver").
-			Where("rides.date > ? AND rides.date <= ? AND rides.status = ?",
-				time.Now(),
-				time.Now().Add(24*time.Hour),
-				"available")
+			Where("rides.date > ? AND rides.date <= ? AND rides.status = ?", from, to, models.RideAvailable).
+			Where("rides.remaining_kg IS NULL OR rides.remaining_kg > 0")
 
-		if destination != "" {
-			query = query.Where("LOWER(rides.destination) LIKE LOWER(?)", "%"+strings.ToLower(destination)+"%")
-		}
-		if currentLocation != "" {
-			query = query.Where("LOWER(rides.current_location) LIKE LOWER(?)", "%"+strings.ToLower(currentLocation)+"%")
+		query, err := searchRides(c, query)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
 		}
 
-		if err := query.Find(&rides).Error; err != nil {
+		rides, nextCursor, err := paginateRides(query, sort, c.Query("cursor"), ridePageSize(c))
+		if err == errInvalidCursor {
+			c.JSON(400, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		if err != nil {
 			c.JSON(500, gin.H{"error": "Failed to fetch rides"})
 			return
 		}
 
-		c.JSON(200, rides)
+		respondRides(c, rides, nextCursor)
 	}
 }
 
-// GetDriverRides retrieves all rides created by a specific driver
+// GetDriverRides retrieves the rides created by the driver, newest first,
+// in pages when the client asks for them
 func GetDriverRides(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userId := c.GetUint("userId")
 
-		var rides []models.Ride
-		if err := db.Where("driver_id = ?", userId).
-			Order("date DESC").
-			Find(&rides).Error; err != nil {
+		rides, nextCursor, err := paginateRides(db.Where("driver_id = ?", userId),
+			rideSorts["-date"], c.Query("cursor"), optionalPageSize(c))
+		if err == errInvalidCursor {
+			c.JSON(400, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		if err != nil {
 			c.JSON(500, gin.H{"error": "Failed to fetch driver rides"})
 			return
 		}
 
-		c.JSON(200, rides)
+		respondRides(c, rides, nextCursor)
 	}
 }
 
-// GetAllRides retrieves all rides in the system
+// GetAllRides retrieves all rides in the next 24 hours, in pages when the
+// client asks for them
 func GetAllRides(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var rides []models.Ride
-		if err := db.Preload("Driver").
+		query := db.Preload("Driver").
 			Where("date > ? AND date <= ?",
 				time.Now(),
-				time.Now().Add(24*time.Hour)).
-			Order("date ASC").
-			Find(&rides).Error; err != nil {
+				time.Now().Add(24*time.Hour))
+
+		rides, nextCursor, err := paginateRides(query, rideSorts["date"], c.Query("cursor"), optionalPageSize(c))
+		if err == errInvalidCursor {
+			c.JSON(400, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		if err != nil {
 			c.JSON(500, gin.H{"error": "Failed to fetch rides"})
 			return
 		}
 
-		c.JSON(200, rides)
+		respondRides(c, rides, nextCursor)
 	}
 }
 
@@ -0,0 +1,416 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// defaultCorridorKm is how far off a ride's route a parcel's ends may be
+	defaultCorridorKm = 5.0
+	maxCorridorKm     = 30.0
+	// maxRideMatches caps the rides returned for one request
+	maxRideMatches = 20
+)
+
+// RideMatch is a posted ride that can carry a parcel request on its way
+type RideMatch struct {
+	Ride            models.Ride `json:"ride"`
+	PickupOffsetKm  float64     `json:"pickupOffsetKm"`
+	DropoffOffsetKm float64     `json:"dropoffOffsetKm"`
+	DetourKm        float64     `json:"detourKm"` // extra driving to leave the route and come back, both ends
+}
+
+// rideRoute returns the route a ride follows: its planned polyline when the
+// driver shared one, otherwise the straight line between its ends
+func rideRoute(ride models.Ride) []utils.Point {
+	if ride.RoutePolyline != "" {
+		if route, err := utils.DecodePolyline(ride.RoutePolyline); err == nil && len(route) > 1 {
+			return route
+		}
+	}
+	if ride.OriginLat == nil || ride.DestinationLat == nil {
+		return nil
+	}
+	return []utils.Point{
+		{Lat: *ride.OriginLat, Lng: *ride.OriginLng},
+		{Lat: *ride.DestinationLat, Lng: *ride.DestinationLng},
+	}
+}
+
+// matchRide checks that both ends of a request lie within the corridor of a
+// ride's route, pickup before drop-off
+func matchRide(ride models.Ride, request models.ParcelRequest) (RideMatch, bool) {
+	route := rideRoute(ride)
+	if route == nil {
+		return RideMatch{}, false
+	}
+
+	pickup := utils.LocateOnRoute(route, utils.Point{Lat: request.OriginLat, Lng: request.OriginLng})
+	dropoff := utils.LocateOnRoute(route, utils.Point{Lat: request.DestinationLat, Lng: request.DestinationLng})
+	if pickup.OffsetKm > request.CorridorKm || dropoff.OffsetKm > request.CorridorKm {
+		return RideMatch{}, false
+	}
+	if pickup.AlongKm >= dropoff.AlongKm {
+		return RideMatch{}, false
+	}
+
+	return RideMatch{
+		Ride:            ride,
+		PickupOffsetKm:  pickup.OffsetKm,
+		DropoffOffsetKm: dropoff.OffsetKm,
+		DetourKm:        2 * (pickup.OffsetKm + dropoff.OffsetKm),
+	}, true
+}
+
+// findRideMatches returns the rides that can carry a request within its time
+// window and price, least detour first, then cheapest
+func findRideMatches(db *gorm.DB, request models.ParcelRequest) ([]RideMatch, error) {
+	query := db.Preload("Driver").
+		Where("status = ? AND date BETWEEN ? AND ?", models.RideAvailable, request.EarliestDate, request.LatestDate).
+		Where("date > ?", time.Now()).
+		Where("origin_lat IS NOT NULL AND destination_lat IS NOT NULL").
+		Where("remaining_kg IS NULL OR remaining_kg >= ?", request.WeightKg)
+	if request.MaxPrice != nil {
+		query = query.Where("price <= ?", *request.MaxPrice)
+	}
+
+	var rides []models.Ride
+	if err := query.Limit(500).Find(&rides).Error; err != nil {
+		return nil, err
+	}
+
+	matches := make([]RideMatch, 0)
+	for _, ride := range rides {
+		if match, ok := matchRide(ride, request); ok {
+			matches = append(matches, match)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].DetourKm != matches[j].DetourKm {
+			return matches[i].DetourKm < matches[j].DetourKm
+		}
+		return matches[i].Ride.Price < matches[j].Ride.Price
+	})
+	if len(matches) > maxRideMatches {
+		matches = matches[:maxRideMatches]
+	}
+	return matches, nil
+}
+
+// notifyMatchedDriver tells a ride's driver about a compatible parcel request
+// unless they already heard about it
+func notifyMatchedDriver(db *gorm.DB, hub *services.Hub, request models.ParcelRequest, match RideMatch) {
+	record := models.ParcelRequestMatch{
+		ParcelRequestID: request.ID,
+		RideID:          match.Ride.ID,
+		DriverID:        match.Ride.DriverID,
+		DetourKm:        match.DetourKm,
+	}
+	result := db.Where("parcel_request_id = ? AND ride_id = ?", request.ID, match.Ride.ID).FirstOrCreate(&record)
+	if result.Error != nil {
+		log.Printf("Failed to record match of request %d and ride %d: %v", request.ID, match.Ride.ID, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+
+	data := gin.H{
+		"parcelRequestId": request.ID,
+		"rideId":          match.Ride.ID,
+		"origin":          request.Origin,
+		"destination":     request.Destination,
+		"weightKg":        request.WeightKg,
+		"detourKm":        match.DetourKm,
+		"earliestDate":    request.EarliestDate,
+		"latestDate":      request.LatestDate,
+	}
+	if message, err := json.Marshal(services.WebSocketMessage{Type: "parcel_request", Data: data}); err == nil {
+		hub.BroadcastToUser(match.Ride.DriverID, message)
+	}
+
+	notifyUser(db, Notification{
+		Event:  eventParcelRequest,
+		UserID: match.Ride.DriverID,
+		Data: map[string]interface{}{
+			"parcelRequestId": fmt.Sprintf("%d", request.ID),
+			"rideId":          fmt.Sprintf("%d", match.Ride.ID),
+			"origin":          request.Origin,
+			"destination":     request.Destination,
+			"weightKg":        fmt.Sprintf("%.0f", request.WeightKg),
+			"detourKm":        fmt.Sprintf("%.0f", match.DetourKm),
+		},
+	})
+}
+
+// notifyRequestsForRide tells the driver of a new ride about open parcel
+// requests along its route
+func notifyRequestsForRide(db *gorm.DB, hub *services.Hub, ride models.Ride) {
+	if rideRoute(ride) == nil {
+		return
+	}
+	if ride.Driver == nil {
+		var driver models.User
+		if err := db.First(&driver, ride.DriverID).Error; err == nil {
+			ride.Driver = &driver
+		}
+	}
+
+	var requests []models.ParcelRequest
+	if err := db.Where("status = ? AND earliest_date <= ? AND latest_date >= ?", models.ParcelRequestOpen, ride.Date, ride.Date).
+		Find(&requests).Error; err != nil {
+		log.Printf("Failed to load parcel requests for ride %d: %v", ride.ID, err)
+		return
+	}
+
+	for _, request := range requests {
+		if request.MaxPrice != nil && ride.Price > *request.MaxPrice {
+			continue
+		}
+		if ride.RemainingKg != nil && *ride.RemainingKg < request.WeightKg {
+			continue
+		}
+		if match, ok := matchRide(ride, request); ok {
+			notifyMatchedDriver(db, hub, request, match)
+		}
+	}
+}
+
+// markParcelRequestsBooked closes the client's open requests that were
+// matched to the ride of their accepted booking, so drivers stop being told
+// about them
+func markParcelRequestsBooked(tx *gorm.DB, booking models.Booking) error {
+	matched := tx.Session(&gorm.Session{NewDB: true}).
+		Model(&models.ParcelRequestMatch{}).
+		Select("parcel_request_id").
+		Where("ride_id = ?", booking.RideID)
+	return tx.Model(&models.ParcelRequest{}).
+		Where("client_id = ? AND status = ? AND id IN (?)", booking.ClientID, models.ParcelRequestOpen, matched).
+		Update("status", models.ParcelRequestBooked).Error
+}
+
+// CreateParcelRequest posts a parcel that needs moving between two places.
+// Rides already heading that way are returned and their drivers notified.
+func CreateParcelRequest(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+		userType := c.GetString("userType")
+
+		if userType != string(models.UserTypeClient) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only clients can request parcel delivery"})
+			return
+		}
+
+		var input struct {
+			Origin         string    `json:"origin" binding:"required"`
+			Destination    string    `json:"destination" binding:"required"`
+			OriginLat      *float64  `json:"originLat" binding:"omitempty,min=-90,max=90"`
+			OriginLng      *float64  `json:"originLng" binding:"omitempty,min=-180,max=180"`
+			DestinationLat *float64  `json:"destinationLat" binding:"omitempty,min=-90,max=90"`
+			DestinationLng *float64  `json:"destinationLng" binding:"omitempty,min=-180,max=180"`
+			EarliestDate   time.Time `json:"earliestDate" binding:"required"`
+			LatestDate     time.Time `json:"latestDate" binding:"required"`
+			WeightKg       float64   `json:"weightKg" binding:"required,gt=0"`
+			Description    string    `json:"description" binding:"max=500"`
+			MaxPrice       *float64  `json:"maxPrice" binding:"omitempty,gt=0"`
+			CorridorKm     float64   `json:"corridorKm" binding:"omitempty,gt=0"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !input.EarliestDate.Before(input.LatestDate) || input.LatestDate.Before(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "latestDate must be in the future and after earliestDate"})
+			return
+		}
+		if input.LatestDate.Sub(input.EarliestDate) > maxRideSearchRange {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Date range cannot exceed 90 days"})
+			return
+		}
+		if input.CorridorKm == 0 {
+			input.CorridorKm = defaultCorridorKm
+		}
+		if input.CorridorKm > maxCorridorKm {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("corridorKm cannot exceed %.0f", maxCorridorKm)})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), geocodeTimeout)
+		defer cancel()
+		origin, err := resolvePoint(ctx, input.Origin, input.OriginLat, input.OriginLng)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Could not locate origin, send originLat and originLng"})
+			return
+		}
+		destination, err := resolvePoint(ctx, input.Destination, input.DestinationLat, input.DestinationLng)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Could not locate destination, send destinationLat and destinationLng"})
+			return
+		}
+
+		request := models.ParcelRequest{
+			ClientID:       userID,
+			Origin:         input.Origin,
+			Destination:    input.Destination,
+			OriginLat:      origin.Lat,
+			OriginLng:      origin.Lng,
+			DestinationLat: destination.Lat,
+			DestinationLng: destination.Lng,
+			EarliestDate:   input.EarliestDate,
+			LatestDate:     input.LatestDate,
+			WeightKg:       input.WeightKg,
+			Description:    input.Description,
+			MaxPrice:       input.MaxPrice,
+			CorridorKm:     input.CorridorKm,
+			Status:         models.ParcelRequestOpen,
+		}
+		if err := db.Create(&request).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create parcel request"})
+			return
+		}
+
+		matches, err := findRideMatches(db, request)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to match rides"})
+			return
+		}
+
+		go func() {
+			for _, match := range matches {
+				notifyMatchedDriver(db, hub, request, match)
+			}
+		}()
+
+		c.JSON(http.StatusCreated, gin.H{"request": request, "matches": matches})
+	}
+}
+
+// resolvePoint uses the given coordinates, or geocodes the place name
+func resolvePoint(ctx context.Context, name string, lat, lng *float64) (utils.Point, error) {
+	if lat != nil && lng != nil {
+		return utils.Point{Lat: *lat, Lng: *lng}, nil
+	}
+	place, err := services.GeocodePlace(ctx, name)
+	if err != nil {
+		return utils.Point{}, err
+	}
+	return utils.Point{Lat: place.Lat, Lng: place.Lng}, nil
+}
+
+// GetParcelRequests lists the client's parcel requests
+func GetParcelRequests(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+
+		var requests []models.ParcelRequest
+		if err := db.Where("client_id = ?", userID).
+			Order("created_at DESC").
+			Limit(100).
+			Find(&requests).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch parcel requests"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"requests": requests})
+	}
+}
+
+// GetParcelRequestMatches returns the rides that currently match a request
+func GetParcelRequestMatches(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+
+		var request models.ParcelRequest
+		if err := db.First(&request, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Parcel request not found"})
+			return
+		}
+
+		if request.ClientID != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		if request.Status != models.ParcelRequestOpen {
+			c.JSON(http.StatusOK, gin.H{"request": request, "matches": []RideMatch{}})
+			return
+		}
+
+		matches, err := findRideMatches(db, request)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to match rides"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"request": request, "matches": matches})
+	}
+}
+
+// CancelParcelRequest stops a request from being matched
+func CancelParcelRequest(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+
+		result := db.Model(&models.ParcelRequest{}).
+			Where("id = ? AND client_id = ? AND status = ?", c.Param("id"), userID, models.ParcelRequestOpen).
+			Update("status", models.ParcelRequestCancelled)
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel parcel request"})
+			return
+		}
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Open parcel request not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Parcel request cancelled"})
+	}
+}
+
+// GetDriverParcelRequests lists the open parcel requests matched to the
+// driver's upcoming rides
+func GetDriverParcelRequests(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userId")
+		userType := c.GetString("userType")
+
+		if userType != string(models.UserTypeDriver) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can view parcel requests"})
+			return
+		}
+
+		var results []struct {
+			models.ParcelRequest
+			RideID   uint    `json:"rideId"`
+			DetourKm float64 `json:"detourKm"`
+		}
+		if err := db.Table("parcel_request_matches").
+			Select("parcel_requests.*, parcel_request_matches.ride_id, parcel_request_matches.detour_km").
+			Joins("JOIN parcel_requests ON parcel_requests.id = parcel_request_matches.parcel_request_id").
+			Joins("JOIN rides ON rides.id = parcel_request_matches.ride_id").
+			Where("parcel_request_matches.driver_id = ? AND parcel_requests.status = ? AND parcel_requests.deleted_at IS NULL", userID, models.ParcelRequestOpen).
+			Where("parcel_requests.latest_date >= ?", time.Now()).
+			Where("rides.date > ? AND rides.deleted_at IS NULL", time.Now()).
+			Order("parcel_request_matches.detour_km ASC").
+			Scan(&results).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch parcel requests"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"requests": results})
+	}
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"strconv"
 
 	"github.com/chachabrian/mooveit-backend/internal/models"
@@ -11,6 +12,14 @@ import (
 	"gorm.io/gorm"
 )
 
+// tripCompletionInput holds the final figures a driver reports for a trip
+type tripCompletionInput struct {
+	ActualFare     float64 `json:"actualFare" binding:"required"`
+	ActualDistance float64 `json:"actualDistance" binding:"required"`
+	ActualDuration int     `json:"actualDuration" binding:"required"`
+	DriverNotes    string  `json:"driverNotes,omitempty"`
+}
+
 // CompleteTrip handles trip completion by driver
 func CompleteTrip(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -29,61 +38,65 @@ func CompleteTrip(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 			return
 		}
 
-		var input struct {
-			ActualFare     float64 `json:"actualFare" binding:"required"`
-			ActualDistance float64 `json:"actualDistance" binding:"required"`
-			ActualDuration int     `json:"actualDuration" binding:"required"`
-			DriverNotes    string  `json:"driverNotes,omitempty"`
-		}
-
+		var input tripCompletionInput
 		if err := c.ShouldBindJSON(&input); err != nil {
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
 
+		response, err := completeTrip(db, hub)(driverID, userType, uint(rideID), input)
+		if err != nil {
+			respondActionError(c, err)
+			return
+		}
+
+		c.JSON(200, response)
+	}
+}
+
+// completeTrip records the completion of a started ride and frees the driver
+func completeTrip(db *gorm.DB, hub *services.Hub) func(driverID uint, userType string, rideID uint, input tripCompletionInput) (gin.H, error) {
+	return func(driverID uint, userType string, rideID uint, input tripCompletionInput) (gin.H, error) {
+		if userType != string(models.UserTypeDriver) {
+			return nil, newActionError(403, "Only drivers can complete trips")
+		}
+
 		// Validate input
 		if input.ActualFare < 0 {
-			c.JSON(400, gin.H{"error": "Actual fare must be non-negative"})
-			return
+			return nil, newActionError(400, "Actual fare must be non-negative")
 		}
 		if input.ActualDistance < 0 {
-			c.JSON(400, gin.H{"error": "Actual distance must be non-negative"})
-			return
+			return nil, newActionError(400, "Actual distance must be non-negative")
 		}
 		if input.ActualDuration < 0 {
-			c.JSON(400, gin.H{"error": "Actual duration must be non-negative"})
-			return
+			return nil, newActionError(400, "Actual duration must be non-negative")
 		}
 
 		// Get ride request
 		var rideRequest models.RideRequest
 		if err := db.Preload("Client").First(&rideRequest, rideID).Error; err != nil {
-			c.JSON(404, gin.H{"error": "Ride not found"})
-			return
+			return nil, newActionError(404, "Ride not found")
 		}
 
 		// Check if driver is assigned to this ride
 		if rideRequest.DriverID == nil || *rideRequest.DriverID != driverID {
-			c.JSON(403, gin.H{"error": "Unauthorized to complete this ride"})
-			return
+			return nil, newActionError(403, "Unauthorized to complete this ride")
 		}
 
 		// Check if ride is in correct status
 		if rideRequest.Status != models.RideStatusStarted {
-			c.JSON(400, gin.H{"error": "Ride must be started before completion"})
-			return
+			return nil, newActionError(400, "Ride must be started before completion")
 		}
 
 		// Check if trip completion already exists
 		var existingCompletion models.TripCompletion
 		if err := db.Where("ride_id = ?", rideID).First(&existingCompletion).Error; err == nil {
-			c.JSON(400, gin.H{"error": "Trip already completed"})
-			return
+			return nil, newActionError(400, "Trip already completed")
 		}
 
 		// Create trip completion record
 		tripCompletion := models.TripCompletion{
-			RideID:         uint(rideID),
+			RideID:         rideID,
 			DriverID:       driverID,
 			ClientID:       rideRequest.ClientID,
 			ActualFare:     input.ActualFare,
@@ -103,16 +116,14 @@ func CompleteTrip(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		// Create trip completion
 		if err := tx.Create(&tripCompletion).Error; err != nil {
 			tx.Rollback()
-			c.JSON(500, gin.H{"error": "Failed to create trip completion"})
-			return
+			return nil, newActionError(500, "Failed to create trip completion")
 		}
 
 		// Update ride status to completed
 		rideRequest.Status = models.RideStatusCompleted
 		if err := tx.Save(&rideRequest).Error; err != nil {
 			tx.Rollback()
-			c.JSON(500, gin.H{"error": "Failed to update ride status"})
-			return
+			return nil, newActionError(500, "Failed to update ride status")
 		}
 
 		// Make driver available again
@@ -121,37 +132,34 @@ func CompleteTrip(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 			driverLocation.IsAvailable = true
 			if err := tx.Save(&driverLocation).Error; err != nil {
 				tx.Rollback()
-				c.JSON(500, gin.H{"error": "Failed to update driver availability"})
-				return
+				return nil, newActionError(500, "Failed to update driver availability")
 			}
 		}
 
 		// Commit transaction
 		if err := tx.Commit().Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to complete transaction"})
-			return
+			return nil, newActionError(500, "Failed to complete transaction")
 		}
 
 		// Update Redis
 		ctx := context.Background()
 		services.SetDriverAvailability(ctx, driverID, true)
+		services.ClearDriverActiveClient(ctx, driverID)
 
 		// Get client and driver information for notifications
 		var client models.User
 		if err := db.Where("id = ?", rideRequest.ClientID).First(&client).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to get client information"})
-			return
+			return nil, newActionError(500, "Failed to get client information")
 		}
 
 		var driver models.User
 		if err := db.Where("id = ?", driverID).First(&driver).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to get driver information"})
-			return
+			return nil, newActionError(500, "Failed to get driver information")
 		}
 
 		// Notify client that ride has completed
 		completed := services.RideCompleted{
-			RideID:         uint(rideID),
+			RideID:         rideID,
 			DriverID:       driverID,
 			ActualFare:     input.ActualFare,
 			ActualDistance: input.ActualDistance,
@@ -159,22 +167,21 @@ func CompleteTrip(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		}
 		hub.SendRideCompleted(rideRequest.ClientID, completed)
 
-		// Send FCM push notification to client
-		ctx = context.Background()
-		if client.FCMToken != "" {
-			go services.SendRideCompletedNotification(
-				ctx,
-				client.FCMToken,
-				uint(rideID),
-				input.ActualFare,
-			)
-		}
+		notifyUser(db, Notification{
+			Event:  eventRideCompleted,
+			UserID: rideRequest.ClientID,
+			Data: map[string]interface{}{
+				"rideId":         rideID,
+				"fare":           fmt.Sprintf("%.2f", input.ActualFare),
+				"notificationId": fmt.Sprintf("ride_completed_%d", rideID),
+			},
+		})
 
 		// Also send a general status update notification
 		statusUpdate := services.WebSocketMessage{
 			Type: "ride_completed",
 			Data: gin.H{
-				"rideId":         uint(rideID),
+				"rideId":         rideID,
 				"driverId":       driverID,
 				"driverName":     driver.Username,
 				"status":         rideRequest.Status,
@@ -193,7 +200,7 @@ func CompleteTrip(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		driverNotification := services.WebSocketMessage{
 			Type: "ride_completed",
 			Data: gin.H{
-				"rideId":         uint(rideID),
+				"rideId":         rideID,
 				"clientId":       rideRequest.ClientID,
 				"clientName":     client.Username,
 				"status":         rideRequest.Status,
@@ -207,12 +214,12 @@ func CompleteTrip(db *gorm.DB, hub *services.Hub) gin.HandlerFunc {
 		driverData, _ := json.Marshal(driverNotification)
 		hub.BroadcastToUser(driverID, driverData)
 
-		c.JSON(200, gin.H{
+		return gin.H{
 			"message":    "Trip completed successfully",
 			"rideId":     rideID,
 			"status":     rideRequest.Status,
 			"completion": tripCompletion,
-		})
+		}, nil
 	}
 }
 
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"github.com/chachabrian/mooveit-backend/internal/models"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
@@ -18,14 +19,15 @@ func GetProfile(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		c.JSON(200, gin.H{
-			"id":          user.ID,
-			"email":       user.Email,
-			"username":    user.Username,
-			"phoneNumber": user.PhoneNumber,
-			"userType":    user.UserType,
-			"carPlate":    user.CarPlate,
-			"carMake":     user.CarMake,
-			"carColor":    user.CarColor,
+			"id":                user.ID,
+			"email":             user.Email,
+			"username":          user.Username,
+			"phoneNumber":       user.PhoneNumber,
+			"userType":          user.UserType,
+			"carPlate":          user.CarPlate,
+			"carMake":           user.CarMake,
+			"carColor":          user.CarColor,
+			"preferredLanguage": user.PreferredLanguage,
 		})
 	}
 }
@@ -36,11 +38,12 @@ func UpdateProfile(db *gorm.DB) gin.HandlerFunc {
 		userId := c.GetUint("userId")
 
 		var input struct {
-			Username    *string `json:"username"`
-			PhoneNumber *string `json:"phoneNumber"`
-			CarPlate    *string `json:"carPlate"`
-			CarMake     *string `json:"carMake"`
-			CarColor    *string `json:"carColor"`
+			Username          *string `json:"username"`
+			PhoneNumber       *string `json:"phoneNumber"`
+			CarPlate          *string `json:"carPlate"`
+			CarMake           *string `json:"carMake"`
+			CarColor          *string `json:"carColor"`
+			PreferredLanguage *string `json:"preferredLanguage"`
 		}
 
 		if err := c.ShouldBindJSON(&input); err != nil {
@@ -48,6 +51,11 @@ func UpdateProfile(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		if input.PreferredLanguage != nil && !utils.SupportedLanguage(*input.PreferredLanguage) {
+			c.JSON(400, gin.H{"error": "Unsupported language"})
+			return
+		}
+
 		var user models.User
 		if err := db.First(&user, userId).Error; err != nil {
 			c.JSON(404, gin.H{"error": "User not found"})
@@ -70,6 +78,9 @@ func UpdateProfile(db *gorm.DB) gin.HandlerFunc {
 		if input.CarColor != nil {
 			user.CarColor = *input.CarColor
 		}
+		if input.PreferredLanguage != nil {
+			user.PreferredLanguage = *input.PreferredLanguage
+		}
 
 		// Use Save() instead of Updates() to persist all fields including empty strings
 		if err := db.Save(&user).Error; err != nil {
@@ -84,14 +95,15 @@ func UpdateProfile(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		c.JSON(200, gin.H{
-			"id":          user.ID,
-			"email":       user.Email,
-			"username":    user.Username,
-			"phoneNumber": user.PhoneNumber,
-			"userType":    user.UserType,
-			"carPlate":    user.CarPlate,
-			"carMake":     user.CarMake,
-			"carColor":    user.CarColor,
+			"id":                user.ID,
+			"email":             user.Email,
+			"username":          user.Username,
+			"phoneNumber":       user.PhoneNumber,
+			"userType":          user.UserType,
+			"carPlate":          user.CarPlate,
+			"carMake":           user.CarMake,
+			"carColor":          user.CarColor,
+			"preferredLanguage": user.PreferredLanguage,
 		})
 	}
 }
@@ -1,6 +1,9 @@
 package handlers
 
 import (
+	"context"
+	"strconv"
+
 	"github.com/chachabrian/mooveit-backend/internal/services"
 	"github.com/gin-gonic/gin"
 )
@@ -11,7 +14,41 @@ func WebSocketHandler(hub *services.Hub) gin.HandlerFunc {
 		userID := c.GetUint("userId")
 		userType := c.GetString("userType")
 
+		// Clients resume from the last event they saw; without it the
+		// server falls back to the last acknowledged event
+		var lastSeq *uint64
+		if lastSeqStr := c.Query("lastSeq"); lastSeqStr != "" {
+			seq, err := strconv.ParseUint(lastSeqStr, 10, 64)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Invalid lastSeq"})
+				return
+			}
+			lastSeq = &seq
+		}
+
 		// Convert Gin's ResponseWriter to http.ResponseWriter
-		services.HandleWebSocket(hub, c.Writer, c.Request, userID, userType)
+		services.HandleWebSocket(hub, c.Writer, c.Request, userID, userType, lastSeq)
+	}
+}
+
+// WebSocketStats reports connection metrics for this instance and cluster-wide presence
+func WebSocketStats(hub *services.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		cluster := gin.H{}
+		for _, userType := range []string{"client", "driver"} {
+			userIDs, err := services.GetConnectedUserIDs(ctx, userType)
+			if err != nil {
+				c.JSON(500, gin.H{"error": "Failed to fetch connected users"})
+				return
+			}
+			cluster[userType+"s"] = len(userIDs)
+		}
+
+		c.JSON(200, gin.H{
+			"instance": hub.Stats(),
+			"cluster":  cluster,
+		})
 	}
 }
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminMiddleware only lets requests carrying the ADMIN_API_KEY in the
+// X-Admin-Key header through. Admin routes are disabled when no key is set.
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		adminKey := os.Getenv("ADMIN_API_KEY")
+		if adminKey == "" {
+			c.JSON(503, gin.H{"error": "Admin access is not configured"})
+			c.Abort()
+			return
+		}
+
+		key := c.GetHeader("X-Admin-Key")
+		if subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) != 1 {
+			c.JSON(401, gin.H{"error": "Invalid admin key"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimitMiddleware allows each client IP at most limit requests per window
+// for routes sharing the same name. Counters live in Redis so the limit holds
+// across instances; if Redis is unavailable requests are let through.
+func RateLimitMiddleware(name string, limit int, window time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := time.Now().Unix() / int64(window.Seconds())
+		key := fmt.Sprintf("ratelimit:%s:%s:%d", name, c.ClientIP(), bucket)
+
+		ctx := context.Background()
+		pipe := services.RedisClient.TxPipeline()
+		count := pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, window)
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("Rate limiter unavailable: %v", err)
+			c.Next()
+			return
+		}
+
+		remaining := limit - int(count.Val())
+		if remaining < 0 {
+			remaining = 0
+		}
+		c.Header("X-RateLimit-Limit", strconv.Itoa(limit))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+
+		if count.Val() > int64(limit) {
+			retryAfter := int64(window.Seconds()) - time.Now().Unix()%int64(window.Seconds())
+			c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+			c.JSON(429, gin.H{"error": "Too many requests, please try again later"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+    "time"
+
     "gorm.io/gorm"
 )
 
@@ -11,13 +13,25 @@ const (
     BookingStatusAccepted BookingStatus = "accepted"
     BookingStatusRejected BookingStatus = "rejected"
      BookingStatusCancelled BookingStatus = "cancelled"
+    BookingStatusExpired    BookingStatus = "expired"     // the driver never answered
+    BookingStatusInProgress BookingStatus = "in_progress" // the ride left with the parcels
+    BookingStatusDelivered  BookingStatus = "delivered"
+    BookingStatusCompleted  BookingStatus = "completed"
 )
 
 type Booking struct {
     gorm.Model
-    ClientID    uint          `json:"clientId" gorm:"not null"`
-    Client      User          `json:"client"`
-    RideID      uint          `json:"rideId" gorm:"not null"`
-    Ride        Ride          `json:"ride" gorm:"foreignKey:RideID"`
-    Status      BookingStatus `json:"status" gorm:"not null;default:'pending'"`
+    ClientID         uint          `json:"clientId" gorm:"not null;uniqueIndex:idx_booking_idempotency"`
+    Client           User          `json:"client"`
+    RideID           uint          `json:"rideId" gorm:"not null"`
+    Ride             Ride          `json:"ride" gorm:"foreignKey:RideID"`
+    Status           BookingStatus `json:"status" gorm:"not null;default:'pending'"`
+    ReservedKg       float64       `json:"reservedKg" gorm:"not null;default:0"` // ride capacity held for this booking
+    ReservedM3       float64       `json:"reservedM3" gorm:"not null;default:0"`
+    InsurancePremium float64       `json:"insurancePremium" gorm:"not null;default:0"`
+    TotalPrice       float64       `json:"totalPrice" gorm:"not null;default:0"` // ride price plus insurance
+    DeliveredAt      *time.Time    `json:"deliveredAt,omitempty"`
+    CompletedAt      *time.Time    `json:"completedAt,omitempty"`
+    IdempotencyKey   *string       `json:"-" gorm:"uniqueIndex:idx_booking_idempotency"` // client supplied, makes retries safe
+    Parcels          []Parcel      `json:"parcels,omitempty" gorm:"foreignKey:BookingID"`
 }
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// DeviceToken is the Firebase Cloud Messaging token of one of a user's
+// devices. Push notifications go to every device the user is signed in on.
+type DeviceToken struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	UserID     uint      `json:"userId" gorm:"not null;index"`
+	Token      string    `json:"-" gorm:"not null;uniqueIndex"`
+	Platform   string    `json:"platform"` // android, ios or web
+	AppVersion string    `json:"appVersion"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DriverSession is a continuous period a driver was online, from going
+// available until going offline or being taken offline
+type DriverSession struct {
+	gorm.Model
+	DriverID   uint       `json:"driverId" gorm:"not null;index"`
+	StartedAt  time.Time  `json:"startedAt" gorm:"not null;index"`
+	EndedAt    *time.Time `json:"endedAt,omitempty"`
+	EndReason  string     `json:"endReason,omitempty"` // offline, timeout, fatigue
+	DistanceKm float64    `json:"distanceKm" gorm:"not null;default:0"`
+	Driver     *User      `json:"driver,omitempty" gorm:"foreignKey:DriverID"`
+}
+
+// TableName specifies the table name
+func (DriverSession) TableName() string {
+	return "driver_sessions"
+}
+
+// SessionEndReason constants
+const (
+	SessionEndOffline = "offline" // driver went offline
+	SessionEndTimeout = "timeout" // app stopped reporting its location
+	SessionEndFatigue = "fatigue" // online limit reached, break enforced
+)
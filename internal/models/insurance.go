@@ -0,0 +1,112 @@
+package models
+
+import (
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// InsuranceTier is a level of cover a client can buy for a parcel. The
+// premium is a percentage of the parcel's declared value.
+type InsuranceTier struct {
+	Name            string  `json:"name"`
+	RatePercent     float64 `json:"ratePercent"`     // premium as a share of the declared value
+	CoveragePercent float64 `json:"coveragePercent"` // share of the declared value paid out on a claim
+}
+
+// InsuranceTier names
+const (
+	InsuranceNone     = "none"
+	InsuranceBasic    = "basic"
+	InsuranceStandard = "standard"
+	InsurancePremium  = "premium"
+)
+
+// InsuranceTiers lists the cover on offer
+var InsuranceTiers = []InsuranceTier{
+	{Name: InsuranceBasic, RatePercent: 1, CoveragePercent: 50},
+	{Name: InsuranceStandard, RatePercent: 2, CoveragePercent: 80},
+	{Name: InsurancePremium, RatePercent: 3.5, CoveragePercent: 100},
+}
+
+// FindInsuranceTier returns the tier with the given name
+func FindInsuranceTier(name string) (InsuranceTier, bool) {
+	for _, tier := range InsuranceTiers {
+		if tier.Name == name {
+			return tier, true
+		}
+	}
+	return InsuranceTier{}, false
+}
+
+// Quote returns the premium and maximum payout for insuring a declared value,
+// rounded to the cent
+func (t InsuranceTier) Quote(declaredValue float64) (premium, coverage float64) {
+	premium = math.Round(declaredValue*t.RatePercent) / 100
+	coverage = math.Round(declaredValue*t.CoveragePercent) / 100
+	return premium, coverage
+}
+
+// Claim is a client's request for compensation for a damaged or lost parcel
+type Claim struct {
+	gorm.Model
+	BookingID      uint         `json:"bookingId" gorm:"not null;index"`
+	ParcelID       uint         `json:"parcelId" gorm:"not null;index"`
+	ClientID       uint         `json:"clientId" gorm:"not null;index"`
+	Type           string       `json:"type" gorm:"not null"` // damage or loss
+	Description    string       `json:"description" gorm:"not null"`
+	AmountClaimed  float64      `json:"amountClaimed" gorm:"not null"`
+	AmountApproved float64      `json:"amountApproved" gorm:"not null;default:0"`
+	Status         string       `json:"status" gorm:"not null;default:'submitted';index"`
+	ResolutionNote string       `json:"resolutionNote,omitempty"`
+	ResolvedAt     *time.Time   `json:"resolvedAt,omitempty"`
+	Photos         []ClaimPhoto `json:"photos,omitempty" gorm:"foreignKey:ClaimID"`
+	Parcel         *Parcel      `json:"-" gorm:"foreignKey:ParcelID"`
+}
+
+// ClaimPhoto is evidence attached to a claim
+type ClaimPhoto struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	ClaimID   uint      `json:"claimId" gorm:"not null;index"`
+	ImageURL  string    `json:"imageUrl" gorm:"not null"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ClaimType constants
+const (
+	ClaimTypeDamage = "damage"
+	ClaimTypeLoss   = "loss"
+)
+
+// ClaimStatus constants
+const (
+	ClaimStatusSubmitted   = "submitted"
+	ClaimStatusUnderReview = "under_review"
+	ClaimStatusApproved    = "approved"
+	ClaimStatusRejected    = "rejected"
+)
+
+// IsResolved reports whether an admin has approved or rejected the claim
+func (c *Claim) IsResolved() bool {
+	return c.Status == ClaimStatusApproved || c.Status == ClaimStatusRejected
+}
+
+// LedgerEntry records money owed to or by the platform for a booking
+type LedgerEntry struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	BookingID   uint      `json:"bookingId" gorm:"not null;index"`
+	ClaimID     *uint     `json:"claimId,omitempty" gorm:"index"`
+	UserID      uint      `json:"userId" gorm:"not null;index"`
+	Type        string    `json:"type" gorm:"not null"`
+	Amount      float64   `json:"amount" gorm:"not null"` // positive when the user pays, negative when paid out
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// LedgerEntry types
+const (
+	LedgerInsurancePremium = "insurance_premium"
+	LedgerInsuranceRefund  = "insurance_refund"
+	LedgerClaimPayout      = "claim_payout"
+)
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// Notification is an entry in a user's in-app inbox, kept so notifications
+// dismissed or sent while the user was offline can still be read
+type Notification struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"userId" gorm:"not null;index:idx_notification_user_created"`
+	Event     string     `json:"event" gorm:"not null"`
+	Title     string     `json:"title" gorm:"not null"`
+	Body      string     `json:"body" gorm:"type:text"`
+	Data      string     `json:"-" gorm:"type:text"` // JSON passed on to the app
+	ReadAt    *time.Time `json:"readAt"`
+	CreatedAt time.Time  `json:"createdAt" gorm:"index:idx_notification_user_created"`
+}
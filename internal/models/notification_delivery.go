@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Notification channels
+const (
+	ChannelWebSocket = "websocket"
+	ChannelPush      = "push"
+	ChannelSMS       = "sms"
+	ChannelEmail     = "email"
+)
+
+// Notification delivery statuses
+const (
+	DeliveryQueued   = "queued"
+	DeliveryRetrying = "retrying"
+	DeliverySent     = "sent"
+	DeliveryFailed   = "failed"
+)
+
+// NotificationDelivery records a notification sent to a user on one channel
+// and how the attempts to deliver it went
+type NotificationDelivery struct {
+	gorm.Model
+	UserID    uint       `json:"userId" gorm:"index;not null"`
+	Event     string     `json:"event" gorm:"not null"`
+	Channel   string     `json:"channel" gorm:"not null"`
+	Status    string     `json:"status" gorm:"index;not null;default:'queued'"`
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"lastError,omitempty"`
+	SentAt    *time.Time `json:"sentAt,omitempty"`
+}
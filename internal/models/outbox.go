@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// OutboxMessage is a background job recorded in the same transaction as
+// the change that caused it. A relay moves it onto the job queue once the
+// transaction has committed, so the job is neither lost nor sent for a
+// change that was rolled back.
+type OutboxMessage struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	JobType    string     `json:"jobType" gorm:"not null"`
+	Payload    string     `json:"payload" gorm:"type:text;not null"`
+	Ref        string     `json:"ref,omitempty"` // passed on to the job, e.g. "delivery:12"
+	CreatedAt  time.Time  `json:"createdAt"`
+	EnqueuedAt *time.Time `json:"enqueuedAt,omitempty" gorm:"index"` // nil until handed to the job queue
+}
@@ -1,15 +1,107 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type Parcel struct {
 	gorm.Model
-	RideID            uint   `gorm:"not null"`
-	ParcelImage       string `gorm:"not null"`
-	ParcelDescription string `gorm:"not null"`
-	ReceiverName      string `gorm:"not null"`
-	ReceiverContact   string `gorm:"not null"`
-	ReceiverEmail     string `gorm:"not null"`
-	Destination       string `gorm:"not null"`
-	Ride              Ride   `gorm:"foreignKey:RideID"`
+	RideID            uint     `gorm:"not null"`
+	BookingID         *uint    `gorm:"index"` // nil until the parcel is booked
+	ClientID          uint     `gorm:"not null;default:0;index"`
+	ParcelImage       string   `gorm:"not null"`
+	ParcelDescription string   `gorm:"not null"`
+	ReceiverName      string   `gorm:"not null"`
+	ReceiverContact   string   `gorm:"not null"`
+	ReceiverEmail     string   `gorm:"not null"`
+	Destination       string   `gorm:"not null"`
+	DestinationLat    *float64 // optional, used for the delivery ETA
+	DestinationLng    *float64
+	WeightKg          float64   `gorm:"not null;default:0"`
+	LengthCm          float64   `gorm:"not null;default:0"`
+	WidthCm           float64   `gorm:"not null;default:0"`
+	HeightCm          float64   `gorm:"not null;default:0"`
+	Category          string    `gorm:"not null;default:'general'"`
+	DeclaredValue     float64   `gorm:"not null;default:0"` // in KES
+	InsuranceTier     string    `gorm:"not null;default:'none'"`
+	InsurancePremium  float64   `gorm:"not null;default:0"`
+	CoverageAmount    float64   `gorm:"not null;default:0"` // most a claim can pay out
+	TrackingCode      string    `gorm:"uniqueIndex"`
+	Status            string    `gorm:"not null;default:'created'"`
+	StatusUpdatedAt   time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	DeliveryCode      string    `json:"-"`
+	DeliveryAttempts  int       `json:"-" gorm:"not null;default:0"` // wrong codes entered since the code was sent
+	ProofAttempts     int       `json:"-" gorm:"not null;default:0"` // wrong codes entered to view the proof of delivery
+	DeliveryCodesSent int       `json:"-" gorm:"not null;default:0"` // delivery codes sent to the receiver
+	Ride              Ride      `gorm:"foreignKey:RideID"`
+}
+
+// ParcelCategory constants
+const (
+	ParcelCategoryGeneral    = "general"
+	ParcelCategoryFragile    = "fragile"
+	ParcelCategoryPerishable = "perishable"
+	ParcelCategoryFurniture  = "furniture"
+)
+
+// VolumeM3 returns the space the parcel takes up, or 0 if its dimensions are unknown
+func (p *Parcel) VolumeM3() float64 {
+	return p.LengthCm * p.WidthCm * p.HeightCm / 1e6
+}
+
+// MaxDeliveryAttempts is how many wrong delivery codes are accepted before a
+// new code must be sent to the receiver
+const MaxDeliveryAttempts = 5
+
+// MaxDeliveryCodes is how many delivery codes are sent for a parcel, so
+// resending can't be used to keep guessing
+const MaxDeliveryCodes = 5
+
+// MaxProofAttempts is how many wrong delivery codes the public proof of
+// delivery accepts before it is locked, leaving the proof to the sender
+const MaxProofAttempts = 5
+
+// ParcelStatusEvent records a parcel status change
+type ParcelStatusEvent struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	ParcelID  uint      `json:"parcelId" gorm:"not null;index"`
+	Status    string    `json:"status" gorm:"not null"`
+	Note      string    `json:"note,omitempty"`
+	ChangedBy uint      `json:"changedBy,omitempty"` // user who made the change, 0 for the system
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// TableName specifies the table name
+func (ParcelStatusEvent) TableName() string {
+	return "parcel_status_events"
+}
+
+// ParcelStatus constants
+const (
+	ParcelStatusCreated   = "created"
+	ParcelStatusPickedUp  = "picked_up"
+	ParcelStatusInTransit = "in_transit"
+	ParcelStatusDelivered = "delivered"
+	ParcelStatusFailed    = "failed"
+	ParcelStatusReturned  = "returned"
+)
+
+// parcelTransitions lists the statuses a parcel may move to from each status
+var parcelTransitions = map[string][]string{
+	ParcelStatusCreated:   {ParcelStatusPickedUp, ParcelStatusFailed},
+	ParcelStatusPickedUp:  {ParcelStatusInTransit, ParcelStatusDelivered, ParcelStatusFailed},
+	ParcelStatusInTransit: {ParcelStatusDelivered, ParcelStatusFailed},
+	ParcelStatusFailed:    {ParcelStatusInTransit, ParcelStatusReturned},
+}
+
+// CanTransitionTo reports whether the parcel may move to the given status
+func (p *Parcel) CanTransitionTo(status string) bool {
+	for _, next := range parcelTransitions[p.Status] {
+		if next == status {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ParcelRequest is a client looking for a truck already heading their way.
+// It is matched against posted rides whose route passes both ends.
+type ParcelRequest struct {
+	gorm.Model
+	ClientID       uint      `json:"clientId" gorm:"not null;index"`
+	Origin         string    `json:"origin" gorm:"not null"`
+	Destination    string    `json:"destination" gorm:"not null"`
+	OriginLat      float64   `json:"originLat" gorm:"not null"`
+	OriginLng      float64   `json:"originLng" gorm:"not null"`
+	DestinationLat float64   `json:"destinationLat" gorm:"not null"`
+	DestinationLng float64   `json:"destinationLng" gorm:"not null"`
+	EarliestDate   time.Time `json:"earliestDate" gorm:"not null"`
+	LatestDate     time.Time `json:"latestDate" gorm:"not null;index"`
+	WeightKg       float64   `json:"weightKg" gorm:"not null"`
+	Description    string    `json:"description"`
+	MaxPrice       *float64  `json:"maxPrice,omitempty"`
+	CorridorKm     float64   `json:"corridorKm" gorm:"not null"` // how far off the route the ends may be
+	Status         string    `json:"status" gorm:"not null;default:'open';index"`
+}
+
+// ParcelRequestStatus constants
+const (
+	ParcelRequestOpen      = "open"
+	ParcelRequestBooked    = "booked"
+	ParcelRequestCancelled = "cancelled"
+)
+
+// ParcelRequestMatch records that a ride's driver was told about a request,
+// so each driver is notified once per request and ride
+type ParcelRequestMatch struct {
+	ID              uint      `json:"id" gorm:"primaryKey"`
+	ParcelRequestID uint      `json:"parcelRequestId" gorm:"not null;uniqueIndex:idx_parcel_request_ride"`
+	RideID          uint      `json:"rideId" gorm:"not null;uniqueIndex:idx_parcel_request_ride"`
+	DriverID        uint      `json:"driverId" gorm:"not null;index"`
+	DetourKm        float64   `json:"detourKm"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
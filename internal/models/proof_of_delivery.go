@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ProofOfDelivery records how a parcel was handed over to its receiver
+type ProofOfDelivery struct {
+	gorm.Model
+	ParcelID     uint      `json:"parcelId" gorm:"not null;uniqueIndex"`
+	DriverID     uint      `json:"driverId" gorm:"not null"`
+	OTPVerified  bool      `json:"otpVerified" gorm:"not null;default:false"`
+	ReceivedBy   string    `json:"receivedBy,omitempty"` // name of the person who took the parcel
+	PhotoURL     string    `json:"photoUrl,omitempty"`
+	SignatureURL string    `json:"signatureUrl,omitempty"`
+	Latitude     *float64  `json:"lat,omitempty"`
+	Longitude    *float64  `json:"lng,omitempty"`
+	DeliveredAt  time.Time `json:"deliveredAt" gorm:"not null"`
+	Parcel       *Parcel   `json:"-" gorm:"foreignKey:ParcelID"`
+	Driver       *User     `json:"-" gorm:"foreignKey:DriverID"`
+}
+
+// TableName specifies the table name
+func (ProofOfDelivery) TableName() string {
+	return "proofs_of_delivery"
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -8,12 +11,109 @@ import (
 
 type Ride struct {
 	gorm.Model
-	DriverID        uint      `json:"driverId" gorm:"not null"`
-	CurrentLocation string    `json:"currentLocation" gorm:"not null"`
-	Destination     string    `json:"destination" gorm:"not null"`
-	TruckSize       string    `json:"truckSize" gorm:"not null"`
-	Price           float64   `json:"price" gorm:"not null"`
-	Date            time.Time `json:"date" gorm:"not null"`
-	Status          string    `json:"status" gorm:"not null;default:'available'"`
-	Driver          *User     `json:"driver,omitempty" gorm:"foreignKey:DriverID"`
+	DriverID        uint       `json:"driverId" gorm:"not null"`
+	CurrentLocation string     `json:"currentLocation" gorm:"not null"`
+	Destination     string     `json:"destination" gorm:"not null"`
+	TruckSize       string     `json:"truckSize" gorm:"not null"`
+	Price           float64    `json:"price" gorm:"not null"`
+	Date            time.Time  `json:"date" gorm:"not null;index"`
+	Status          string     `json:"status" gorm:"not null;default:'available'"`
+	OriginLat       *float64   `json:"originLat,omitempty"` // optional, enables distance search
+	OriginLng       *float64   `json:"originLng,omitempty"`
+	DestinationLat  *float64   `json:"destinationLat,omitempty"`
+	DestinationLng  *float64   `json:"destinationLng,omitempty"`
+	RoutePolyline   string     `json:"routePolyline,omitempty"` // encoded polyline of the planned route
+	OriginName      string     `json:"originName,omitempty"`    // normalised place names from geocoding
+	DestinationName string     `json:"destinationName,omitempty"`
+	GeocodedAt      *time.Time `json:"-"`                    // set once geocoding was attempted
+	CapacityKg      *float64   `json:"capacityKg,omitempty"` // nil when the truck size is unknown
+	CapacityM3      *float64   `json:"capacityM3,omitempty"`
+	RemainingKg     *float64   `json:"remainingKg,omitempty"` // capacity not yet reserved by bookings
+	RemainingM3     *float64   `json:"remainingM3,omitempty"`
+	TemplateID      *uint      `json:"templateId,omitempty" gorm:"uniqueIndex:idx_ride_template_occurrence"` // set on rides generated from a RideTemplate
+	OccurrenceDate  *time.Time `json:"occurrenceDate,omitempty" gorm:"type:date;uniqueIndex:idx_ride_template_occurrence"`
+	DepartedAt      *time.Time `json:"departedAt,omitempty"`
+	ArrivedAt       *time.Time `json:"arrivedAt,omitempty"`
+	CompletedAt     *time.Time `json:"completedAt,omitempty"`
+	Driver          *User      `json:"driver,omitempty" gorm:"foreignKey:DriverID"`
+}
+
+// Status constants of posted rides. Rides matched on demand through a
+// RideRequest use the RideStatus constants instead.
+const (
+	RideAvailable = "available"
+	RideBooked    = "booked" // no more bookings fit
+	RideDeparted  = "departed"
+	RideInTransit = "in_transit"
+	RideArrived   = "arrived"
+	RideCompleted = "completed"
+	RideCancelled = "cancelled"
+)
+
+// rideTransitions lists the trip statuses a driver may move a ride to
+var rideTransitions = map[string][]string{
+	RideAvailable: {RideDeparted},
+	RideBooked:    {RideDeparted},
+	RideDeparted:  {RideInTransit, RideArrived},
+	RideInTransit: {RideArrived},
+	RideArrived:   {RideCompleted},
+}
+
+// CanTransitionTo reports whether the ride may move to the given trip status
+func (r *Ride) CanTransitionTo(status string) bool {
+	for _, next := range rideTransitions[r.Status] {
+		if next == status {
+			return true
+		}
+	}
+	return false
+}
+
+// TruckCapacity is the load a truck can carry
+type TruckCapacity struct {
+	WeightKg float64
+	VolumeM3 float64
+}
+
+// truckCapacities lists the load limits of the truck sizes offered in the app
+var truckCapacities = map[string]TruckCapacity{
+	"small":  {WeightKg: 1000, VolumeM3: 4},   // pickup
+	"medium": {WeightKg: 3000, VolumeM3: 14},  // 3 tonne canter
+	"large":  {WeightKg: 10000, VolumeM3: 40}, // 10 tonne lorry
+}
+
+// tonnagePattern matches sizes given as a load such as "3 tonne" or "5t"
+var tonnagePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*(?:t|ton|tons|tonne|tonnes)$`)
+
+// CapacityForTruckSize returns the load limits of a truck size, either one of
+// the standard sizes or a tonnage. ok is false when the size is not understood.
+func CapacityForTruckSize(truckSize string) (capacity TruckCapacity, ok bool) {
+	size := strings.ToLower(strings.TrimSpace(truckSize))
+	if capacity, ok := truckCapacities[size]; ok {
+		return capacity, true
+	}
+
+	match := tonnagePattern.FindStringSubmatch(size)
+	if match == nil {
+		return TruckCapacity{}, false
+	}
+	tonnes, err := strconv.ParseFloat(match[1], 64)
+	if err != nil || tonnes <= 0 {
+		return TruckCapacity{}, false
+	}
+	// Roughly 4.5 cubic metres of cargo space per tonne of payload
+	return TruckCapacity{WeightKg: tonnes * 1000, VolumeM3: tonnes * 4.5}, true
+}
+
+// HasCapacity reports whether the ride tracks how much space is left
+func (r *Ride) HasCapacity() bool {
+	return r.RemainingKg != nil
+}
+
+// IsFull reports whether no more parcels can be booked on the ride
+func (r *Ride) IsFull() bool {
+	if !r.HasCapacity() {
+		return false
+	}
+	return *r.RemainingKg <= 0 || (r.RemainingM3 != nil && *r.RemainingM3 <= 0)
 }
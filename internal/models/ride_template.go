@@ -0,0 +1,157 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Recurrence constants, modelled on the RRULE frequencies drivers need
+const (
+	RecurrenceDaily    = "daily"
+	RecurrenceWeekdays = "weekdays" // Monday to Friday
+	RecurrenceWeekly   = "weekly"   // on the days listed in Days
+)
+
+// RideTemplate status constants
+const (
+	RideTemplateActive    = "active"
+	RideTemplateCancelled = "cancelled"
+)
+
+// weekdayCodes maps the day codes used in Days to weekdays
+var weekdayCodes = map[string]time.Weekday{
+	"mo": time.Monday,
+	"tu": time.Tuesday,
+	"we": time.Wednesday,
+	"th": time.Thursday,
+	"fr": time.Friday,
+	"sa": time.Saturday,
+	"su": time.Sunday,
+}
+
+// RideTemplate is a ride a driver runs on a schedule. Rides are generated
+// from it a few days ahead so clients can book them like any other ride.
+type RideTemplate struct {
+	gorm.Model
+	DriverID        uint       `json:"driverId" gorm:"not null;index"`
+	CurrentLocation string     `json:"currentLocation" gorm:"not null"`
+	Destination     string     `json:"destination" gorm:"not null"`
+	TruckSize       string     `json:"truckSize" gorm:"not null"`
+	Price           float64    `json:"price" gorm:"not null"`
+	CapacityKg      *float64   `json:"capacityKg,omitempty"`
+	CapacityM3      *float64   `json:"capacityM3,omitempty"`
+	OriginLat       *float64   `json:"originLat,omitempty"`
+	OriginLng       *float64   `json:"originLng,omitempty"`
+	DestinationLat  *float64   `json:"destinationLat,omitempty"`
+	DestinationLng  *float64   `json:"destinationLng,omitempty"`
+	RoutePolyline   string     `json:"routePolyline,omitempty"`
+	OriginName      string     `json:"originName,omitempty"`
+	DestinationName string     `json:"destinationName,omitempty"`
+	Recurrence      string     `json:"recurrence" gorm:"not null"`
+	Days            string     `json:"days,omitempty"`                // comma separated day codes for weekly rides, e.g. "mo,we,fr"
+	DepartureTime   string     `json:"departureTime" gorm:"not null"` // local time of day, "15:04"
+	TimeZone        string     `json:"timeZone" gorm:"not null;default:'Africa/Nairobi'"`
+	StartDate       time.Time  `json:"startDate" gorm:"not null"`
+	Until           *time.Time `json:"until,omitempty"` // last day rides run, inclusive
+	Status          string     `json:"status" gorm:"not null;default:'active';index"`
+}
+
+// RideTemplateException records an occurrence the driver skipped, so it is
+// never generated again
+type RideTemplateException struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	TemplateID     uint      `json:"templateId" gorm:"not null;uniqueIndex:idx_template_occurrence"`
+	OccurrenceDate time.Time `json:"occurrenceDate" gorm:"type:date;not null;uniqueIndex:idx_template_occurrence"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// ParseDays validates a list of day codes ("mo", "tuesday", "WE") and returns
+// them in the form stored in Days
+func ParseDays(days []string) (string, error) {
+	seen := make(map[string]bool)
+	var codes []string
+	for _, day := range days {
+		day = strings.ToLower(strings.TrimSpace(day))
+		if len(day) > 2 {
+			day = day[:2]
+		}
+		if _, ok := weekdayCodes[day]; !ok {
+			return "", fmt.Errorf("unknown day %q", day)
+		}
+		if !seen[day] {
+			seen[day] = true
+			codes = append(codes, day)
+		}
+	}
+	return strings.Join(codes, ","), nil
+}
+
+// Location returns the time zone departure times are given in
+func (t *RideTemplate) Location() *time.Location {
+	if location, err := time.LoadLocation(t.TimeZone); err == nil {
+		return location
+	}
+	return time.UTC
+}
+
+// runsOn reports whether the recurrence rule includes a day
+func (t *RideTemplate) runsOn(day time.Time) bool {
+	switch t.Recurrence {
+	case RecurrenceDaily:
+		return true
+	case RecurrenceWeekdays:
+		return day.Weekday() != time.Saturday && day.Weekday() != time.Sunday
+	case RecurrenceWeekly:
+		for _, code := range strings.Split(t.Days, ",") {
+			if weekday, ok := weekdayCodes[code]; ok && weekday == day.Weekday() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Departure returns the departure time of the occurrence on a day
+func (t *RideTemplate) Departure(day time.Time) (time.Time, error) {
+	clock, err := time.Parse("15:04", t.DepartureTime)
+	if err != nil {
+		return time.Time{}, err
+	}
+	location := t.Location()
+	return time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, location), nil
+}
+
+// Occurrences lists the days with a ride departing between from and to,
+// as midnight UTC dates
+func (t *RideTemplate) Occurrences(from, to time.Time) []time.Time {
+	location := t.Location()
+	start := t.StartDate.In(location)
+	if earliest := from.In(location).AddDate(0, 0, -1); earliest.After(start) {
+		start = earliest
+	}
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, location)
+
+	var last time.Time
+	if t.Until != nil {
+		last = time.Date(t.Until.Year(), t.Until.Month(), t.Until.Day(), 0, 0, 0, 0, location)
+	}
+
+	var days []time.Time
+	for ; !day.After(to); day = day.AddDate(0, 0, 1) {
+		if t.Until != nil && day.After(last) {
+			break
+		}
+		if !t.runsOn(day) {
+			continue
+		}
+		departure, err := t.Departure(day)
+		if err != nil || departure.Before(from) || departure.After(to) {
+			continue
+		}
+		days = append(days, time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC))
+	}
+	return days
+}
@@ -24,7 +24,8 @@ type User struct {
 	CarPlate     string   `gorm:"column:car_plate"`
 	CarMake      string   `gorm:"column:car_make"`
 	CarColor     string   `gorm:"column:car_color"`
-	FCMToken     string   `gorm:"column:fcm_token"` // Firebase Cloud Messaging token for push notifications
+	// PreferredLanguage is the language messages are sent in, e.g. "en" or "sw"
+	PreferredLanguage string `gorm:"column:preferred_language;not null;default:'en'"`
 }
 
 // TableName specifies the table name
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// eventLogMaxLen caps how many recent events are kept per user for replay
+	eventLogMaxLen = 500
+	// eventLogTTL is how long a user's event log survives without new events
+	eventLogTTL = 24 * time.Hour
+)
+
+// ackScript stores the acknowledged sequence only if it moves forward
+var ackScript = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+local seq = tonumber(ARGV[1])
+if seq > current then
+	redis.call("SET", KEYS[1], ARGV[1], "EX", ARGV[2])
+	return seq
+end
+return current
+`)
+
+// appendScript takes the user's next sequence number and adds the message to
+// their event log in one step, so stream IDs are always added in order. The
+// message is passed as its JSON object body after the opening brace, with
+// ARGV[2] separating the seq field from the fields that follow.
+var appendScript = redis.NewScript(`
+local seq = redis.call("INCR", KEYS[1])
+local stamped = '{"seq":' .. seq .. ARGV[2] .. ARGV[1]
+redis.call("XADD", KEYS[2], "MAXLEN", "~", ARGV[3], seq .. "-0", "message", stamped)
+redis.call("EXPIRE", KEYS[1], ARGV[4])
+redis.call("EXPIRE", KEYS[2], ARGV[4])
+return {seq, stamped}
+`)
+
+func eventSeqKey(userID uint) string {
+	return fmt.Sprintf("ws:seq:%d", userID)
+}
+
+func eventLogKey(userID uint) string {
+	return fmt.Sprintf("ws:events:%d", userID)
+}
+
+func eventAckKey(userID uint) string {
+	return fmt.Sprintf("ws:ack:%d", userID)
+}
+
+// AppendUserEvent assigns the next per-user sequence number to a WebSocket
+// message, stores it in the user's event log and returns the stamped message
+func AppendUserEvent(ctx context.Context, userID uint, message []byte) ([]byte, uint64, error) {
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return nil, 0, err
+	}
+	delete(envelope, "seq")
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, 0, err
+	}
+	separator := ","
+	if len(envelope) == 0 {
+		separator = ""
+	}
+
+	result, err := appendScript.Run(ctx, RedisClient,
+		[]string{eventSeqKey(userID), eventLogKey(userID)},
+		body[1:], separator, eventLogMaxLen, int(eventLogTTL.Seconds()),
+	).Slice()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(result) != 2 {
+		return nil, 0, fmt.Errorf("unexpected event log reply %v", result)
+	}
+	seq, seqOK := result[0].(int64)
+	stamped, stampedOK := result[1].(string)
+	if !seqOK || !stampedOK {
+		return nil, 0, fmt.Errorf("unexpected event log reply %v", result)
+	}
+
+	return []byte(stamped), uint64(seq), nil
+}
+
+// GetUserEventsSince returns the stored events with a sequence greater than lastSeq
+func GetUserEventsSince(ctx context.Context, userID uint, lastSeq uint64) ([][]byte, error) {
+	entries, err := RedisClient.XRange(ctx, eventLogKey(userID), fmt.Sprintf("%d-0", lastSeq+1), "+").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		if message, ok := entry.Values["message"].(string); ok {
+			events = append(events, []byte(message))
+		}
+	}
+
+	return events, nil
+}
+
+// AckUserEvents records the highest sequence number a user has processed
+func AckUserEvents(ctx context.Context, userID uint, seq uint64) error {
+	return ackScript.Run(ctx, RedisClient, []string{eventAckKey(userID)}, seq, int(eventLogTTL.Seconds())).Err()
+}
+
+// GetUserEventAck returns the highest sequence number a user has acknowledged
+func GetUserEventAck(ctx context.Context, userID uint) (uint64, error) {
+	result, err := RedisClient.Get(ctx, eventAckKey(userID)).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(result, 10, 64)
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// decodeEvent reads the seq and type of a stored event
+func decodeEvent(t *testing.T, event []byte) WebSocketMessage {
+	t.Helper()
+
+	var message WebSocketMessage
+	if err := json.Unmarshal(event, &message); err != nil {
+		t.Fatalf("decode %s: %v", event, err)
+	}
+	return message
+}
+
+// resetUserEvents clears a user's event log, seq and ack
+func resetUserEvents(userIDs ...uint) {
+	for _, userID := range userIDs {
+		testRedis.Del(eventSeqKey(userID))
+		testRedis.Del(eventLogKey(userID))
+		testRedis.Del(eventAckKey(userID))
+	}
+}
+
+func TestAppendUserEventStampsSequence(t *testing.T) {
+	ctx := context.Background()
+	const userID = 301
+	resetUserEvents(userID)
+
+	for want := uint64(1); want <= 3; want++ {
+		stamped, seq, err := AppendUserEvent(ctx, userID, []byte(`{"type":"booking_accepted","data":{"bookingId":7}}`))
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		if seq != want {
+			t.Errorf("seq = %d, want %d", seq, want)
+		}
+
+		message := decodeEvent(t, stamped)
+		if message.Seq != seq || message.Type != "booking_accepted" {
+			t.Errorf("stamped message = %s", stamped)
+		}
+		var data struct {
+			BookingID int `json:"bookingId"`
+		}
+		if raw, _ := json.Marshal(message.Data); json.Unmarshal(raw, &data) != nil || data.BookingID != 7 {
+			t.Errorf("data lost in %s", stamped)
+		}
+	}
+
+	// An empty message still gets a valid envelope
+	stamped, seq, err := AppendUserEvent(ctx, userID, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("append empty: %v", err)
+	}
+	if message := decodeEvent(t, stamped); message.Seq != seq {
+		t.Errorf("empty message stamped as %s", stamped)
+	}
+
+	if ttl := testRedis.TTL(eventSeqKey(userID)); ttl != eventLogTTL {
+		t.Errorf("seq key TTL = %s, want %s", ttl, eventLogTTL)
+	}
+	if ttl := testRedis.TTL(eventLogKey(userID)); ttl != eventLogTTL {
+		t.Errorf("event log TTL = %s, want %s", ttl, eventLogTTL)
+	}
+
+	if _, _, err := AppendUserEvent(ctx, userID, []byte("not json")); err == nil {
+		t.Error("appending a message that is not a JSON object should fail")
+	}
+}
+
+func TestAppendUserEventConcurrentlyStoresEveryEvent(t *testing.T) {
+	ctx := context.Background()
+	const userID, events = 302, 100
+	resetUserEvents(userID)
+
+	var wg sync.WaitGroup
+	seqs := make(chan uint64, events)
+	for i := 0; i < events; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, seq, err := AppendUserEvent(ctx, userID, []byte(`{"type":"ping"}`))
+			if err != nil {
+				t.Errorf("append: %v", err)
+				return
+			}
+			seqs <- seq
+		}()
+	}
+	wg.Wait()
+	close(seqs)
+
+	var got []uint64
+	for seq := range seqs {
+		got = append(got, seq)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	for i, seq := range got {
+		if seq != uint64(i+1) {
+			t.Fatalf("seqs = %v, want 1..%d", got, events)
+		}
+	}
+
+	stored, err := GetUserEventsSince(ctx, userID, 0)
+	if err != nil {
+		t.Fatalf("read events: %v", err)
+	}
+	if len(stored) != events {
+		t.Fatalf("stored %d events, want %d", len(stored), events)
+	}
+	for i, event := range stored {
+		if seq := decodeEvent(t, event).Seq; seq != uint64(i+1) {
+			t.Fatalf("event %d has seq %d, want %d", i, seq, i+1)
+		}
+	}
+}
+
+func TestGetUserEventsSince(t *testing.T) {
+	ctx := context.Background()
+	const userID = 303
+	resetUserEvents(userID, 304)
+
+	for i := 0; i < 5; i++ {
+		if _, _, err := AppendUserEvent(ctx, userID, []byte(`{"type":"ping"}`)); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	for _, tt := range []struct {
+		since uint64
+		want  []uint64
+	}{
+		{0, []uint64{1, 2, 3, 4, 5}},
+		{3, []uint64{4, 5}},
+		{5, nil},
+		{9, nil},
+	} {
+		events, err := GetUserEventsSince(ctx, userID, tt.since)
+		if err != nil {
+			t.Fatalf("read since %d: %v", tt.since, err)
+		}
+		var got []uint64
+		for _, event := range events {
+			got = append(got, decodeEvent(t, event).Seq)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("since %d: got seqs %v, want %v", tt.since, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("since %d: got seqs %v, want %v", tt.since, got, tt.want)
+				break
+			}
+		}
+	}
+
+	if events, err := GetUserEventsSince(ctx, 304, 0); err != nil || len(events) != 0 {
+		t.Errorf("user without events: got %d events, err %v", len(events), err)
+	}
+}
+
+func TestAckUserEventsOnlyMovesForward(t *testing.T) {
+	ctx := context.Background()
+	const userID = 305
+	resetUserEvents(userID)
+
+	if acked, err := GetUserEventAck(ctx, userID); err != nil || acked != 0 {
+		t.Fatalf("initial ack = %d, %v; want 0", acked, err)
+	}
+
+	for _, step := range []struct {
+		ack, want uint64
+	}{
+		{4, 4},
+		{2, 4}, // a late ack for older events is ignored
+		{9, 9},
+	} {
+		if err := AckUserEvents(ctx, userID, step.ack); err != nil {
+			t.Fatalf("ack %d: %v", step.ack, err)
+		}
+		acked, err := GetUserEventAck(ctx, userID)
+		if err != nil {
+			t.Fatalf("read ack: %v", err)
+		}
+		if acked != step.want {
+			t.Errorf("after acking %d: ack = %d, want %d", step.ack, acked, step.want)
+		}
+	}
+
+	if ttl := testRedis.TTL(eventAckKey(userID)); ttl != eventLogTTL {
+		t.Errorf("ack TTL = %s, want %s", ttl, eventLogTTL)
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/messaging"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
 	"google.golang.org/api/option"
 )
 
@@ -155,6 +156,29 @@ func getAPNSConfig(payload NotificationPayload) *messaging.APNSConfig {
 	}
 }
 
+var unregisteredTokenHandler func(ctx context.Context, token string)
+
+// OnUnregisteredToken sets what is done with tokens FCM reports as no longer
+// registered, such as deleting them so they are not used again
+func OnUnregisteredToken(handler func(ctx context.Context, token string)) {
+	unregisteredTokenHandler = handler
+}
+
+func unregisteredToken(ctx context.Context, token string) {
+	if unregisteredTokenHandler != nil {
+		unregisteredTokenHandler(ctx, token)
+	}
+}
+
+// TokenPrefix shortens an FCM token for logs. The full token is a credential
+// for pushing to the device, so it is never logged.
+func TokenPrefix(token string) string {
+	if len(token) <= 8 {
+		return "..."
+	}
+	return token[:8] + "..."
+}
+
 // SendNotificationToToken sends a notification to a specific FCM token
 func SendNotificationToToken(ctx context.Context, token string, payload NotificationPayload) error {
 	if MessagingClient == nil {
@@ -203,10 +227,13 @@ func SendNotificationToToken(ctx context.Context, token string, payload Notifica
 
 	response, err := MessagingClient.Send(ctx, message)
 	if err != nil {
-		return fmt.Errorf("error sending message: %v", err)
+		if messaging.IsUnregistered(err) {
+			unregisteredToken(ctx, token)
+		}
+		return fmt.Errorf("error sending message: %w", err)
 	}
 
-	log.Printf("Successfully sent notification to token: %s, response: %s", token, response)
+	log.Printf("Successfully sent notification to token: %s, response: %s", TokenPrefix(token), response)
 	return nil
 }
 
@@ -266,11 +293,15 @@ func SendNotificationToMultipleTokens(ctx context.Context, tokens []string, payl
 
 	log.Printf("Successfully sent %d messages, %d failures", response.SuccessCount, response.FailureCount)
 
-	// Log any failures
+	// Log any failures and forget devices the app is no longer installed on
 	if response.FailureCount > 0 {
 		for idx, resp := range response.Responses {
-			if !resp.Success {
-				log.Printf("Failed to send to token %s: %v", tokens[idx], resp.Error)
+			if resp.Success {
+				continue
+			}
+			log.Printf("Failed to send to token %s: %v", TokenPrefix(tokens[idx]), resp.Error)
+			if messaging.IsUnregistered(resp.Error) {
+				unregisteredToken(ctx, tokens[idx])
 			}
 		}
 	}
@@ -278,116 +309,18 @@ func SendNotificationToMultipleTokens(ctx context.Context, tokens []string, payl
 	return response, nil
 }
 
-// SendRideRequestNotification sends a ride request notification to a driver
-func SendRideRequestNotification(ctx context.Context, driverToken string, rideID uint, clientName, pickupAddress, destAddress string, fare float64) error {
-	payload := NotificationPayload{
-		Title:     "New Ride Request",
-		Body:      fmt.Sprintf("%s requested a ride from %s", clientName, pickupAddress),
-		Sound:     "ringtone", // Custom ringtone for ride requests (ringtone.mp3 for Android, ringtone.caf for iOS)
-		ChannelID: "ride_requests",
-		Priority:  "high",
-		Data: map[string]interface{}{
-			"type":           "ride_request",
-			"rideId":         rideID,
-			"clientName":     clientName,
-			"pickupAddress":  pickupAddress,
-			"destAddress":    destAddress,
-			"fare":           fare,
-			"notificationId": fmt.Sprintf("ride_request_%d", rideID),
-		},
-	}
-
-	return SendNotificationToToken(ctx, driverToken, payload)
-}
-
-// SendRideAcceptedNotification sends a notification to client when driver accepts
-func SendRideAcceptedNotification(ctx context.Context, clientToken string, rideID uint, driverName, vehicleDetails string, eta int) error {
-	payload := NotificationPayload{
-		Title: "Ride Accepted!",
-		Body:  fmt.Sprintf("%s accepted your ride request. ETA: %d minutes", driverName, eta),
-		Data: map[string]interface{}{
-			"type":           "ride_accepted",
-			"rideId":         rideID,
-			"driverName":     driverName,
-			"vehicleDetails": vehicleDetails,
-			"eta":            eta,
-			"notificationId": fmt.Sprintf("ride_accepted_%d", rideID),
-		},
-	}
-
-	return SendNotificationToToken(ctx, clientToken, payload)
-}
-
-// SendDriverArrivedNotification sends notification when driver arrives at pickup
-func SendDriverArrivedNotification(ctx context.Context, clientToken string, rideID uint, driverName string) error {
-	payload := NotificationPayload{
-		Title: "Driver Arrived",
-		Body:  fmt.Sprintf("%s has arrived at your pickup location", driverName),
-		Data: map[string]interface{}{
-			"type":           "driver_arrived",
-			"rideId":         rideID,
-			"driverName":     driverName,
-			"notificationId": fmt.Sprintf("driver_arrived_%d", rideID),
-		},
-	}
-
-	return SendNotificationToToken(ctx, clientToken, payload)
-}
-
-// SendRideStartedNotification sends notification when ride starts
-func SendRideStartedNotification(ctx context.Context, clientToken string, rideID uint, driverName string) error {
-	payload := NotificationPayload{
-		Title: "Ride Started",
-		Body:  fmt.Sprintf("Your ride with %s has started", driverName),
-		Data: map[string]interface{}{
-			"type":           "ride_started",
-			"rideId":         rideID,
-			"driverName":     driverName,
-			"notificationId": fmt.Sprintf("ride_started_%d", rideID),
-		},
-	}
-
-	return SendNotificationToToken(ctx, clientToken, payload)
-}
-
-// SendRideCompletedNotification sends notification when ride is completed
-func SendRideCompletedNotification(ctx context.Context, clientToken string, rideID uint, fare float64) error {
-	payload := NotificationPayload{
-		Title: "Ride Completed",
-		Body:  fmt.Sprintf("Your ride is complete. Total fare: KES %.2f", fare),
-		Data: map[string]interface{}{
-			"type":           "ride_completed",
-			"rideId":         rideID,
-			"fare":           fare,
-			"notificationId": fmt.Sprintf("ride_completed_%d", rideID),
-		},
-	}
-
-	return SendNotificationToToken(ctx, clientToken, payload)
-}
-
-// SendRideRejectedNotification sends notification when driver rejects a ride request
-func SendRideRejectedNotification(ctx context.Context, clientToken string, rideID uint) error {
-	payload := NotificationPayload{
-		Title:    "Ride Request Declined",
-		Body:     "Unfortunately, the driver has declined your ride request. Please try requesting another ride.",
-		Sound:    "default",
-		Priority: "high",
-		Data: map[string]interface{}{
-			"type":           "ride_rejected",
-			"rideId":         rideID,
-			"notificationId": fmt.Sprintf("ride_rejected_%d", rideID),
-		},
-	}
-
-	return SendNotificationToToken(ctx, clientToken, payload)
-}
-
 // SendScheduledRidesAvailableNotification notifies clients about available scheduled rides
 func SendScheduledRidesAvailableNotification(ctx context.Context, clientTokens []string, count int) (*messaging.BatchResponse, error) {
+	message, err := utils.RenderMessage("scheduled_rides_available", utils.DefaultLanguage, map[string]interface{}{
+		"count": count,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	payload := NotificationPayload{
-		Title: "Rides Available!",
-		Body:  fmt.Sprintf("%d scheduled rides are now available. Book yours now!", count),
+		Title: message.Title,
+		Body:  message.Body,
 		Data: map[string]interface{}{
 			"type":           "scheduled_rides_available",
 			"count":          count,
@@ -0,0 +1,254 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrPlaceNotFound is returned when a geocoder has no match for a query
+var ErrPlaceNotFound = errors.New("place not found")
+
+// geocodeCacheTTL is how long geocoding results are cached in Redis
+const geocodeCacheTTL = 30 * 24 * time.Hour
+
+// Place is a geocoded location with a short, normalised name such as "Nairobi"
+type Place struct {
+	Name string  `json:"name"`
+	Lat  float64 `json:"lat"`
+	Lng  float64 `json:"lng"`
+}
+
+// Geocoder turns a free-text location into coordinates
+type Geocoder interface {
+	Geocode(ctx context.Context, query string) (*Place, error)
+}
+
+// geocoder is the provider selected by InitGeocoder
+var geocoder Geocoder
+
+// InitGeocoder selects the geocoding provider from GEOCODER: "nominatim"
+// (the default) or "stub" for local development and tests
+func InitGeocoder() {
+	switch os.Getenv("GEOCODER") {
+	case "stub":
+		geocoder = NewStubGeocoder()
+		log.Println("Using stub geocoder")
+	default:
+		geocoder = NewNominatimGeocoder(
+			os.Getenv("NOMINATIM_URL"),
+			os.Getenv("GEOCODER_USER_AGENT"),
+			os.Getenv("GEOCODER_COUNTRY"),
+		)
+	}
+}
+
+// GeocodePlace geocodes a location with the configured provider, caching
+// results in Redis since place names repeat across rides
+func GeocodePlace(ctx context.Context, query string) (*Place, error) {
+	if geocoder == nil {
+		return nil, errors.New("geocoder not initialized")
+	}
+
+	normalized := strings.ToLower(strings.Join(strings.Fields(query), " "))
+	if normalized == "" {
+		return nil, ErrPlaceNotFound
+	}
+
+	key := "geocode:" + normalized
+	if RedisClient != nil {
+		if cached, err := RedisClient.Get(ctx, key).Result(); err == nil {
+			var place Place
+			if err := json.Unmarshal([]byte(cached), &place); err == nil {
+				return &place, nil
+			}
+		} else if err != redis.Nil {
+			log.Printf("Geocode cache unavailable: %v", err)
+		}
+	}
+
+	place, err := geocoder.Geocode(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if RedisClient != nil {
+		if data, err := json.Marshal(place); err == nil {
+			RedisClient.Set(ctx, key, data, geocodeCacheTTL)
+		}
+	}
+	return place, nil
+}
+
+// NominatimGeocoder queries a Nominatim-compatible search API. Requests are
+// spaced at least a second apart as the public instance's usage policy asks.
+type NominatimGeocoder struct {
+	baseURL   string
+	userAgent string
+	country   string
+	client    *http.Client
+
+	mutex       sync.Mutex
+	lastRequest time.Time
+}
+
+// NewNominatimGeocoder creates a geocoder for the given server, defaulting to
+// the public OpenStreetMap instance limited to Kenya
+func NewNominatimGeocoder(baseURL, userAgent, country string) *NominatimGeocoder {
+	if baseURL == "" {
+		baseURL = "https://nominatim.openstreetmap.org"
+	}
+	if userAgent == "" {
+		userAgent = "MooveIt/1.0"
+	}
+	if country == "" {
+		country = "ke"
+	}
+
+	return &NominatimGeocoder{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		userAgent: userAgent,
+		country:   country,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// nominatimResult is the part of a Nominatim search result we use
+type nominatimResult struct {
+	Lat     string            `json:"lat"`
+	Lon     string            `json:"lon"`
+	Name    string            `json:"name"`
+	Address map[string]string `json:"address"`
+}
+
+// Geocode returns the best match for the query
+func (g *NominatimGeocoder) Geocode(ctx context.Context, query string) (*Place, error) {
+	if err := g.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Set("q", query)
+	params.Set("format", "jsonv2")
+	params.Set("addressdetails", "1")
+	params.Set("limit", "1")
+	params.Set("countrycodes", g.country)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", g.baseURL+"/search?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", g.userAgent)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("geocoding request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("geocoding failed with status %d", resp.StatusCode)
+	}
+
+	var results []nominatimResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, fmt.Errorf("invalid geocoding response: %v", err)
+	}
+	if len(results) == 0 {
+		return nil, ErrPlaceNotFound
+	}
+
+	result := results[0]
+	lat, err := strconv.ParseFloat(result.Lat, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid latitude %q", result.Lat)
+	}
+	lng, err := strconv.ParseFloat(result.Lon, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid longitude %q", result.Lon)
+	}
+
+	return &Place{Name: placeName(result), Lat: lat, Lng: lng}, nil
+}
+
+// wait blocks until this request's turn, a second after the previous one.
+// The turn is taken under the lock but waited for outside it, so a caller
+// whose context ends stops waiting instead of queueing behind the others.
+func (g *NominatimGeocoder) wait(ctx context.Context) error {
+	g.mutex.Lock()
+	turn := g.lastRequest.Add(time.Second)
+	if now := time.Now(); turn.Before(now) {
+		turn = now
+	}
+	g.lastRequest = turn
+	g.mutex.Unlock()
+
+	if delay := time.Until(turn); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// placeName picks the settlement a result lies in, falling back to its own name
+func placeName(result nominatimResult) string {
+	for _, key := range []string{"city", "town", "village", "suburb", "county", "state"} {
+		if name := result.Address[key]; name != "" {
+			return name
+		}
+	}
+	return result.Name
+}
+
+// StubGeocoder resolves a fixed set of towns without network access
+type StubGeocoder struct {
+	places map[string]Place
+}
+
+// NewStubGeocoder creates a geocoder that knows Kenya's main towns
+func NewStubGeocoder() *StubGeocoder {
+	places := []Place{
+		{Name: "Nairobi", Lat: -1.2864, Lng: 36.8172},
+		{Name: "Mombasa", Lat: -4.0435, Lng: 39.6682},
+		{Name: "Kisumu", Lat: -0.0917, Lng: 34.7680},
+		{Name: "Nakuru", Lat: -0.3031, Lng: 36.0800},
+		{Name: "Eldoret", Lat: 0.5143, Lng: 35.2698},
+		{Name: "Thika", Lat: -1.0388, Lng: 37.0834},
+		{Name: "Machakos", Lat: -1.5177, Lng: 37.2634},
+		{Name: "Nyeri", Lat: -0.4201, Lng: 36.9476},
+		{Name: "Naivasha", Lat: -0.7172, Lng: 36.4310},
+		{Name: "Kitale", Lat: 1.0157, Lng: 35.0062},
+	}
+
+	stub := &StubGeocoder{places: make(map[string]Place, len(places))}
+	for _, place := range places {
+		stub.places[strings.ToLower(place.Name)] = place
+	}
+	return stub
+}
+
+// Geocode matches the first known town named in the query
+func (g *StubGeocoder) Geocode(ctx context.Context, query string) (*Place, error) {
+	for _, word := range strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		if place, ok := g.places[word]; ok {
+			return &place, nil
+		}
+	}
+	return nil, ErrPlaceNotFound
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// countingGeocoder records the queries that reach the stub geocoder
+type countingGeocoder struct {
+	*StubGeocoder
+
+	mutex   sync.Mutex
+	queries []string
+}
+
+func (g *countingGeocoder) Geocode(ctx context.Context, query string) (*Place, error) {
+	g.mutex.Lock()
+	g.queries = append(g.queries, query)
+	g.mutex.Unlock()
+	return g.StubGeocoder.Geocode(ctx, query)
+}
+
+// useStubGeocoder makes GeocodePlace use a counting stub for one test
+func useStubGeocoder(t *testing.T) *countingGeocoder {
+	t.Helper()
+
+	previous := geocoder
+	t.Cleanup(func() { geocoder = previous })
+
+	stub := &countingGeocoder{StubGeocoder: NewStubGeocoder()}
+	geocoder = stub
+	return stub
+}
+
+func TestGeocodePlaceNormalisesAndCaches(t *testing.T) {
+	stub := useStubGeocoder(t)
+	ctx := context.Background()
+	testRedis.Del("geocode:nakuru, rift valley")
+
+	place, err := GeocodePlace(ctx, "  Nakuru,   Rift Valley ")
+	if err != nil {
+		t.Fatalf("geocode: %v", err)
+	}
+	if place.Name != "Nakuru" || place.Lat != -0.3031 || place.Lng != 36.0800 {
+		t.Fatalf("got %+v, want Nakuru", place)
+	}
+
+	// Case and spacing do not matter to the cache
+	if !testRedis.Exists("geocode:nakuru, rift valley") {
+		t.Fatal("result not cached under its normalised query")
+	}
+	cached, err := GeocodePlace(ctx, "NAKURU, rift   valley")
+	if err != nil {
+		t.Fatalf("geocode cached: %v", err)
+	}
+	if *cached != *place {
+		t.Errorf("cached place %+v differs from %+v", cached, place)
+	}
+	if len(stub.queries) != 1 {
+		t.Errorf("geocoder queried %d times, want once: %q", len(stub.queries), stub.queries)
+	}
+}
+
+func TestGeocodePlaceNotFound(t *testing.T) {
+	stub := useStubGeocoder(t)
+	ctx := context.Background()
+
+	for _, query := range []string{"", "   ", "Atlantis"} {
+		if _, err := GeocodePlace(ctx, query); !errors.Is(err, ErrPlaceNotFound) {
+			t.Errorf("GeocodePlace(%q) error = %v, want ErrPlaceNotFound", query, err)
+		}
+	}
+
+	// Blank queries never reach the geocoder and misses are not cached
+	if len(stub.queries) != 1 {
+		t.Errorf("geocoder queried %q, want only Atlantis", stub.queries)
+	}
+	if testRedis.Exists("geocode:atlantis") {
+		t.Error("miss was cached")
+	}
+}
+
+func TestPlaceName(t *testing.T) {
+	tests := []struct {
+		name   string
+		result nominatimResult
+		want   string
+	}{
+		{
+			name:   "city wins over smaller areas",
+			result: nominatimResult{Name: "Kenyatta Avenue", Address: map[string]string{"suburb": "CBD", "city": "Nairobi"}},
+			want:   "Nairobi",
+		},
+		{
+			name:   "town",
+			result: nominatimResult{Name: "Biashara Street", Address: map[string]string{"town": "Naivasha", "county": "Nakuru"}},
+			want:   "Naivasha",
+		},
+		{
+			name:   "county when there is no settlement",
+			result: nominatimResult{Name: "Hell's Gate", Address: map[string]string{"county": "Nakuru", "state": "Rift Valley"}},
+			want:   "Nakuru",
+		},
+		{
+			name:   "own name without an address",
+			result: nominatimResult{Name: "Mombasa"},
+			want:   "Mombasa",
+		},
+	}
+	for _, tt := range tests {
+		if got := placeName(tt.result); got != tt.want {
+			t.Errorf("%s: placeName() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	jobsReadyKey      = "jobs:ready"      // list of jobs waiting for a worker
+	jobsDelayedKey    = "jobs:delayed"    // jobs waiting to be retried, scored by when
+	jobsProcessingKey = "jobs:processing" // jobs being run, scored by when their lease ends
+	jobsDeadKey       = "jobs:dead"       // jobs that ran out of attempts
+
+	// jobTimeout bounds a single attempt at a job
+	jobTimeout = 30 * time.Second
+	// jobLease is how long a worker may hold a job before it is handed to
+	// another worker, in case the first one died
+	jobLease = 2 * time.Minute
+	// jobBaseBackoff is the delay before the first retry, doubled for each later one
+	jobBaseBackoff = 10 * time.Second
+	jobMaxBackoff  = time.Hour
+	// jobDeadLetterMax caps how many failed jobs are kept for inspection
+	jobDeadLetterMax = 1000
+	// jobPollInterval is how often due retries and expired leases are requeued
+	jobPollInterval = time.Second
+	// jobIdleWait is how long an idle worker waits before checking for jobs again
+	jobIdleWait = 200 * time.Millisecond
+)
+
+// Job is a unit of background work, such as sending an SMS
+type Job struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Ref       string          `json:"ref,omitempty"` // what the job is for, e.g. "delivery:12"
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	FailedAt  *time.Time      `json:"failedAt,omitempty"`
+}
+
+// JobHandler runs jobs of one type. Returning an error retries the job
+// unless it is wrapped with Permanent.
+type JobHandler func(ctx context.Context, payload json.RawMessage) error
+
+// JobObserver is told the outcome of every attempt at a job. err is nil
+// when the attempt succeeded; job.FailedAt is set when no retry follows.
+type JobObserver func(job Job, err error)
+
+var (
+	jobHandlers      = make(map[string]JobHandler)
+	jobObservers     []JobObserver
+	jobHandlersMutex sync.RWMutex
+)
+
+// permanentError marks a failure that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks a job error as final, sending the job straight to the
+// dead letter list
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// retryWithError asks for a job to be retried with a new payload
+type retryWithError struct {
+	err     error
+	payload json.RawMessage
+}
+
+func (e *retryWithError) Error() string { return e.err.Error() }
+func (e *retryWithError) Unwrap() error { return e.err }
+
+// RetryWith retries a job with a new payload, such as only the recipients
+// an attempt failed to reach
+func RetryWith(payload json.RawMessage, err error) error {
+	return &retryWithError{err: err, payload: payload}
+}
+
+// requeueScript moves members of a sorted set whose score has passed onto
+// the ready list
+var requeueScript = redis.NewScript(`
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+for _, job in ipairs(due) do
+	redis.call("ZREM", KEYS[1], job)
+	redis.call("LPUSH", KEYS[2], job)
+end
+return #due
+`)
+
+// claimScript pops the next ready job and leases it in one step, so a job
+// is never off the ready list without a lease
+var claimScript = redis.NewScript(`
+local job = redis.call("RPOP", KEYS[1])
+if not job then
+	return false
+end
+redis.call("ZADD", KEYS[2], ARGV[1], job)
+return job
+`)
+
+// RegisterJobHandler sets the handler run for jobs of a type
+func RegisterJobHandler(jobType string, handler JobHandler) {
+	jobHandlersMutex.Lock()
+	defer jobHandlersMutex.Unlock()
+	jobHandlers[jobType] = handler
+}
+
+// OnJobAttempt adds an observer run after every attempt at a job
+func OnJobAttempt(observer JobObserver) {
+	jobHandlersMutex.Lock()
+	defer jobHandlersMutex.Unlock()
+	jobObservers = append(jobObservers, observer)
+}
+
+// observeJob tells the observers how an attempt went
+func observeJob(job Job, err error) {
+	jobHandlersMutex.RLock()
+	observers := jobObservers
+	jobHandlersMutex.RUnlock()
+
+	for _, observer := range observers {
+		observer(job, err)
+	}
+}
+
+func jobHandler(jobType string) (JobHandler, bool) {
+	jobHandlersMutex.RLock()
+	defer jobHandlersMutex.RUnlock()
+	handler, ok := jobHandlers[jobType]
+	return handler, ok
+}
+
+// EnqueueJob queues a job for the next free worker
+func EnqueueJob(ctx context.Context, job Job) error {
+	if job.ID == "" || job.Type == "" {
+		return errors.New("job needs an ID and a type")
+	}
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = time.Now()
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return RedisClient.LPush(ctx, jobsReadyKey, data).Err()
+}
+
+// RunJobWorkers runs JOB_WORKERS workers (4 by default) until the process
+// exits. Each job is tried up to JOB_MAX_ATTEMPTS times (8 by default) with
+// exponential backoff between attempts.
+func RunJobWorkers() {
+	workers := utils.EnvInt("JOB_WORKERS", 4)
+	maxAttempts := utils.EnvInt("JOB_MAX_ATTEMPTS", 8)
+
+	for i := 0; i < workers; i++ {
+		go runJobWorker(maxAttempts)
+	}
+	log.Printf("Started %d job workers", workers)
+
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx := context.Background()
+		now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		for _, key := range []string{jobsDelayedKey, jobsProcessingKey} {
+			if err := requeueScript.Run(ctx, RedisClient, []string{key, jobsReadyKey}, now, 100).Err(); err != nil {
+				log.Printf("Failed to requeue jobs from %s: %v", key, err)
+			}
+		}
+	}
+}
+
+// runJobWorker takes jobs off the ready list one at a time
+func runJobWorker(maxAttempts int) {
+	ctx := context.Background()
+	for {
+		// Hold a lease so the job is retried if this process dies mid-way
+		lease := time.Now().Add(jobLease).UnixMilli()
+		raw, err := claimScript.Run(ctx, RedisClient, []string{jobsReadyKey, jobsProcessingKey}, lease).Text()
+		if err == redis.Nil {
+			time.Sleep(jobIdleWait)
+			continue
+		}
+		if err != nil {
+			log.Printf("Job queue unavailable: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		runJob(ctx, raw, maxAttempts)
+	}
+}
+
+// runJob runs one attempt at a job and schedules a retry if it fails
+func runJob(ctx context.Context, raw string, maxAttempts int) {
+	defer RedisClient.ZRem(ctx, jobsProcessingKey, raw)
+
+	var job Job
+	if err := json.Unmarshal([]byte(raw), &job); err != nil {
+		log.Printf("Dropping malformed job: %v", err)
+		return
+	}
+
+	handler, ok := jobHandler(job.Type)
+	if !ok {
+		failJob(ctx, job, fmt.Errorf("no handler for job type %q", job.Type))
+		return
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, jobTimeout)
+	err := handler(attemptCtx, job.Payload)
+	cancel()
+	if err == nil {
+		job.Attempts++
+		observeJob(job, nil)
+		return
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+	var retryWith *retryWithError
+	if errors.As(err, &retryWith) {
+		job.Payload = retryWith.payload
+	}
+	var permanent *permanentError
+	if errors.As(err, &permanent) || job.Attempts >= maxAttempts {
+		failJob(ctx, job, err)
+		return
+	}
+
+	observeJob(job, err)
+	delay := jobBackoff(job.Attempts)
+	log.Printf("Job %s (%s) failed, attempt %d, retrying in %s: %v", job.ID, job.Type, job.Attempts, delay, err)
+	data, _ := json.Marshal(job)
+	runAt := time.Now().Add(delay).UnixMilli()
+	if err := RedisClient.ZAdd(ctx, jobsDelayedKey, redis.Z{Score: float64(runAt), Member: data}).Err(); err != nil {
+		log.Printf("Failed to schedule retry of job %s: %v", job.ID, err)
+	}
+}
+
+// jobBackoff is the delay before the given retry, with jitter so jobs that
+// failed together do not all retry at once
+func jobBackoff(attempt int) time.Duration {
+	delay := jobMaxBackoff
+	if attempt < 20 {
+		if d := jobBaseBackoff << (attempt - 1); d < jobMaxBackoff {
+			delay = d
+		}
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay) / 5))
+	return delay - delay/10 + jitter
+}
+
+// failJob moves a job to the dead letter list
+func failJob(ctx context.Context, job Job, err error) {
+	now := time.Now()
+	job.FailedAt = &now
+	job.LastError = err.Error()
+	log.Printf("Job %s (%s) failed permanently after %d attempts: %v", job.ID, job.Type, job.Attempts, err)
+	observeJob(job, err)
+
+	data, _ := json.Marshal(job)
+	pipe := RedisClient.TxPipeline()
+	pipe.LPush(ctx, jobsDeadKey, data)
+	pipe.LTrim(ctx, jobsDeadKey, 0, jobDeadLetterMax-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to store dead job %s: %v", job.ID, err)
+	}
+}
+
+// DeadJobs returns the most recently failed jobs
+func DeadJobs(ctx context.Context, limit int) ([]Job, error) {
+	raws, err := RedisClient.LRange(ctx, jobsDeadKey, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]Job, 0, len(raws))
+	for _, raw := range raws {
+		var job Job
+		if err := json.Unmarshal([]byte(raw), &job); err == nil {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// RetryDeadJob moves a failed job back onto the queue with fresh attempts.
+// ok is false when no dead job has that ID.
+func RetryDeadJob(ctx context.Context, id string) (ok bool, err error) {
+	raws, err := RedisClient.LRange(ctx, jobsDeadKey, 0, -1).Result()
+	if err != nil {
+		return false, err
+	}
+
+	for _, raw := range raws {
+		var job Job
+		if err := json.Unmarshal([]byte(raw), &job); err != nil || job.ID != id {
+			continue
+		}
+		removed, err := RedisClient.LRem(ctx, jobsDeadKey, 1, raw).Result()
+		if err != nil || removed == 0 {
+			return false, err
+		}
+		job.Attempts = 0
+		job.FailedAt = nil
+		return true, EnqueueJob(ctx, job)
+	}
+	return false, nil
+}
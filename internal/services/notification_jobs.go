@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+)
+
+// Job types of outbound notifications
+const (
+	JobSMS   = "sms"
+	JobEmail = "email"
+	JobPush  = "push"
+	// JobWebSocket is only handled once RegisterWebSocketJob has been called
+	JobWebSocket = "websocket"
+)
+
+// SMSJob is an SMS to send
+type SMSJob struct {
+	To      []string `json:"to"`
+	Message string   `json:"message"`
+}
+
+// EmailJob is an email to send
+type EmailJob struct {
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Body    string   `json:"body"`
+}
+
+// PushJob is a push notification to send to a user's devices
+type PushJob struct {
+	Tokens       []string            `json:"tokens"`
+	Token        string              `json:"token,omitempty"` // single device, in jobs queued before Tokens
+	Notification NotificationPayload `json:"notification"`
+}
+
+// WebSocketJob is a message to send to a user's connected devices
+type WebSocketJob struct {
+	UserID  uint            `json:"userId"`
+	Message json.RawMessage `json:"message"`
+}
+
+func init() {
+	RegisterJobHandler(JobSMS, runSMSJob)
+	RegisterJobHandler(JobEmail, runEmailJob)
+	RegisterJobHandler(JobPush, runPushJob)
+}
+
+func runSMSJob(ctx context.Context, payload json.RawMessage) error {
+	var job SMSJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return Permanent(err)
+	}
+	return utils.SendSMS(job.Message, job.To)
+}
+
+func runEmailJob(ctx context.Context, payload json.RawMessage) error {
+	var job EmailJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return Permanent(err)
+	}
+	return utils.SendEmail(job.To, job.Subject, job.Body)
+}
+
+func runPushJob(ctx context.Context, payload json.RawMessage) error {
+	var job PushJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return Permanent(err)
+	}
+	tokens := job.Tokens
+	if job.Token != "" {
+		tokens = append(tokens, job.Token)
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	response, err := SendNotificationToMultipleTokens(ctx, tokens, job.Notification)
+	if err != nil || response == nil {
+		return err
+	}
+
+	// Retry only the devices that failed for a reason other than the app
+	// being uninstalled, so the others are not notified twice
+	var failed []string
+	var lastErr error
+	for i, result := range response.Responses {
+		if result.Success || IsUnregisteredToken(result.Error) {
+			continue
+		}
+		failed = append(failed, tokens[i])
+		lastErr = result.Error
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+
+	retry, err := json.Marshal(PushJob{Tokens: failed, Notification: job.Notification})
+	if err != nil {
+		return err
+	}
+	return RetryWith(retry, fmt.Errorf("%d of %d devices failed: %w", len(failed), len(tokens), lastErr))
+}
+
+// RegisterWebSocketJob lets workers send WebSocket messages through the hub,
+// which reaches users connected to any instance
+func RegisterWebSocketJob(hub *Hub) {
+	RegisterJobHandler(JobWebSocket, func(ctx context.Context, payload json.RawMessage) error {
+		var job WebSocketJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return Permanent(err)
+		}
+		hub.BroadcastToUser(job.UserID, job.Message)
+		return nil
+	})
+}
+
+// IsUnregisteredToken reports whether a send failed because the app was
+// uninstalled or the token expired, so the token should not be used again
+func IsUnregisteredToken(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if messaging.IsUnregistered(err) {
+			return true
+		}
+	}
+	return false
+}
@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -74,6 +76,24 @@ func GetDriverLocation(ctx context.Context, driverID uint) (lat, lng, heading fl
 	return lat, lng, heading, nil
 }
 
+// GetDriverLocationUpdatedAt returns when a driver's location was last stored in Redis
+func GetDriverLocationUpdatedAt(ctx context.Context, driverID uint) (time.Time, error) {
+	key := fmt.Sprintf("driver:location:%d", driverID)
+	data, err := RedisClient.Get(ctx, key).Result()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var locationData struct {
+		Updated int64 `json:"updated"`
+	}
+	if err := json.Unmarshal([]byte(data), &locationData); err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(locationData.Updated, 0), nil
+}
+
 // SetDriverAvailability stores driver availability status
 func SetDriverAvailability(ctx context.Context, driverID uint, isAvailable bool) error {
 	key := fmt.Sprintf("driver:availability:%d", driverID)
@@ -156,3 +176,160 @@ func PublishRideUpdate(ctx context.Context, rideID uint, status string, data map
 
 	return RedisClient.Publish(ctx, "ride:updates", jsonData).Err()
 }
+
+// activeClientTTL bounds how long a cached active ride lookup is trusted
+const activeClientTTL = 15 * time.Second
+
+// SetDriverActiveClient caches the client of a driver's active ride.
+// A clientID of 0 records that the driver has no active ride.
+func SetDriverActiveClient(ctx context.Context, driverID, clientID uint) error {
+	key := fmt.Sprintf("driver:active_client:%d", driverID)
+	return RedisClient.Set(ctx, key, clientID, activeClientTTL).Err()
+}
+
+// GetDriverActiveClient returns the cached client of a driver's active ride.
+// It returns redis.Nil when nothing is cached.
+func GetDriverActiveClient(ctx context.Context, driverID uint) (uint, error) {
+	key := fmt.Sprintf("driver:active_client:%d", driverID)
+	clientID, err := RedisClient.Get(ctx, key).Uint64()
+	if err != nil {
+		return 0, err
+	}
+	return uint(clientID), nil
+}
+
+// ClearDriverActiveClient drops the cached active ride lookup for a driver
+func ClearDriverActiveClient(ctx context.Context, driverID uint) error {
+	key := fmt.Sprintf("driver:active_client:%d", driverID)
+	return RedisClient.Del(ctx, key).Err()
+}
+
+// rideOfferTTL is how long ride offers are remembered for re-dispatch
+const rideOfferTTL = time.Hour
+
+// RecordRideOffer remembers that a pending ride was offered to a driver
+func RecordRideOffer(ctx context.Context, rideID, driverID uint) error {
+	rideKey := fmt.Sprintf("ride:offers:%d", rideID)
+	driverKey := fmt.Sprintf("driver:offers:%d", driverID)
+
+	pipe := RedisClient.TxPipeline()
+	pipe.SAdd(ctx, rideKey, driverID)
+	pipe.Expire(ctx, rideKey, rideOfferTTL)
+	pipe.SAdd(ctx, driverKey, rideID)
+	pipe.Expire(ctx, driverKey, rideOfferTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetRideOfferedDrivers returns the drivers a ride has already been offered to
+func GetRideOfferedDrivers(ctx context.Context, rideID uint) (map[uint]bool, error) {
+	members, err := RedisClient.SMembers(ctx, fmt.Sprintf("ride:offers:%d", rideID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseIDSet(members), nil
+}
+
+// TakeDriverOffers returns and forgets the rides offered to a driver
+func TakeDriverOffers(ctx context.Context, driverID uint) ([]uint, error) {
+	key := fmt.Sprintf("driver:offers:%d", driverID)
+	pipe := RedisClient.TxPipeline()
+	members := pipe.SMembers(ctx, key)
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	rideIDs := make([]uint, 0, len(members.Val()))
+	for id := range parseIDSet(members.Val()) {
+		rideIDs = append(rideIDs, id)
+	}
+	return rideIDs, nil
+}
+
+// parseIDSet converts Redis set members into a set of IDs
+func parseIDSet(members []string) map[uint]bool {
+	ids := make(map[uint]bool, len(members))
+	for _, member := range members {
+		if id, err := strconv.ParseUint(member, 10, 32); err == nil {
+			ids[uint(id)] = true
+		}
+	}
+	return ids
+}
+
+// sessionTrackingTTL keeps an abandoned session's tracking data from living forever
+const sessionTrackingTTL = 48 * time.Hour
+
+// StartSessionDistance begins accumulating the distance a driver covers
+func StartSessionDistance(ctx context.Context, driverID uint) error {
+	key := fmt.Sprintf("driver:session:%d", driverID)
+	pipe := RedisClient.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.HSet(ctx, key, "distance", 0)
+	pipe.Expire(ctx, key, sessionTrackingTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// TrackSessionDistance adds the distance from the driver's previous position
+// to the open session, if there is one
+func TrackSessionDistance(ctx context.Context, driverID uint, lat, lng float64) error {
+	key := fmt.Sprintf("driver:session:%d", driverID)
+	values, err := RedisClient.HMGet(ctx, key, "distance", "lat", "lng").Result()
+	if err != nil {
+		return err
+	}
+	if values[0] == nil {
+		return nil // no open session
+	}
+
+	pipe := RedisClient.TxPipeline()
+	if prevLat, prevLng, ok := parseCoordinates(values[1], values[2]); ok {
+		pipe.HIncrByFloat(ctx, key, "distance", utils.HaversineDistance(prevLat, prevLng, lat, lng))
+	}
+	pipe.HSet(ctx, key, "lat", lat, "lng", lng)
+	pipe.Expire(ctx, key, sessionTrackingTTL)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// GetSessionDistance returns the kilometres covered in the open session
+func GetSessionDistance(ctx context.Context, driverID uint) (float64, error) {
+	key := fmt.Sprintf("driver:session:%d", driverID)
+	return RedisClient.HGet(ctx, key, "distance").Float64()
+}
+
+// StopSessionDistance returns the kilometres covered and stops tracking
+func StopSessionDistance(ctx context.Context, driverID uint) (float64, error) {
+	key := fmt.Sprintf("driver:session:%d", driverID)
+	pipe := RedisClient.TxPipeline()
+	distance := pipe.HGet(ctx, key, "distance")
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return 0, err
+	}
+	return distance.Float64()
+}
+
+// parseCoordinates reads a lat/lng pair returned by HMGET
+func parseCoordinates(latValue, lngValue interface{}) (float64, float64, bool) {
+	latStr, ok := latValue.(string)
+	if !ok {
+		return 0, 0, false
+	}
+	lngStr, ok := lngValue.(string)
+	if !ok {
+		return 0, 0, false
+	}
+
+	lat, err := strconv.ParseFloat(latStr, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	lng, err := strconv.ParseFloat(lngStr, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return lat, lng, true
+}
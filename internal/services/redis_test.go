@@ -0,0 +1,27 @@
+package services
+
+import (
+	"os"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// testRedis is an in-memory Redis shared by the tests of this package
+var testRedis *miniredis.Miniredis
+
+func TestMain(m *testing.M) {
+	server, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	testRedis = server
+	RedisClient = redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+	code := m.Run()
+
+	RedisClient.Close()
+	server.Close()
+	os.Exit(code)
+}
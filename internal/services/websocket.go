@@ -1,12 +1,17 @@
 package services
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
 )
 
 var upgrader = websocket.Upgrader{
@@ -22,96 +27,176 @@ type Client struct {
 	Conn     *websocket.Conn
 	Send     chan []byte
 	Hub      *Hub
+	replay   [][]byte // missed events written before live messages
+	// replayedSeq is the last seq in replay; live copies of those events are skipped
+	replayedSeq uint64
+	// joined is closed once the user's channel is subscribed, when live
+	// events start to arrive
+	joined chan struct{}
+	slow   atomic.Bool
 }
 
-// Hub maintains the set of active clients and broadcasts messages
+// markSlow flags the client for removal and reports whether it was newly flagged
+func (c *Client) markSlow() bool {
+	return c.slow.CompareAndSwap(false, true)
+}
+
+// Hub maintains the set of active clients and broadcasts messages. Messages
+// are routed through Redis pub/sub so every API instance delivers them to its
+// own connected clients.
 type Hub struct {
 	clients    map[*Client]bool
+	localUsers map[uint]int // open connections per user on this instance
 	register   chan *Client
 	unregister chan *Client
-	broadcast  chan []byte
+	clusterOps chan clusterOp
+	commands   map[string]CommandHandler
 	mutex      sync.RWMutex
+	instanceID string
+	pubsub     *redis.PubSub
+	config     WebSocketConfig
+	counters   hubCounters
+	mapFeed    mapFeed
 }
 
-// NewHub creates a new WebSocket hub
+// NewHub creates a new WebSocket hub configured from the environment
 func NewHub() *Hub {
-	return &Hub{
+	return NewHubWithConfig(LoadWebSocketConfig())
+}
+
+// NewHubWithConfig creates a new WebSocket hub with explicit settings
+func NewHubWithConfig(config WebSocketConfig) *Hub {
+	h := &Hub{
 		clients:    make(map[*Client]bool),
+		localUsers: make(map[uint]int),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
-		broadcast:  make(chan []byte),
+		clusterOps: make(chan clusterOp, clusterQueueSize),
+		commands:   make(map[string]CommandHandler),
+		instanceID: newInstanceID(),
+		config:     config,
+		mapFeed:    mapFeed{subscribers: make(map[*Client]*mapSubscription)},
 	}
+	h.commands["map.subscribe"] = h.subscribeMap
+	h.commands["map.unsubscribe"] = h.unsubscribeMap
+
+	// Join before the hub is shared, so publishing never races the subscription
+	h.startCluster()
+	return h
 }
 
 // Run starts the hub
 func (h *Hub) Run() {
+	go h.flushMap()
+
 	for {
 		select {
 		case client := <-h.register:
 			h.mutex.Lock()
 			h.clients[client] = true
+			h.localUsers[client.ID]++
+			firstConnection := h.localUsers[client.ID] == 1
 			h.mutex.Unlock()
+			h.counters.connections.Add(1)
+			h.clusterOps <- clusterOp{client: client, join: true, changed: firstConnection}
 			log.Printf("Client %d connected", client.ID)
 
 		case client := <-h.unregister:
 			h.mutex.Lock()
+			removed := false
+			lastConnection := false
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.Send)
+				removed = true
+				h.localUsers[client.ID]--
+				if h.localUsers[client.ID] <= 0 {
+					delete(h.localUsers, client.ID)
+					lastConnection = true
+				}
 			}
 			h.mutex.Unlock()
-			log.Printf("Client %d disconnected", client.ID)
-
-		case message := <-h.broadcast:
-			h.mutex.RLock()
-			for client := range h.clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(h.clients, client)
-				}
+			if removed {
+				h.removeMapSubscriber(client)
+				h.clusterOps <- clusterOp{client: client, changed: lastConnection}
+				log.Printf("Client %d disconnected", client.ID)
 			}
-			h.mutex.RUnlock()
 		}
 	}
 }
 
-// BroadcastToUser sends a message to a specific user
+// trySend queues a message for a client without blocking. It must be called
+// with the hub lock held. A client whose buffer is full is handed to the hub
+// goroutine for removal, which closes its Send channel and its connection.
+func (h *Hub) trySend(client *Client, message []byte) {
+	select {
+	case client.Send <- message:
+		h.counters.messagesDelivered.Add(1)
+	default:
+		if client.markSlow() {
+			h.counters.slowClientsDropped.Add(1)
+			log.Printf("Dropping slow client %d (%s): send buffer full", client.ID, client.UserType)
+			go func() { h.unregister <- client }()
+		}
+	}
+}
+
+// BroadcastToUser sends a message to a specific user. The message is assigned
+// the user's next sequence number and stored so it can be replayed if the user
+// is offline or misses it.
 func (h *Hub) BroadcastToUser(userID uint, message []byte) {
+	ctx := context.Background()
+	stamped, _, err := AppendUserEvent(ctx, userID, message)
+	if err != nil {
+		log.Printf("Failed to store event for user %d: %v", userID, err)
+		stamped = message
+	}
+
+	h.SendTransientToUser(userID, stamped)
+}
+
+// SendTransientToUser sends a message to a specific user without storing it.
+// Use it for high-frequency updates that are useless once stale.
+func (h *Hub) SendTransientToUser(userID uint, message []byte) {
+	if err := h.publish(userChannel(userID), message); err != nil {
+		log.Printf("Failed to publish message for user %d, delivering locally: %v", userID, err)
+		h.deliverToUser(userID, message)
+	}
+}
+
+// BroadcastToUserType sends a message to all users of a specific type
+func (h *Hub) BroadcastToUserType(userType string, message []byte) {
+	if err := h.publish(roleChannel(userType), message); err != nil {
+		log.Printf("Failed to publish message for %s users, delivering locally: %v", userType, err)
+		h.deliverToUserType(userType, message)
+	}
+}
+
+// deliverToUser sends a message to a user's clients connected to this instance
+func (h *Hub) deliverToUser(userID uint, message []byte) {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
 	for client := range h.clients {
 		if client.ID == userID {
-			select {
-			case client.Send <- message:
-			default:
-				close(client.Send)
-				delete(h.clients, client)
-			}
+			h.trySend(client, message)
 		}
 	}
 }
 
-// BroadcastToUserType sends a message to all users of a specific type
-func (h *Hub) BroadcastToUserType(userType string, message []byte) {
+// deliverToUserType sends a message to clients of a user type connected to this instance
+func (h *Hub) deliverToUserType(userType string, message []byte) {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
 	for client := range h.clients {
 		if client.UserType == userType {
-			select {
-			case client.Send <- message:
-			default:
-				close(client.Send)
-				delete(h.clients, client)
-			}
+			h.trySend(client, message)
 		}
 	}
 }
 
-// GetConnectedClients returns the number of connected clients
+// GetConnectedClients returns the number of clients connected to this instance
 func (h *Hub) GetConnectedClients() int {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
@@ -122,6 +207,7 @@ func (h *Hub) GetConnectedClients() int {
 type WebSocketMessage struct {
 	Type string      `json:"type"`
 	Data interface{} `json:"data"`
+	Seq  uint64      `json:"seq,omitempty"` // per-user sequence number of stored events
 }
 
 // DriverLocationUpdate represents a driver location update
@@ -193,8 +279,15 @@ type CancelRide struct {
 	RideID uint `json:"rideId"`
 }
 
-// HandleWebSocket handles WebSocket connections
-func HandleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request, userID uint, userType string) {
+// ReplayComplete tells the client that all missed events have been sent
+type ReplayComplete struct {
+	Replayed int    `json:"replayed"`
+	LastSeq  uint64 `json:"lastSeq"`
+}
+
+// HandleWebSocket handles WebSocket connections. lastSeq is the last event
+// sequence the client has seen; pass nil to resume from the last acknowledged one.
+func HandleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request, userID uint, userType string, lastSeq *uint64) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
@@ -205,12 +298,32 @@ func HandleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request, userID ui
 		ID:       userID,
 		UserType: userType,
 		Conn:     conn,
-		Send:     make(chan []byte, 256),
+		Send:     make(chan []byte, hub.config.SendBufferSize),
 		Hub:      hub,
+		joined:   make(chan struct{}),
 	}
 
 	client.Hub.register <- client
 
+	// Load events the client missed while disconnected once live events
+	// flow, so none fall between the two. Events in both are sent once.
+	<-client.joined
+	ctx := context.Background()
+	resumeFrom := uint64(0)
+	if lastSeq != nil {
+		resumeFrom = *lastSeq
+	} else if acked, err := GetUserEventAck(ctx, userID); err == nil {
+		resumeFrom = acked
+	}
+	if events, err := GetUserEventsSince(ctx, userID, resumeFrom); err != nil {
+		log.Printf("Failed to load missed events for user %d: %v", userID, err)
+	} else {
+		client.replay = events
+		if len(events) > 0 {
+			client.replayedSeq = eventSeq(events[len(events)-1])
+		}
+	}
+
 	// Start goroutines for reading and writing
 	go client.writePump()
 	go client.readPump()
@@ -223,6 +336,13 @@ func (c *Client) readPump() {
 		c.Conn.Close()
 	}()
 
+	config := c.Hub.config
+	c.Conn.SetReadLimit(config.MaxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(config.PongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(config.PongWait))
+	})
+
 	for {
 		_, message, err := c.Conn.ReadMessage()
 		if err != nil {
@@ -233,79 +353,156 @@ func (c *Client) readPump() {
 		}
 
 		// Handle incoming messages
-		var wsMessage WebSocketMessage
-		if err := json.Unmarshal(message, &wsMessage); err != nil {
+		var frame Command
+		if err := json.Unmarshal(message, &frame); err != nil {
 			log.Printf("Error unmarshaling WebSocket message: %v", err)
 			continue
 		}
 
 		// Process different message types
-		switch wsMessage.Type {
+		switch frame.Type {
+		case "command":
+			c.dispatchCommand(frame)
 		case "request_ride":
-			// Handle ride request
-			c.handleRideRequest(wsMessage.Data)
+			// Legacy unversioned ride request
+			frame.Version = ProtocolVersion
+			frame.Action = "ride.request"
+			c.dispatchCommand(frame)
 		case "cancel_ride":
-			// Handle ride cancellation
-			c.handleRideCancellation(wsMessage.Data)
+			// Legacy unversioned ride cancellation
+			frame.Version = ProtocolVersion
+			frame.Action = "ride.cancel"
+			c.dispatchCommand(frame)
+		case "location":
+			// Driver position report: {"type":"location","data":{"lat":..,"lng":..,"heading":..}}
+			frame.Version = ProtocolVersion
+			frame.Action = "driver.location"
+			c.dispatchStream(frame)
+		case "ack":
+			// Client has processed events up to the given sequence
+			c.handleAck(frame.Data)
 		}
 	}
 }
 
 // writePump pumps messages from the hub to the websocket connection
 func (c *Client) writePump() {
-	defer c.Conn.Close()
+	config := c.Hub.config
+	ticker := time.NewTicker(config.PingInterval)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+	}()
+
+	if err := c.writeReplay(); err != nil {
+		log.Printf("WebSocket replay error: %v", err)
+		return
+	}
 
 	for {
 		select {
 		case message, ok := <-c.Send:
+			c.Conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
 			if !ok {
+				// The hub closed the channel
 				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
+			// Skip events already sent in the replay
+			if c.replayedSeq > 0 {
+				if seq := leadingSeq(message); seq > 0 && seq <= c.replayedSeq {
+					continue
+				}
+			}
+
 			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				log.Printf("WebSocket write error: %v", err)
 				return
 			}
 
-			// Log message type for debugging
-			var msg WebSocketMessage
-			if err := json.Unmarshal(message, &msg); err == nil {
-				log.Printf("[WS→] Sent to client %d (%s): %s", c.ID, c.UserType, msg.Type)
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
 			}
 		}
 	}
 }
 
-// handleRideRequest processes ride requests
-func (c *Client) handleRideRequest(data interface{}) {
-	// This would be implemented to handle ride requests
-	// For now, just log the request
-	log.Printf("Ride request from client %d: %+v", c.ID, data)
+// writeReplay writes missed events ahead of live messages and marks the end of the replay
+func (c *Client) writeReplay() error {
+	var lastSeq uint64
+	for _, message := range c.replay {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.Hub.config.WriteTimeout))
+		if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			return err
+		}
+
+		if seq := eventSeq(message); seq > lastSeq {
+			lastSeq = seq
+		}
+	}
+
+	replayed := len(c.replay)
+	c.replay = nil
+
+	data, err := json.Marshal(WebSocketMessage{
+		Type: "replay_complete",
+		Data: ReplayComplete{Replayed: replayed, LastSeq: lastSeq},
+	})
+	if err != nil {
+		return err
+	}
+
+	if replayed > 0 {
+		log.Printf("[WS→] Replayed %d missed events to client %d (%s)", replayed, c.ID, c.UserType)
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(c.Hub.config.WriteTimeout))
+	return c.Conn.WriteMessage(websocket.TextMessage, data)
 }
 
-// handleRideCancellation processes ride cancellations
-func (c *Client) handleRideCancellation(data interface{}) {
-	// This would be implemented to handle ride cancellations
-	// For now, just log the cancellation
-	log.Printf("Ride cancellation from client %d: %+v", c.ID, data)
+// eventSeq returns the seq of a stored event, or 0 for a transient message
+func eventSeq(message []byte) uint64 {
+	var envelope struct {
+		Seq uint64 `json:"seq"`
+	}
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return 0
+	}
+	return envelope.Seq
 }
 
-// SendDriverLocationUpdate sends a driver location update to all clients
-func (hub *Hub) SendDriverLocationUpdate(update DriverLocationUpdate) {
-	message := WebSocketMessage{
-		Type: "driver_location_update",
-		Data: update,
+// leadingSeq reads the seq AppendUserEvent puts first in a stored event
+// without decoding the rest of the message. It returns 0 for other messages.
+func leadingSeq(message []byte) uint64 {
+	prefix := []byte(`{"seq":`)
+	if !bytes.HasPrefix(message, prefix) {
+		return 0
 	}
+	var seq uint64
+	for _, b := range message[len(prefix):] {
+		if b < '0' || b > '9' {
+			break
+		}
+		seq = seq*10 + uint64(b-'0')
+	}
+	return seq
+}
 
-	data, err := json.Marshal(message)
-	if err != nil {
-		log.Printf("Error marshaling driver location update: %v", err)
+// handleAck records the highest event sequence the client has processed
+func (c *Client) handleAck(data json.RawMessage) {
+	var payload struct {
+		Seq uint64 `json:"seq"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil || payload.Seq < 1 {
+		log.Printf("Invalid ack from client %d: %s", c.ID, data)
 		return
 	}
 
-	// Broadcast to all connected clients using the safe method
-	hub.BroadcastToAll(data)
+	if err := AckUserEvents(context.Background(), c.ID, payload.Seq); err != nil {
+		log.Printf("Failed to store ack for client %d: %v", c.ID, err)
+	}
 }
 
 // SendDriverLocationUpdateToClient sends a driver location update to a specific client
@@ -321,25 +518,26 @@ func (hub *Hub) SendDriverLocationUpdateToClient(clientID uint, update DriverLoc
 		return
 	}
 
-	hub.BroadcastToUser(clientID, data)
-	log.Printf("Sent driver location update to client %d: driver %d at (%.6f, %.6f)",
-		clientID, update.DriverID, update.Location.Lat, update.Location.Lng)
+	// Location updates are superseded by the next one, so they are not stored for replay
+	hub.SendTransientToUser(clientID, data)
 }
 
 // BroadcastToAll sends a message to all connected clients
 func (hub *Hub) BroadcastToAll(message []byte) {
+	if err := hub.publish(allChannel, message); err != nil {
+		log.Printf("Failed to publish broadcast, delivering locally: %v", err)
+		hub.deliverToAll(message)
+	}
+}
+
+// deliverToAll sends a message to all clients connected to this instance
+func (hub *Hub) deliverToAll(message []byte) {
 	hub.mutex.RLock()
 	defer hub.mutex.RUnlock()
 
 	log.Printf("Broadcasting to %d connected clients", len(hub.clients))
 	for client := range hub.clients {
-		select {
-		case client.Send <- message:
-			// Message sent successfully
-		default:
-			// Client's send channel is full, skip
-			log.Printf("Warning: Could not send to client %d (channel full)", client.ID)
-		}
+		hub.trySend(client, message)
 	}
 }
 
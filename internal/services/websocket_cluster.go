@@ -0,0 +1,253 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// allChannel carries messages for every connected client
+	allChannel = "ws:all"
+	// presenceTTL is how long presence survives without an instance heartbeat
+	presenceTTL = 90 * time.Second
+	// presenceHeartbeat is how often an instance refreshes presence of its clients
+	presenceHeartbeat = 30 * time.Second
+	// clusterOpTimeout bounds each Redis call made by the cluster worker
+	clusterOpTimeout = 2 * time.Second
+	// clusterQueueSize is how many joins and leaves can wait for the cluster
+	// worker before the hub goroutine blocks on it
+	clusterQueueSize = 1024
+)
+
+// clusterOp is a connection or disconnection to record in Redis
+type clusterOp struct {
+	client *Client
+	join   bool
+	// changed is set on a user's first local connection when joining and on
+	// their last when leaving, which is when their channel is (un)subscribed
+	changed bool
+}
+
+func userChannel(userID uint) string {
+	return fmt.Sprintf("ws:user:%d", userID)
+}
+
+func roleChannel(userType string) string {
+	return fmt.Sprintf("ws:role:%s", userType)
+}
+
+func presenceKey(userID uint) string {
+	return fmt.Sprintf("ws:presence:%d", userID)
+}
+
+func onlineUsersKey(userType string) string {
+	return fmt.Sprintf("ws:online:%s", userType)
+}
+
+// newInstanceID identifies this API instance in the presence registry
+func newInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// startCluster subscribes to the shared channels and starts delivering
+// messages published by any instance to the clients connected here
+func (h *Hub) startCluster() {
+	ctx := context.Background()
+
+	h.pubsub = RedisClient.Subscribe(ctx,
+		allChannel,
+		mapDriversChannel,
+		roleChannel("client"),
+		roleChannel("driver"),
+	)
+	if _, err := h.pubsub.Receive(ctx); err != nil {
+		log.Printf("Failed to subscribe hub %s to Redis: %v", h.instanceID, err)
+	}
+
+	go h.receiveCluster()
+	go h.runClusterOps()
+	go h.heartbeatPresence()
+
+	log.Printf("WebSocket hub %s joined cluster", h.instanceID)
+}
+
+// receiveCluster delivers published messages to local clients
+func (h *Hub) receiveCluster() {
+	for msg := range h.pubsub.Channel() {
+		message := []byte(msg.Payload)
+
+		switch {
+		case msg.Channel == allChannel:
+			h.deliverToAll(message)
+		case msg.Channel == mapDriversChannel:
+			h.receiveMapDriver(msg.Payload)
+		case strings.HasPrefix(msg.Channel, "ws:role:"):
+			h.deliverToUserType(strings.TrimPrefix(msg.Channel, "ws:role:"), message)
+		case strings.HasPrefix(msg.Channel, "ws:user:"):
+			userID, err := strconv.ParseUint(strings.TrimPrefix(msg.Channel, "ws:user:"), 10, 32)
+			if err != nil {
+				log.Printf("Invalid user channel %s: %v", msg.Channel, err)
+				continue
+			}
+			h.deliverToUser(uint(userID), message)
+		}
+	}
+}
+
+// publish sends a message to every instance subscribed to the channel
+func (h *Hub) publish(channel string, message []byte) error {
+	if h.pubsub == nil {
+		return fmt.Errorf("hub is not connected to the cluster")
+	}
+	return RedisClient.Publish(context.Background(), channel, message).Err()
+}
+
+// runClusterOps applies joins and leaves in the order the hub saw them, so
+// a slow Redis delays presence instead of every register and broadcast
+func (h *Hub) runClusterOps() {
+	for op := range h.clusterOps {
+		if op.join {
+			h.joinCluster(op.client, op.changed)
+		} else {
+			h.leaveCluster(op.client, op.changed)
+		}
+	}
+}
+
+// joinCluster subscribes to a user's channel on their first local connection
+// and records them in the presence registry
+func (h *Hub) joinCluster(client *Client, firstConnection bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterOpTimeout)
+	defer cancel()
+
+	if firstConnection && h.pubsub != nil {
+		if err := h.pubsub.Subscribe(ctx, userChannel(client.ID)); err != nil {
+			log.Printf("Failed to subscribe to channel for user %d: %v", client.ID, err)
+		}
+	}
+	// Later connections of the user were queued behind the first one's subscription
+	if client.joined != nil {
+		close(client.joined)
+	}
+
+	key := presenceKey(client.ID)
+	pipe := RedisClient.TxPipeline()
+	pipe.HIncrBy(ctx, key, h.instanceID, 1)
+	pipe.Expire(ctx, key, presenceTTL)
+	pipe.ZAdd(ctx, onlineUsersKey(client.UserType), redis.Z{
+		Score:  float64(time.Now().Unix()),
+		Member: client.ID,
+	})
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record presence for user %d: %v", client.ID, err)
+	}
+}
+
+// leaveCluster drops a user's channel after their last local connection
+// closes and removes them from presence once no instance holds them
+func (h *Hub) leaveCluster(client *Client, lastConnection bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterOpTimeout)
+	defer cancel()
+
+	if lastConnection && h.pubsub != nil {
+		if err := h.pubsub.Unsubscribe(ctx, userChannel(client.ID)); err != nil {
+			log.Printf("Failed to unsubscribe from channel for user %d: %v", client.ID, err)
+		}
+	}
+
+	key := presenceKey(client.ID)
+	remaining, err := RedisClient.HIncrBy(ctx, key, h.instanceID, -1).Result()
+	if err != nil {
+		log.Printf("Failed to update presence for user %d: %v", client.ID, err)
+		return
+	}
+	if remaining > 0 {
+		return
+	}
+
+	RedisClient.HDel(ctx, key, h.instanceID)
+	if connections, err := RedisClient.HLen(ctx, key).Result(); err == nil && connections == 0 {
+		RedisClient.ZRem(ctx, onlineUsersKey(client.UserType), client.ID)
+	}
+}
+
+// heartbeatPresence keeps presence of locally connected users from expiring
+// and prunes users whose instance stopped heartbeating
+func (h *Hub) heartbeatPresence() {
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.mutex.RLock()
+		userTypes := make(map[uint]string, len(h.localUsers))
+		for client := range h.clients {
+			userTypes[client.ID] = client.UserType
+		}
+		h.mutex.RUnlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), clusterOpTimeout)
+		now := float64(time.Now().Unix())
+		pipe := RedisClient.Pipeline()
+		for userID, userType := range userTypes {
+			pipe.Expire(ctx, presenceKey(userID), presenceTTL)
+			pipe.ZAdd(ctx, onlineUsersKey(userType), redis.Z{Score: now, Member: userID})
+		}
+		stale := strconv.FormatInt(time.Now().Add(-presenceTTL).Unix(), 10)
+		for _, userType := range []string{"client", "driver"} {
+			pipe.ZRemRangeByScore(ctx, onlineUsersKey(userType), "-inf", "("+stale)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("Failed to refresh presence for hub %s: %v", h.instanceID, err)
+		}
+		cancel()
+	}
+}
+
+// IsUserConnected reports whether a user has an open WebSocket on any instance
+func IsUserConnected(ctx context.Context, userID uint) (bool, error) {
+	count, err := RedisClient.Exists(ctx, presenceKey(userID)).Result()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// GetConnectedUserIDs returns users of a type connected to any instance
+func GetConnectedUserIDs(ctx context.Context, userType string) ([]uint, error) {
+	stale := strconv.FormatInt(time.Now().Add(-presenceTTL).Unix(), 10)
+	members, err := RedisClient.ZRangeByScore(ctx, onlineUsersKey(userType), &redis.ZRangeBy{
+		Min: stale,
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	userIDs := make([]uint, 0, len(members))
+	for _, member := range members {
+		userID, err := strconv.ParseUint(member, 10, 32)
+		if err != nil {
+			continue
+		}
+		userIDs = append(userIDs, uint(userID))
+	}
+	return userIDs, nil
+}
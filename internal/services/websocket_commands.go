@@ -0,0 +1,152 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+// ProtocolVersion is the current version of the WebSocket command protocol
+const ProtocolVersion = 1
+
+// Command is a request sent by a client over the WebSocket:
+//
+//	{"type":"command","v":1,"id":"c-42","action":"ride.accept","data":{"rideId":7}}
+//
+// The id is chosen by the client and echoed in the response so it can be
+// matched to the request.
+type Command struct {
+	Type    string          `json:"type"`
+	Version int             `json:"v"`
+	ID      string          `json:"id"`
+	Action  string          `json:"action"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// CommandResult is sent back as a "command_result" message when a command succeeds
+type CommandResult struct {
+	Version int         `json:"v"`
+	ID      string      `json:"id"`
+	Action  string      `json:"action"`
+	Result  interface{} `json:"result"`
+}
+
+// CommandFailure is sent back as a "command_error" message when a command fails
+type CommandFailure struct {
+	Version int           `json:"v"`
+	ID      string        `json:"id"`
+	Action  string        `json:"action"`
+	Error   *CommandError `json:"error"`
+}
+
+// CommandError describes why a command failed. Status mirrors the HTTP status
+// the equivalent REST endpoint would return.
+type CommandError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *CommandError) Error() string {
+	return e.Message
+}
+
+// CommandHandler executes a command on behalf of the connected client and
+// returns the result to send back
+type CommandHandler func(client *Client, command Command) (interface{}, error)
+
+// HandleCommand registers the handler for a command action
+func (h *Hub) HandleCommand(action string, handler CommandHandler) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.commands[action] = handler
+}
+
+// dispatchCommand runs a command and replies to the client that sent it
+func (c *Client) dispatchCommand(command Command) {
+	result, cmdErr := c.runCommand(command)
+	if cmdErr != nil {
+		c.replyError(command, cmdErr)
+		return
+	}
+
+	c.reply(WebSocketMessage{
+		Type: "command_result",
+		Data: CommandResult{
+			Version: ProtocolVersion,
+			ID:      command.ID,
+			Action:  command.Action,
+			Result:  result,
+		},
+	})
+}
+
+// dispatchStream runs a high-frequency frame such as a location report.
+// Nothing is sent back unless the frame is rejected.
+func (c *Client) dispatchStream(command Command) {
+	if _, cmdErr := c.runCommand(command); cmdErr != nil {
+		c.replyError(command, cmdErr)
+	}
+}
+
+// runCommand looks up and executes the handler for a command
+func (c *Client) runCommand(command Command) (interface{}, *CommandError) {
+	if command.Version != ProtocolVersion {
+		return nil, &CommandError{
+			Status:  400,
+			Code:    "unsupported_version",
+			Message: "Unsupported protocol version",
+		}
+	}
+
+	c.Hub.mutex.RLock()
+	handler, ok := c.Hub.commands[command.Action]
+	c.Hub.mutex.RUnlock()
+	if !ok {
+		return nil, &CommandError{
+			Status:  400,
+			Code:    "unknown_action",
+			Message: "Unknown action: " + command.Action,
+		}
+	}
+
+	result, err := handler(c, command)
+	if err != nil {
+		var cmdErr *CommandError
+		if !errors.As(err, &cmdErr) {
+			log.Printf("Command %s from client %d failed: %v", command.Action, c.ID, err)
+			cmdErr = &CommandError{Status: 500, Code: "internal_error", Message: "Internal server error"}
+		}
+		return nil, cmdErr
+	}
+
+	return result, nil
+}
+
+// replyError sends a command_error response to the client
+func (c *Client) replyError(command Command, cmdErr *CommandError) {
+	c.reply(WebSocketMessage{
+		Type: "command_error",
+		Data: CommandFailure{
+			Version: ProtocolVersion,
+			ID:      command.ID,
+			Action:  command.Action,
+			Error:   cmdErr,
+		},
+	})
+}
+
+// reply sends a message to this connection only
+func (c *Client) reply(message WebSocketMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling command response: %v", err)
+		return
+	}
+
+	c.Hub.mutex.RLock()
+	defer c.Hub.mutex.RUnlock()
+	if c.Hub.clients[c] {
+		c.Hub.trySend(c, data)
+	}
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+)
+
+// WebSocketConfig holds keepalive and limit settings for WebSocket connections
+type WebSocketConfig struct {
+	PongWait          time.Duration // time allowed to read the next pong from the peer
+	PingInterval      time.Duration // how often pings are sent; must be less than PongWait
+	WriteTimeout      time.Duration // time allowed to write a message to the peer
+	MaxMessageSize    int64         // largest message accepted from the peer, in bytes
+	SendBufferSize    int           // messages queued per client before it counts as slow
+	MapUpdateInterval time.Duration // minimum time between driver map updates to a subscriber
+	MapTokenSecret    string        // keys the anonymous driver IDs shown on the map
+}
+
+// LoadWebSocketConfig reads WebSocket settings from the environment,
+// falling back to defaults for anything unset or invalid. The map token
+// secret falls back to JWT_SECRET and has no default.
+func LoadWebSocketConfig() WebSocketConfig {
+	config := WebSocketConfig{
+		PongWait:          utils.EnvDuration("WS_PONG_WAIT", 60*time.Second),
+		WriteTimeout:      utils.EnvDuration("WS_WRITE_TIMEOUT", 10*time.Second),
+		MaxMessageSize:    int64(utils.EnvInt("WS_MAX_MESSAGE_SIZE", 16*1024)),
+		SendBufferSize:    utils.EnvInt("WS_SEND_BUFFER_SIZE", 256),
+		MapUpdateInterval: utils.EnvDuration("WS_MAP_UPDATE_INTERVAL", 2*time.Second),
+		MapTokenSecret:    os.Getenv("MAP_TOKEN_SECRET"),
+	}
+
+	if config.MapTokenSecret == "" {
+		config.MapTokenSecret = os.Getenv("JWT_SECRET")
+	}
+
+	config.PingInterval = utils.EnvDuration("WS_PING_INTERVAL", config.PongWait*9/10)
+	if config.PingInterval >= config.PongWait {
+		log.Printf("Warning: WS_PING_INTERVAL must be less than WS_PONG_WAIT, using %s", config.PongWait*9/10)
+		config.PingInterval = config.PongWait * 9 / 10
+	}
+
+	return config
+}
+
+// HubStats reports WebSocket connections and delivery counters for this instance
+type HubStats struct {
+	InstanceID         string         `json:"instanceId"`
+	ConnectedClients   int            `json:"connectedClients"`
+	ConnectedUsers     int            `json:"connectedUsers"`
+	ClientsByUserType  map[string]int `json:"clientsByUserType"`
+	TotalConnections   uint64         `json:"totalConnections"`
+	MessagesDelivered  uint64         `json:"messagesDelivered"`
+	SlowClientsDropped uint64         `json:"slowClientsDropped"`
+	MapSubscribers     int            `json:"mapSubscribers"`
+}
+
+// hubCounters are cumulative counters updated outside the hub lock
+type hubCounters struct {
+	connections        atomic.Uint64
+	messagesDelivered  atomic.Uint64
+	slowClientsDropped atomic.Uint64
+}
+
+// Stats returns a snapshot of this instance's WebSocket metrics
+func (h *Hub) Stats() HubStats {
+	h.mapFeed.mutex.Lock()
+	mapSubscribers := len(h.mapFeed.subscribers)
+	h.mapFeed.mutex.Unlock()
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	byType := make(map[string]int)
+	for client := range h.clients {
+		byType[client.UserType]++
+	}
+
+	return HubStats{
+		InstanceID:         h.instanceID,
+		ConnectedClients:   len(h.clients),
+		ConnectedUsers:     len(h.localUsers),
+		ClientsByUserType:  byType,
+		TotalConnections:   h.counters.connections.Load(),
+		MessagesDelivered:  h.counters.messagesDelivered.Load(),
+		SlowClientsDropped: h.counters.slowClientsDropped.Load(),
+		MapSubscribers:     mapSubscribers,
+	}
+}
@@ -0,0 +1,247 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/chachabrian/mooveit-backend/pkg/utils"
+)
+
+const (
+	// mapDriversChannel carries position changes of available drivers
+	mapDriversChannel = "ws:map:drivers"
+	// mapCoordinatePrecision rounds map positions to 3 decimals (about 110m)
+	mapCoordinatePrecision = 1000
+	// maxViewportSpan is the largest viewport side accepted, in degrees
+	maxViewportSpan = 1.0
+	// maxViewportRadius is the largest radius accepted for a centered viewport, in km
+	maxViewportRadius = 50.0
+)
+
+// MapDriver is the anonymised position of an available driver shown on a
+// client's map. The ID is an opaque token that changes daily and cannot be
+// mapped back to the driver.
+type MapDriver struct {
+	ID        string  `json:"id"`
+	Lat       float64 `json:"lat"`
+	Lng       float64 `json:"lng"`
+	Available bool    `json:"available"` // false means the marker should be removed
+}
+
+// MapDrivers is sent as a "map_drivers" message with the markers that changed
+// inside a subscriber's viewport since the previous update
+type MapDrivers struct {
+	Drivers []MapDriver `json:"drivers"`
+}
+
+// mapSubscription is a client's viewport and the changes waiting to be sent
+type mapSubscription struct {
+	viewport utils.BoundingBox
+	visible  map[string]MapDriver // markers the client currently shows
+	pending  map[string]MapDriver
+}
+
+// mapFeed tracks the viewport subscriptions of clients on this instance
+type mapFeed struct {
+	mutex       sync.Mutex
+	subscribers map[*Client]*mapSubscription
+}
+
+// mapSubscribeInput selects a viewport either as a bounding box or as a
+// center point and radius
+type mapSubscribeInput struct {
+	NorthEast *utils.Point `json:"northEast"`
+	SouthWest *utils.Point `json:"southWest"`
+	Center    *utils.Point `json:"center"`
+	RadiusKm  float64      `json:"radiusKm"`
+}
+
+// viewport validates the input and returns the bounding box it describes
+func (input mapSubscribeInput) viewport() (utils.BoundingBox, error) {
+	var bbox utils.BoundingBox
+	switch {
+	case input.NorthEast != nil && input.SouthWest != nil:
+		bbox = utils.BoundingBox{NorthEast: *input.NorthEast, SouthWest: *input.SouthWest}
+	case input.Center != nil:
+		if input.RadiusKm <= 0 || input.RadiusKm > maxViewportRadius {
+			return bbox, fmt.Errorf("radiusKm must be between 0 and %.0f", maxViewportRadius)
+		}
+		bbox = utils.GetBoundingBox(input.Center.Lat, input.Center.Lng, input.RadiusKm)
+	default:
+		return bbox, fmt.Errorf("a bounding box or a center and radius is required")
+	}
+
+	if bbox.SouthWest.Lat > bbox.NorthEast.Lat || bbox.SouthWest.Lng > bbox.NorthEast.Lng {
+		return bbox, fmt.Errorf("southWest must be below and left of northEast")
+	}
+	if bbox.NorthEast.Lat-bbox.SouthWest.Lat > maxViewportSpan || bbox.NorthEast.Lng-bbox.SouthWest.Lng > maxViewportSpan {
+		return bbox, fmt.Errorf("viewport is too large")
+	}
+	return bbox, nil
+}
+
+// subscribeMap handles the "map.subscribe" command. Calling it again moves
+// the viewport; markers that fall outside the new one are removed.
+func (h *Hub) subscribeMap(client *Client, command Command) (interface{}, error) {
+	if client.UserType != "client" {
+		return nil, &CommandError{Status: 403, Code: "forbidden", Message: "Only clients can subscribe to the driver map"}
+	}
+
+	var input mapSubscribeInput
+	if err := json.Unmarshal(command.Data, &input); err != nil {
+		return nil, &CommandError{Status: 400, Code: "bad_request", Message: "Invalid command data"}
+	}
+	viewport, err := input.viewport()
+	if err != nil {
+		return nil, &CommandError{Status: 400, Code: "bad_request", Message: err.Error()}
+	}
+
+	h.mapFeed.mutex.Lock()
+	subscription, ok := h.mapFeed.subscribers[client]
+	if !ok {
+		subscription = &mapSubscription{
+			visible: make(map[string]MapDriver),
+			pending: make(map[string]MapDriver),
+		}
+		h.mapFeed.subscribers[client] = subscription
+	}
+	subscription.viewport = viewport
+	for id, driver := range subscription.visible {
+		if !utils.IsPointInBoundingBox(utils.Point{Lat: driver.Lat, Lng: driver.Lng}, viewport) {
+			delete(subscription.visible, id)
+			subscription.pending[id] = MapDriver{ID: id}
+		}
+	}
+	h.mapFeed.mutex.Unlock()
+
+	return map[string]interface{}{
+		"viewport":       viewport,
+		"updateInterval": h.config.MapUpdateInterval.Seconds(),
+	}, nil
+}
+
+// unsubscribeMap handles the "map.unsubscribe" command
+func (h *Hub) unsubscribeMap(client *Client, command Command) (interface{}, error) {
+	h.removeMapSubscriber(client)
+	return map[string]interface{}{"subscribed": false}, nil
+}
+
+// removeMapSubscriber drops a client's viewport subscription
+func (h *Hub) removeMapSubscriber(client *Client) {
+	h.mapFeed.mutex.Lock()
+	delete(h.mapFeed.subscribers, client)
+	h.mapFeed.mutex.Unlock()
+}
+
+// PublishMapDriver shares a driver's coarse position with map subscribers on
+// every instance. Pass available=false when the driver stops taking rides so
+// the marker is removed.
+func (h *Hub) PublishMapDriver(driverID uint, lat, lng float64, available bool) {
+	driver := MapDriver{
+		ID:        h.mapDriverToken(driverID, time.Now()),
+		Lat:       math.Round(lat*mapCoordinatePrecision) / mapCoordinatePrecision,
+		Lng:       math.Round(lng*mapCoordinatePrecision) / mapCoordinatePrecision,
+		Available: available,
+	}
+
+	data, err := json.Marshal(driver)
+	if err != nil {
+		log.Printf("Error marshaling map driver: %v", err)
+		return
+	}
+
+	if err := h.publish(mapDriversChannel, data); err != nil {
+		log.Printf("Failed to publish map driver, queueing locally: %v", err)
+		h.queueMapDriver(driver)
+	}
+}
+
+// queueMapDriver records a marker change for each subscriber it concerns
+func (h *Hub) queueMapDriver(driver MapDriver) {
+	point := utils.Point{Lat: driver.Lat, Lng: driver.Lng}
+
+	h.mapFeed.mutex.Lock()
+	defer h.mapFeed.mutex.Unlock()
+
+	for _, subscription := range h.mapFeed.subscribers {
+		if driver.Available && utils.IsPointInBoundingBox(point, subscription.viewport) {
+			subscription.visible[driver.ID] = driver
+			subscription.pending[driver.ID] = driver
+		} else if _, ok := subscription.visible[driver.ID]; ok {
+			delete(subscription.visible, driver.ID)
+			subscription.pending[driver.ID] = MapDriver{ID: driver.ID}
+		}
+	}
+}
+
+// flushMap sends each subscriber its pending marker changes at most once per
+// MapUpdateInterval, so busy areas cannot flood a client
+func (h *Hub) flushMap() {
+	ticker := time.NewTicker(h.config.MapUpdateInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		messages := make(map[*Client][]byte)
+
+		h.mapFeed.mutex.Lock()
+		for client, subscription := range h.mapFeed.subscribers {
+			if len(subscription.pending) == 0 {
+				continue
+			}
+
+			drivers := make([]MapDriver, 0, len(subscription.pending))
+			for _, driver := range subscription.pending {
+				drivers = append(drivers, driver)
+			}
+			subscription.pending = make(map[string]MapDriver)
+
+			data, err := json.Marshal(WebSocketMessage{
+				Type: "map_drivers",
+				Data: MapDrivers{Drivers: drivers},
+			})
+			if err != nil {
+				log.Printf("Error marshaling map drivers: %v", err)
+				continue
+			}
+			messages[client] = data
+		}
+		h.mapFeed.mutex.Unlock()
+
+		if len(messages) == 0 {
+			continue
+		}
+
+		h.mutex.RLock()
+		for client, data := range messages {
+			if h.clients[client] {
+				h.trySend(client, data)
+			}
+		}
+		h.mutex.RUnlock()
+	}
+}
+
+// receiveMapDriver decodes a marker change published by any instance
+func (h *Hub) receiveMapDriver(payload string) {
+	var driver MapDriver
+	if err := json.Unmarshal([]byte(payload), &driver); err != nil {
+		log.Printf("Invalid map driver message: %v", err)
+		return
+	}
+	h.queueMapDriver(driver)
+}
+
+// mapDriverToken derives the anonymous marker ID for a driver. It is stable
+// for a day so clients can animate markers, then rotates.
+func (h *Hub) mapDriverToken(driverID uint, now time.Time) string {
+	mac := hmac.New(sha256.New, []byte(h.config.MapTokenSecret))
+	fmt.Fprintf(mac, "%s:%d", now.UTC().Format("2006-01-02"), driverID)
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
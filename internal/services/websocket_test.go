@@ -0,0 +1,223 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestHub runs a hub against test Redis. Hubs run until the test
+// binary exits, so each test uses its own user IDs.
+func startTestHub(t *testing.T, sendBufferSize int) *Hub {
+	t.Helper()
+
+	config := LoadWebSocketConfig()
+	config.SendBufferSize = sendBufferSize
+	hub := NewHubWithConfig(config)
+	go hub.Run()
+	return hub
+}
+
+// newTestClient creates a client without a connection; tests read its Send channel
+func newTestClient(hub *Hub, userID uint, userType string) *Client {
+	return &Client{
+		ID:       userID,
+		UserType: userType,
+		Send:     make(chan []byte, hub.config.SendBufferSize),
+		Hub:      hub,
+		joined:   make(chan struct{}),
+	}
+}
+
+// waitFor polls until the condition holds or the test times out
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitJoined waits until the hub has subscribed to a client's user channel
+func waitJoined(t *testing.T, client *Client) {
+	t.Helper()
+
+	select {
+	case <-client.joined:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client of user %d never joined", client.ID)
+	}
+}
+
+// drain reads a client's messages until the hub closes its Send channel
+func drain(client *Client) <-chan [][]byte {
+	done := make(chan [][]byte, 1)
+	go func() {
+		var received [][]byte
+		for message := range client.Send {
+			received = append(received, message)
+		}
+		done <- received
+	}()
+	return done
+}
+
+func TestHubConcurrentConnectBroadcastDisconnect(t *testing.T) {
+	// Large enough that no client is dropped as slow
+	hub := startTestHub(t, 1024)
+
+	const users = 20
+	const connectionsPerUser = 3
+
+	var clients []*Client
+	var drained []<-chan [][]byte
+	for userID := uint(1); userID <= users; userID++ {
+		for i := 0; i < connectionsPerUser; i++ {
+			client := newTestClient(hub, userID, "client")
+			clients = append(clients, client)
+			drained = append(drained, drain(client))
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Client) {
+			defer wg.Done()
+			hub.register <- client
+		}(client)
+	}
+	for userID := uint(1); userID <= users; userID++ {
+		wg.Add(1)
+		go func(userID uint) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				hub.BroadcastToUser(userID, []byte(`{"type":"test","data":null}`))
+				hub.BroadcastToUserType("client", []byte(`{"type":"role","data":null}`))
+				hub.GetConnectedClients()
+				hub.Stats()
+			}
+		}(userID)
+	}
+	wg.Wait()
+
+	waitFor(t, "all clients to register", func() bool {
+		return hub.GetConnectedClients() == len(clients)
+	})
+
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Client) {
+			defer wg.Done()
+			hub.unregister <- client
+		}(client)
+	}
+	wg.Wait()
+
+	waitFor(t, "all clients to unregister", func() bool {
+		return hub.GetConnectedClients() == 0
+	})
+	for _, done := range drained {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("hub did not close the Send channel of an unregistered client")
+		}
+	}
+	if stats := hub.Stats(); stats.ConnectedUsers != 0 {
+		t.Fatalf("connected users = %d after every client left, want 0", stats.ConnectedUsers)
+	}
+}
+
+func TestHubEvictsSlowClient(t *testing.T) {
+	hub := startTestHub(t, 4)
+
+	slow := newTestClient(hub, 101, "driver")
+	hub.register <- slow
+	waitJoined(t, slow)
+
+	// Nobody reads the slow client's buffer, so it fills and overflows
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < hub.config.SendBufferSize; j++ {
+				hub.deliverToUser(slow.ID, []byte(`{"type":"test","data":null}`))
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitFor(t, "the slow client to be removed", func() bool {
+		return hub.GetConnectedClients() == 0
+	})
+	if dropped := hub.Stats().SlowClientsDropped; dropped != 1 {
+		t.Fatalf("slow clients dropped = %d, want 1", dropped)
+	}
+
+	received := 0
+	for range slow.Send {
+		received++
+	}
+	if received != hub.config.SendBufferSize {
+		t.Fatalf("slow client received %d messages, want its buffer of %d", received, hub.config.SendBufferSize)
+	}
+}
+
+func TestBroadcastToUserReachesEveryConnectionOfTheUser(t *testing.T) {
+	hub := startTestHub(t, 4)
+
+	phone := newTestClient(hub, 201, "client")
+	tablet := newTestClient(hub, 201, "client")
+	other := newTestClient(hub, 202, "client")
+	for _, client := range []*Client{phone, tablet, other} {
+		hub.register <- client
+		waitJoined(t, client)
+	}
+
+	hub.BroadcastToUser(201, []byte(`{"type":"booking_status","data":{"status":"accepted"}}`))
+
+	for name, client := range map[string]*Client{"phone": phone, "tablet": tablet} {
+		select {
+		case message := <-client.Send:
+			var msg WebSocketMessage
+			if err := json.Unmarshal(message, &msg); err != nil {
+				t.Fatalf("%s received invalid JSON %s: %v", name, message, err)
+			}
+			if msg.Type != "booking_status" || msg.Seq == 0 {
+				t.Fatalf("%s received type %q seq %d, want a stored booking_status", name, msg.Type, msg.Seq)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s did not receive the message", name)
+		}
+	}
+
+	select {
+	case message := <-other.Send:
+		t.Fatalf("another user received %s", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLeadingSeqReadsStoredEvents(t *testing.T) {
+	resetUserEvents(401)
+	stamped, seq, err := AppendUserEvent(context.Background(), 401, []byte(`{"type":"booking_status","data":{"seq":99}}`))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if got := leadingSeq(stamped); got != seq {
+		t.Errorf("leadingSeq(%s) = %d, want %d", stamped, got, seq)
+	}
+
+	// Transient messages carry no seq, even when their data has one
+	if got := leadingSeq([]byte(`{"type":"driver_location_update","data":{"seq":5}}`)); got != 0 {
+		t.Errorf("leadingSeq of a transient message = %d, want 0", got)
+	}
+}
@@ -17,34 +17,8 @@ var (
 	baseURL       = os.Getenv("BASE_URL")
 )
 
-// Common header template for all emails
-const emailHeader = `
-<!DOCTYPE html>
-<html>
-<head>
-	<meta charset="UTF-8">
-	<meta name="viewport" content="width=device-width, initial-scale=1.0">
-</head>
-<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333; margin: 0; padding: 0;">
-	<div style="max-width: 600px; margin: 0 auto; padding: 20px;">
-		<div style="text-align: center; margin-bottom: 30px; background-color: #f9f9f9; padding: 20px;">
-			<!-- <img src="%s/static/images/logo.png" alt="MooveIt" style="width: 200px; height: auto;"> -->
-			<h2 style="color: #4CAF50; margin: 0;">MooveIt</h2>
-		</div>
-`
-
-// Common footer template for all emails
-const emailFooter = `
-		<div style="text-align: center; margin-top: 20px; font-size: 12px; color: #666; border-top: 1px solid #eee; padding-top: 20px;">
-			<p>This is an automated message, please do not reply to this email.</p>
-			<p>© 2025 MooveIt Limited. All rights reserved.</p>
-		</div>
-	</div>
-</body>
-</html>
-`
-
-func sendEmail(to []string, subject, body string) error {
+// SendEmail sends an HTML email through the configured SMTP server
+func SendEmail(to []string, subject, body string) error {
 	if emailFrom == "" || emailPassword == "" || smtpHost == "" || smtpPort == "" {
 		return fmt.Errorf("email configuration not set")
 	}
@@ -82,116 +56,34 @@ func sendEmail(to []string, subject, body string) error {
 	return nil
 }
 
-func SendNewBookingNotificationEmailToDriver(driverEmail, destination, clientName string) error {
-	subject := "New Booking Request - MooveIt"
-	body := fmt.Sprintf(emailHeader+`
-				<div style="background-color: #f9f9f9; padding: 20px; border-radius: 5px;">
-					<h1 style="color: #2c3e50; text-align: center;">New Booking Request</h1>
-					<p>Hello,</p>
-					<p>You have received a new booking request for your ride to <strong>%s</strong> from <strong>%s</strong>.</p>
-					<p>Please log in to your MooveIt account to accept or reject this booking.</p>
-					<div style="text-align: center; margin: 30px 0;">
-						<a href="%s/login" style="background-color: #4CAF50; color: white; padding: 12px 25px; text-decoration: none; border-radius: 5px;">Login to MooveIt</a>
-					</div>
-					<p>Best regards,<br>The MooveIt Team</p>
-				</div>`+emailFooter,
-		baseURL, destination, clientName, baseURL)
-
-	return sendEmail([]string{driverEmail}, subject, body)
-}
-
-func SendBookingAcceptedEmail(clientEmail, driverName, carPlate, receiverEmail, receiverName string) error {
-	// Email to client
-	clientSubject := "Booking Accepted - MooveIt"
-	clientBody := fmt.Sprintf(emailHeader+`
-				<div style="background-color: #f9f9f9; padding: 20px; border-radius: 5px;">
-					<h1 style="color: #2c3e50; text-align: center;">Booking Accepted</h1>
-					<p>Hello,</p>
-					<p>Great news! Your booking has been accepted by driver <strong>%s</strong> (Car: <strong>%s</strong>).</p>
-					<p>Your parcel is now ready for delivery. You will receive updates about your delivery status.</p>
-					<div style="text-align: center; margin: 30px 0;">
-						<a href="%s/tracking" style="background-color: #4CAF50; color: white; padding: 12px 25px; text-decoration: none; border-radius: 5px;">Track Your Parcel</a>
-					</div>
-					<p>Best regards,<br>The MooveIt Team</p>
-				</div>`+emailFooter,
-		baseURL, driverName, carPlate, baseURL)
-
-	if err := sendEmail([]string{clientEmail}, clientSubject, clientBody); err != nil {
-		return fmt.Errorf("failed to send email to client: %v", err)
-	}
-
-	// Email to receiver
-	receiverSubject := "Incoming Parcel Delivery - MooveIt"
-	receiverBody := fmt.Sprintf(emailHeader+`
-				<div style="background-color: #f9f9f9; padding: 20px; border-radius: 5px;">
-					<h1 style="color: #2c3e50; text-align: center;">Incoming Parcel Delivery</h1>
-					<p>Hello %s,</p>
-					<p>A parcel is being delivered to you by <strong>%s</strong> (Car: <strong>%s</strong>).</p>
-					<p>You will be notified when the parcel arrives at your location.</p>
-					<div style="text-align: center; margin: 30px 0;">
-						<a href="%s/tracking" style="background-color: #4CAF50; color: white; padding: 12px 25px; text-decoration: none; border-radius: 5px;">Track Your Parcel</a>
-					</div>
-					<p>Best regards,<br>The MooveIt Team</p>
-				</div>`+emailFooter,
-		baseURL, receiverName, driverName, carPlate, baseURL)
-
-	if err := sendEmail([]string{receiverEmail}, receiverSubject, receiverBody); err != nil {
-		return fmt.Errorf("failed to send email to receiver: %v", err)
+func SendIncomingParcelEmail(receiverEmail, receiverName, driverName, carPlate, trackingCode string) error {
+	message, err := IncomingParcelMessage(receiverName, driverName, carPlate, trackingCode)
+	if err != nil {
+		return err
 	}
-
-	return nil
+	return SendEmail([]string{receiverEmail}, message.Subject, message.HTML)
 }
 
-func SendBookingRejectedEmail(clientEmail string) error {
-	subject := "Booking Rejected - MooveIt"
-	body := fmt.Sprintf(emailHeader+`
-				<div style="background-color: #f9f9f9; padding: 20px; border-radius: 5px;">
-					<h1 style="color: #2c3e50; text-align: center;">Booking Rejected</h1>
-					<p>Hello,</p>
-					<p>Unfortunately, your booking has been rejected by the driver.</p>
-					<p>Don't worry! You can try booking another available ride.</p>
-					<div style="text-align: center; margin: 30px 0;">
-						<a href="%s/rides" style="background-color: #4CAF50; color: white; padding: 12px 25px; text-decoration: none; border-radius: 5px;">Find Another Ride</a>
-					</div>
-					<p>Best regards,<br>The MooveIt Team</p>
-				</div>`+emailFooter,
-		baseURL, baseURL)
-	return sendEmail([]string{clientEmail}, subject, body)
+func SendPasswordResetEmail(userEmail, otp, language string) error {
+	message, err := RenderMessage("password_reset", language, map[string]interface{}{"otp": otp})
+	if err != nil {
+		return err
+	}
+	return SendEmail([]string{userEmail}, message.Subject, message.HTML)
 }
 
-func SendPasswordResetEmail(userEmail, otp string) error {
-	subject := "Password Reset OTP - MooveIt"
-	body := fmt.Sprintf(emailHeader+`
-				<div style="background-color: #f9f9f9; padding: 20px; border-radius: 5px;">
-					<h1 style="color: #2c3e50; text-align: center;">Password Reset</h1>
-					<p>Hello,</p>
-					<p>We received a request to reset your password for your MooveIt account.</p>
-					<p>Your 4-digit one-time password (OTP) for password reset is:</p>
-					<div style="text-align: center; margin: 20px 0; padding: 10px; background-color: #eee; font-size: 28px; font-weight: bold; letter-spacing: 8px;">
-						%s
-					</div>
-					<p>This OTP will expire in 15 minutes. If you did not request this reset, please ignore this email.</p>
-					<p>Best regards,<br>The MooveIt Team</p>
-				</div>`+emailFooter,
-		baseURL, otp)
-	return sendEmail([]string{userEmail}, subject, body)
+func SendEmailVerificationOTP(userEmail, otp, language string) error {
+	message, err := RenderMessage("email_verification", language, map[string]interface{}{"otp": otp})
+	if err != nil {
+		return err
+	}
+	return SendEmail([]string{userEmail}, message.Subject, message.HTML)
 }
 
-func SendEmailVerificationOTP(userEmail, otp string) error {
-	subject := "Email Verification - MooveIt"
-	body := fmt.Sprintf(emailHeader+`
-				<div style="background-color: #f9f9f9; padding: 20px; border-radius: 5px;">
-					<h1 style="color: #2c3e50; text-align: center;">Verify Your Email</h1>
-					<p>Hello,</p>
-					<p>Thank you for registering with MooveIt! To complete your registration, please verify your email address.</p>
-					<p>Your 4-digit email verification code is:</p>
-					<div style="text-align: center; margin: 20px 0; padding: 10px; background-color: #eee; font-size: 28px; font-weight: bold; letter-spacing: 8px;">
-						%s
-					</div>
-					<p>This verification code will expire in 15 minutes.</p>
-					<p>If you did not create this account, please ignore this email.</p>
-					<p>Best regards,<br>The MooveIt Team</p>
-				</div>`+emailFooter,
-		baseURL, otp)
-	return sendEmail([]string{userEmail}, subject, body)
+func SendParcelStatusEmail(receiverEmail, receiverName, trackingCode, status, note string) error {
+	message, err := ParcelStatusMessage(receiverName, trackingCode, status, note)
+	if err != nil {
+		return err
+	}
+	return SendEmail([]string{receiverEmail}, message.Subject, message.HTML)
 }
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// EnvDuration parses a duration such as "30s" from the environment, falling
+// back when it is unset or not a positive duration
+func EnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("Warning: invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return duration
+}
+
+// EnvInt parses a positive integer from the environment, falling back when
+// it is unset or invalid
+func EnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number <= 0 {
+		log.Printf("Warning: invalid %s %q, using %d", key, value, fallback)
+		return fallback
+	}
+	return number
+}
@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// DefaultLanguage is used when a user has no preferred language, or when a
+// message has not been translated into it
+const DefaultLanguage = "en"
+
+// Message is the text of a message on each channel. Channels the message's
+// templates do not define are left empty.
+type Message struct {
+	Title   string // push and in-app title
+	Body    string // push and in-app body
+	SMS     string
+	Subject string // email subject
+	HTML    string // email body
+}
+
+// messageTemplates holds the templates of one message in one language
+type messageTemplates struct {
+	text *template.Template     // title, body, sms and subject blocks
+	html *htmltemplate.Template // content block, inside the email layout
+}
+
+// templates by language, then message name
+var loadedTemplates map[string]map[string]*messageTemplates
+
+// templateFuncs are available to every template
+var templateFuncs = map[string]interface{}{
+	"trackingURL": TrackingURL,
+}
+
+// LoadMessageTemplates loads the message templates under dir, laid out as
+// <language>/<message>.txt for text channels and <language>/<message>.html
+// for email, with <language>/layout.html wrapping every email.
+func LoadMessageTemplates(dir string) error {
+	languages, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]map[string]*messageTemplates)
+	for _, language := range languages {
+		if !language.IsDir() {
+			continue
+		}
+		messages, err := loadLanguage(filepath.Join(dir, language.Name()))
+		if err != nil {
+			return fmt.Errorf("%s templates: %w", language.Name(), err)
+		}
+		loaded[language.Name()] = messages
+	}
+
+	if _, ok := loaded[DefaultLanguage]; !ok {
+		return fmt.Errorf("no %s templates in %s", DefaultLanguage, dir)
+	}
+	loadedTemplates = loaded
+	return nil
+}
+
+// loadLanguage parses the templates of one language
+func loadLanguage(dir string) (map[string]*messageTemplates, error) {
+	layout := htmltemplate.New("layout").Option("missingkey=error").Funcs(templateFuncs)
+	layoutFile := filepath.Join(dir, "layout.html")
+	if _, err := os.Stat(layoutFile); err == nil {
+		if layout, err = layout.ParseFiles(layoutFile); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make(map[string]*messageTemplates)
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		name := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+		if file.IsDir() || file.Name() == "layout.html" {
+			continue
+		}
+		if messages[name] == nil {
+			messages[name] = &messageTemplates{}
+		}
+
+		switch filepath.Ext(file.Name()) {
+		case ".txt":
+			t, err := template.New(name).Option("missingkey=error").Funcs(templateFuncs).ParseFiles(path)
+			if err != nil {
+				return nil, err
+			}
+			messages[name].text = t
+		case ".html":
+			base, err := layout.Clone()
+			if err != nil {
+				return nil, err
+			}
+			t, err := base.ParseFiles(path)
+			if err != nil {
+				return nil, err
+			}
+			messages[name].html = t
+		}
+	}
+	return messages, nil
+}
+
+// SupportedLanguage reports whether there are templates in a language
+func SupportedLanguage(language string) bool {
+	_, ok := loadedTemplates[language]
+	return ok
+}
+
+// HasMessage reports whether a message has templates in a language
+func HasMessage(name, language string) bool {
+	_, ok := loadedTemplates[language][name]
+	return ok
+}
+
+// RenderMessage fills in a message's templates in the given language, or in
+// English when it has not been translated. BASE_URL is available to the
+// templates as .baseURL.
+func RenderMessage(name, language string, data map[string]interface{}) (Message, error) {
+	templates, ok := loadedTemplates[language][name]
+	if !ok {
+		templates, ok = loadedTemplates[DefaultLanguage][name]
+	}
+	if !ok {
+		return Message{}, fmt.Errorf("no templates for message %q", name)
+	}
+
+	fields := map[string]interface{}{"baseURL": baseURL}
+	for key, value := range data {
+		fields[key] = value
+	}
+
+	var message Message
+	if templates.text != nil {
+		for block, out := range map[string]*string{
+			"title":   &message.Title,
+			"body":    &message.Body,
+			"sms":     &message.SMS,
+			"subject": &message.Subject,
+		} {
+			t := templates.text.Lookup(block)
+			if t == nil {
+				continue
+			}
+			var text bytes.Buffer
+			if err := t.Execute(&text, fields); err != nil {
+				return Message{}, err
+			}
+			*out = strings.TrimSpace(text.String())
+		}
+	}
+
+	if templates.html != nil {
+		block := "content"
+		if layout := templates.html.Lookup("layout"); layout != nil && layout.Tree != nil {
+			block = "layout"
+		}
+		var html bytes.Buffer
+		if err := templates.html.ExecuteTemplate(&html, block, fields); err != nil {
+			return Message{}, err
+		}
+		message.HTML = html.String()
+	}
+	return message, nil
+}
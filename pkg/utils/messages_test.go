@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const (
+	templatesDir = "../../templates"
+	testBaseURL  = "https://mooveit.example"
+)
+
+// sampleMessageData fills in every field the templates use
+var sampleMessageData = map[string]interface{}{
+	"amountApproved": "4500",
+	"breakUntil":     "18:30",
+	"carMake":        "Isuzu",
+	"carPlate":       "KDA 123A",
+	"clientName":     "Wanjiku",
+	"code":           "482913",
+	"count":          3,
+	"date":           "Mon 2 Mar 09:00",
+	"destination":    "Nakuru",
+	"detourKm":       "4.2",
+	"driverName":     "Otieno",
+	"eta":            "12",
+	"fare":           "2500",
+	"hours":          "10",
+	"minutes":        "15",
+	"note":           "Left with the gate guard",
+	"origin":         "Nairobi",
+	"otp":            "7731",
+	"pickupAddress":  "Moi Avenue",
+	"place":          "Westlands",
+	"price":          "3000",
+	"reason":         "Truck broke down",
+	"receiverName":   "Akinyi",
+	"status":         "delivered",
+	"trackingCode":   "MV7K2QX9HD",
+	"weightKg":       "120",
+}
+
+// sampleStatuses picks the status branch shown for messages that have one
+var sampleStatuses = map[string]string{
+	"claim_status": "approved",
+}
+
+// useTemplates loads the templates under dir for one test
+func useTemplates(t *testing.T, dir string) {
+	t.Helper()
+	previous, previousBaseURL := loadedTemplates, baseURL
+	t.Cleanup(func() { loadedTemplates, baseURL = previous, previousBaseURL })
+
+	t.Setenv("BASE_URL", testBaseURL)
+	baseURL = testBaseURL
+	if err := LoadMessageTemplates(dir); err != nil {
+		t.Fatalf("load templates: %v", err)
+	}
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatMessage lays out every channel of a message for a golden file
+func formatMessage(message Message) string {
+	var out strings.Builder
+	for _, channel := range []struct{ name, text string }{
+		{"title", message.Title},
+		{"body", message.Body},
+		{"sms", message.SMS},
+		{"subject", message.Subject},
+		{"html", message.HTML},
+	} {
+		if channel.text == "" {
+			continue
+		}
+		fmt.Fprintf(&out, "-- %s --\n%s\n", channel.name, strings.TrimSpace(channel.text))
+	}
+	return out.String()
+}
+
+func TestRenderMessageGolden(t *testing.T) {
+	useTemplates(t, templatesDir)
+
+	for _, language := range []string{"en", "sw"} {
+		if !SupportedLanguage(language) {
+			t.Fatalf("no %s templates", language)
+		}
+		for _, name := range sortedKeys(loadedTemplates[language]) {
+			t.Run(language+"/"+name, func(t *testing.T) {
+				data := make(map[string]interface{}, len(sampleMessageData))
+				for key, value := range sampleMessageData {
+					data[key] = value
+				}
+				if status, ok := sampleStatuses[name]; ok {
+					data["status"] = status
+				}
+
+				message, err := RenderMessage(name, language, data)
+				if err != nil {
+					t.Fatalf("render: %v", err)
+				}
+				got := formatMessage(message)
+
+				golden := filepath.Join("testdata", name+"."+language+".golden")
+				if *update {
+					if err := os.MkdirAll("testdata", 0o755); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("%v (run go test -update to create it)", err)
+				}
+				if got != string(want) {
+					t.Errorf("rendered message differs from %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestRenderMessageFallsBackToEnglish(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"en/greeting.txt": `{{define "title"}}Hello {{.name}}{{end}}`,
+		"en/farewell.txt": `{{define "title"}}Goodbye {{.name}}{{end}}`,
+		"sw/greeting.txt": `{{define "title"}}Habari {{.name}}{{end}}`,
+	}
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	useTemplates(t, dir)
+
+	tests := []struct {
+		name, language, want string
+	}{
+		{"greeting", "sw", "Habari Amani"},
+		{"farewell", "sw", "Goodbye Amani"}, // not translated
+		{"greeting", "fr", "Hello Amani"},   // unsupported language
+		{"farewell", "en", "Goodbye Amani"},
+	}
+	for _, tt := range tests {
+		message, err := RenderMessage(tt.name, tt.language, map[string]interface{}{"name": "Amani"})
+		if err != nil {
+			t.Fatalf("render %s in %s: %v", tt.name, tt.language, err)
+		}
+		if message.Title != tt.want {
+			t.Errorf("%s in %s: got title %q, want %q", tt.name, tt.language, message.Title, tt.want)
+		}
+	}
+
+	if _, err := RenderMessage("missing", "sw", nil); err == nil {
+		t.Error("rendering a message with no templates should fail")
+	}
+}
+
+// definedBlocks lists the blocks a message's templates define, leaving out
+// the templates named after the message and its files
+func definedBlocks(name string, templates *messageTemplates) map[string]bool {
+	blocks := make(map[string]bool)
+	if templates.text != nil {
+		for _, t := range templates.text.Templates() {
+			if t.Name() != name && !strings.Contains(t.Name(), ".") {
+				blocks["txt:"+t.Name()] = true
+			}
+		}
+	}
+	if templates.html != nil {
+		for _, t := range templates.html.Templates() {
+			if t.Name() != name && !strings.Contains(t.Name(), ".") {
+				blocks["html:"+t.Name()] = true
+			}
+		}
+	}
+	return blocks
+}
+
+func TestTranslationsDefineEveryEnglishBlock(t *testing.T) {
+	useTemplates(t, templatesDir)
+
+	english := loadedTemplates[DefaultLanguage]
+	for _, language := range sortedKeys(loadedTemplates) {
+		if language == DefaultLanguage {
+			continue
+		}
+		for _, name := range sortedKeys(loadedTemplates[language]) {
+			source, ok := english[name]
+			if !ok {
+				t.Errorf("%s/%s has no English original", language, name)
+				continue
+			}
+			translated := definedBlocks(name, loadedTemplates[language][name])
+			for _, block := range sortedKeys(definedBlocks(name, source)) {
+				if !translated[block] {
+					t.Errorf("%s/%s is missing the %s block", language, name, block)
+				}
+			}
+		}
+	}
+}
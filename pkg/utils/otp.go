@@ -31,14 +31,14 @@ func GenerateOTP(uniqueKey string) string {
 
 // SendPasswordResetOTP sends OTP via both email and SMS
 // If SMS fails, it logs the error but doesn't fail the entire operation
-func SendPasswordResetOTP(email, phone, otp string) error {
+func SendPasswordResetOTP(email, phone, otp, language string) error {
 	var emailSent bool
 	var errors []string
 
 	log.Printf("Attempting to send OTP to email: %s, phone: %s", email, phone)
 
 	// Send via email - this is critical and must succeed
-	if err := SendPasswordResetEmail(email, otp); err != nil {
+	if err := SendPasswordResetEmail(email, otp, language); err != nil {
 		errors = append(errors, fmt.Sprintf("failed to send OTP via email: %v", err))
 	} else {
 		emailSent = true
@@ -46,7 +46,7 @@ func SendPasswordResetOTP(email, phone, otp string) error {
 
 	// Send via SMS if phone is provided - this is optional
 	if phone != "" {
-		if err := SendPasswordResetSMS(phone, otp); err != nil {
+		if err := SendPasswordResetSMS(phone, otp, language); err != nil {
 			// Log SMS failure but don't fail the entire operation
 			log.Printf("Warning: Failed to send OTP via SMS to %s: %v", phone, err)
 			errors = append(errors, fmt.Sprintf("failed to send OTP via SMS: %v", err))
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrInvalidPolyline is returned for a malformed encoded polyline
+var ErrInvalidPolyline = errors.New("invalid encoded polyline")
+
+// DecodePolyline decodes a route in Google's encoded polyline format, as
+// returned by the Directions API and most mobile map SDKs
+func DecodePolyline(encoded string) ([]Point, error) {
+	var points []Point
+	var lat, lng int
+
+	for index := 0; index < len(encoded); {
+		var deltas [2]int
+		for i := range deltas {
+			result, shift := 0, 0
+			for {
+				if index >= len(encoded) {
+					return nil, ErrInvalidPolyline
+				}
+				b := int(encoded[index]) - 63
+				index++
+				if b < 0 || b > 63 {
+					return nil, ErrInvalidPolyline
+				}
+				result |= (b & 0x1f) << shift
+				shift += 5
+				if b < 0x20 {
+					break
+				}
+			}
+			if result&1 != 0 {
+				deltas[i] = ^(result >> 1)
+			} else {
+				deltas[i] = result >> 1
+			}
+		}
+
+		lat += deltas[0]
+		lng += deltas[1]
+		points = append(points, Point{Lat: float64(lat) / 1e5, Lng: float64(lng) / 1e5})
+	}
+
+	return points, nil
+}
+
+// RoutePosition describes where a point lies relative to a route
+type RoutePosition struct {
+	OffsetKm float64 // distance from the point to the nearest point of the route
+	AlongKm  float64 // distance from the start of the route to that nearest point
+}
+
+// LocateOnRoute finds the point of the route closest to p. Each segment is
+// projected onto a flat plane around its start, which is accurate enough for
+// the few kilometres a corridor spans.
+func LocateOnRoute(route []Point, p Point) RoutePosition {
+	best := RoutePosition{OffsetKm: math.Inf(1)}
+	if len(route) == 1 {
+		return RoutePosition{OffsetKm: HaversineDistance(p.Lat, p.Lng, route[0].Lat, route[0].Lng)}
+	}
+
+	travelled := 0.0
+	for i := 0; i+1 < len(route); i++ {
+		start, end := route[i], route[i+1]
+
+		// Kilometres east and north of the segment start
+		kmPerLng := 111.32 * math.Cos(start.Lat*math.Pi/180)
+		const kmPerLat = 110.574
+		ex, ey := (end.Lng-start.Lng)*kmPerLng, (end.Lat-start.Lat)*kmPerLat
+		px, py := (p.Lng-start.Lng)*kmPerLng, (p.Lat-start.Lat)*kmPerLat
+
+		length := math.Hypot(ex, ey)
+		t := 0.0
+		if length > 0 {
+			t = math.Max(0, math.Min(1, (px*ex+py*ey)/(length*length)))
+		}
+
+		offset := math.Hypot(px-t*ex, py-t*ey)
+		if offset < best.OffsetKm {
+			best = RoutePosition{OffsetKm: offset, AlongKm: travelled + t*length}
+		}
+		travelled += length
+	}
+
+	return best
+}
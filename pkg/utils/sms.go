@@ -11,7 +11,7 @@ import (
 
 // We'll load credentials dynamically when sending SMS to ensure
 // they're available at runtime rather than just at init time
-func sendSMS(message string, recipients []string) error {
+func SendSMS(message string, recipients []string) error {
 	// Load credentials dynamically each time we send an SMS
 	username := os.Getenv("AT_USERNAME")
 	apiKey := os.Getenv("AT_API_KEY")
@@ -66,41 +66,86 @@ func sendSMS(message string, recipients []string) error {
 	return nil
 }
 
-func SendNewBookingNotificationToDriver(driverPhone, destination, clientName string) error {
-	msg := fmt.Sprintf("Your ride to %s has been booked by %s. Please log in to accept or reject the booking.",
-		destination, clientName)
+// IncomingParcelMessage tells a receiver a parcel is on its way to them.
+// Receivers have no account, so it is always in the default language.
+func IncomingParcelMessage(receiverName, driverName, carPlate, trackingCode string) (Message, error) {
+	return RenderMessage("incoming_parcel", DefaultLanguage, map[string]interface{}{
+		"receiverName": receiverName,
+		"driverName":   driverName,
+		"carPlate":     carPlate,
+		"trackingCode": trackingCode,
+	})
+}
 
-	return sendSMS(msg, []string{driverPhone})
+func SendIncomingParcelSMS(receiverPhone, receiverName, driverName, carPlate, trackingCode string) error {
+	message, err := IncomingParcelMessage(receiverName, driverName, carPlate, trackingCode)
+	if err != nil {
+		return err
+	}
+	return SendSMS(message.SMS, []string{receiverPhone})
 }
 
-func SendBookingAcceptedSMS(clientPhone, driverName, carPlate, receiverPhone, receiverName string) error {
-	// Message to client
-	clientMsg := fmt.Sprintf("Your booking has been accepted by driver %s (Car: %s). Your parcel is now ready for delivery.",
-		driverName, carPlate)
+func SendPasswordResetSMS(userPhone, otp, language string) error {
+	message, err := RenderMessage("password_reset", language, map[string]interface{}{"otp": otp})
+	if err != nil {
+		return err
+	}
+	return SendSMS(message.SMS, []string{userPhone})
+}
 
-	// Message to receiver
-	receiverMsg := fmt.Sprintf("Hello %s, a parcel is being delivered to you by %s (Car: %s). You will be notified when the parcel arrives.",
-		receiverName, driverName, carPlate)
+// parcelStatusMessages describes each parcel status to the receiver
+var parcelStatusMessages = map[string]string{
+	"picked_up":  "has been picked up by the driver",
+	"in_transit": "is on its way to you",
+	"delivered":  "has been delivered",
+	"failed":     "could not be delivered",
+	"returned":   "is being returned to the sender",
+}
 
-	// Send to client
-	if err := sendSMS(clientMsg, []string{clientPhone}); err != nil {
-		return fmt.Errorf("failed to send SMS to client: %v", err)
+// ParcelStatusText describes a parcel status in plain words
+func ParcelStatusText(status string) string {
+	if text, ok := parcelStatusMessages[status]; ok {
+		return text
 	}
+	return "has been updated"
+}
 
-	// Send to receiver
-	if err := sendSMS(receiverMsg, []string{receiverPhone}); err != nil {
-		return fmt.Errorf("failed to send SMS to receiver: %v", err)
+// ParcelStatusMessage tells a receiver their parcel changed status
+func ParcelStatusMessage(receiverName, trackingCode, status, note string) (Message, error) {
+	return RenderMessage("parcel_status", DefaultLanguage, map[string]interface{}{
+		"receiverName": receiverName,
+		"trackingCode": trackingCode,
+		"status":       status,
+		"note":         note,
+	})
+}
+
+func SendParcelStatusSMS(receiverPhone, receiverName, trackingCode, status, note string) error {
+	message, err := ParcelStatusMessage(receiverName, trackingCode, status, note)
+	if err != nil {
+		return err
 	}
+	return SendSMS(message.SMS, []string{receiverPhone})
+}
 
-	return nil
+// DeliveryCodeMessage gives a receiver the code that confirms delivery
+func DeliveryCodeMessage(receiverName, trackingCode, code string) (Message, error) {
+	return RenderMessage("delivery_code", DefaultLanguage, map[string]interface{}{
+		"receiverName": receiverName,
+		"trackingCode": trackingCode,
+		"code":         code,
+	})
 }
 
-func SendBookingRejectedSMS(clientPhone string) error {
-	msg := "Your booking has been rejected by the driver. Please try booking another available ride."
-	return sendSMS(msg, []string{clientPhone})
+func SendDeliveryCodeSMS(receiverPhone, receiverName, trackingCode, code string) error {
+	message, err := DeliveryCodeMessage(receiverName, trackingCode, code)
+	if err != nil {
+		return err
+	}
+	return SendSMS(message.SMS, []string{receiverPhone})
 }
 
-func SendPasswordResetSMS(userPhone, otp string) error {
-	msg := fmt.Sprintf("Your MooveIt 4-digit password reset OTP is: %s. This code will expire in 15 minutes.", otp)
-	return sendSMS(msg, []string{userPhone})
+// TrackingURL is the public page where a parcel can be tracked without an account
+func TrackingURL(trackingCode string) string {
+	return strings.TrimRight(os.Getenv("BASE_URL"), "/") + "/track/" + trackingCode
 }
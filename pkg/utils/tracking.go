@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+// trackingAlphabet omits characters that are easily confused (0/O, 1/I/L)
+const trackingAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+// GenerateTrackingCode returns a random public parcel tracking code such as "MV7K2QX9HD"
+func GenerateTrackingCode() (string, error) {
+	code := make([]byte, 8)
+	max := big.NewInt(int64(len(trackingAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = trackingAlphabet[n.Int64()]
+	}
+	return "MV" + string(code), nil
+}